@@ -0,0 +1,257 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type adoptParameters struct {
+	OptionContext *string
+	OptionId      *StringListOption
+	OptionOwner   *string
+	OptionRegion  *string
+	OptionTag     *StringListOption
+	OptionVerbose *bool
+}
+
+var DEFAULT_ADOPT_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_ADOPT_OWNER string = DEFAULT_OWNER
+var DEFAULT_ADOPT_REGION string = "*"
+var DEFAULT_ADOPT_VERBOSE bool = false
+
+var adoptParams adoptParameters
+
+var adoptProcOptionId map[string]bool
+var adoptProcOptionRegion []string
+var adoptProcOptionTag map[string]string
+
+func PrintAdoptUsage() {
+	fmt.Printf(`Usage: %s adopt [options]
+       %s recover [options]
+
+Rebuild the fleets and instances of a context from the spot fleet requests
+running on AWS EC2. This is useful when the context file has been lost or when
+the fleets have been launched from another machine.
+Only the active fleets launched by %s and tagged with the owner are adopted,
+unless they are explicitly specified with their id. Fleets already present in
+the context are left untouched. Fleets with a name already used in the context
+are ignored with a warning.
+The names, users and properties of the adopted fleets and instances are
+recovered from their EC2 tags.
+
+Options:
+
+  --context <path>            path of the context file (default: '%s')
+
+  --id <fleet-id>             only adopt the fleet with the specified spot
+                              fleet request id, can be specified many times
+
+  --owner <name>              only adopt the fleets tagged with the specified
+                              owner, or any owner if empty (default: '%s')
+
+  --region <region-name>      search in the specified region instead of every
+                              regions, accept multiple region names separated
+                              by commas or '*'
+
+  --tag <key>=<value>         only adopt the fleets with the specified EC2 tag,
+                              can be specified many times
+
+  --verbose                   print the adopted fleets
+`,
+		PROGNAME, PROGNAME, PROGNAME, DEFAULT_CONTEXT, DEFAULT_ADOPT_OWNER)
+}
+
+func processAdoptOptionId() {
+	var id string
+
+	adoptProcOptionId = make(map[string]bool)
+
+	for _, id = range adoptParams.OptionId.Values {
+		adoptProcOptionId[id] = true
+	}
+}
+
+func processAdoptOptionRegion() {
+	if *adoptParams.OptionRegion == "*" {
+		adoptProcOptionRegion = ListRegions()
+	} else {
+		adoptProcOptionRegion = strings.Split(*adoptParams.OptionRegion,
+			",")
+	}
+}
+
+func processAdoptOptionTag() {
+	var err error
+
+	adoptProcOptionTag = make(map[string]string)
+
+	err = ParseTagSpecs(adoptProcOptionTag, adoptParams.OptionTag.Values)
+	if err != nil {
+		Error("%s", err.Error())
+	}
+}
+
+// Indicate if the given remote fleet matches the filters specified on the
+// command line.
+// Fleets specified by id are always adopted. Otherwise, only the fleets
+// launched by ec2tools with the requested owner and tags are adopted.
+//
+func matchAdoptFilters(fleet *RemoteFleet) bool {
+	var key, value, tag string
+	var found bool
+
+	if len(adoptProcOptionId) > 0 {
+		if !adoptProcOptionId[fleet.Id] {
+			return false
+		}
+	} else {
+		if _, found = fleet.Tags[TAG_CONTEXT]; !found {
+			return false
+		}
+
+		if (*adoptParams.OptionOwner != "") &&
+			(fleet.Tags[TAG_OWNER] != *adoptParams.OptionOwner) {
+			return false
+		}
+	}
+
+	for key, value = range adoptProcOptionTag {
+		tag, found = fleet.Tags[key]
+		if !found || (tag != value) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Add the given remote fleet to the given context.
+// The fleet name and user are taken from the fleet tags, or respectively from
+// the fleet id and the default user if they are not tagged.
+// Return the added fleet or nil if the fleet cannot be added.
+//
+func adoptFleet(ctx *Ec2Index, remote *RemoteFleet) *Ec2Fleet {
+	var fleet *Ec2Fleet
+	var name, user string
+	var found bool
+	var err error
+
+	name, found = remote.Tags[TAG_FLEET]
+	if !found || (name == "") {
+		name = remote.Id
+	}
+
+	user, found = remote.Tags[TAG_USER]
+	if !found || (user == "") {
+		user = DEFAULT_USER
+	}
+
+	fleet, err = ctx.AddEc2Fleet(remote.Id, name, user, remote.Region,
+		remote.Size)
+	if err != nil {
+		Warning("cannot adopt fleet '%s' (%s): name '%s' already used",
+			remote.Id, remote.Region, name)
+		return nil
+	}
+
+	fleet.Volumes = remote.Volumes
+
+	return fleet
+}
+
+func doAdopt(ctx *Ec2Index) {
+	var adopted []*Ec2Fleet = make([]*Ec2Fleet, 0)
+	var instances []*Ec2Instance = make([]*Ec2Instance, 0)
+	var known map[string]bool = make(map[string]bool)
+	var remotes []*RemoteFleet
+	var remote *RemoteFleet
+	var fleet *Ec2Fleet
+	var err error
+
+	for _, fleet = range ctx.FleetsByName {
+		known[fleet.Id] = true
+	}
+
+	remotes, err = DiscoverFleets(adoptProcOptionRegion)
+	if err != nil {
+		Warning("cannot fetch fleets of some regions: %s", err.Error())
+	}
+
+	for _, remote = range remotes {
+		if known[remote.Id] || !matchAdoptFilters(remote) {
+			continue
+		}
+
+		fleet = adoptFleet(ctx, remote)
+		if fleet == nil {
+			continue
+		}
+
+		if *adoptParams.OptionVerbose {
+			fmt.Fprintf(os.Stderr, "[ec2tools] adopt %s (%s) as %s\n",
+				remote.Id, remote.Region, fleet.Name)
+		}
+
+		adopted = append(adopted, fleet)
+	}
+
+	if len(adopted) == 0 {
+		return
+	}
+
+	// Store the adopted fleets first so a failing probe does not lose them
+	err = StoreEc2Index(*adoptParams.OptionContext, ctx)
+	if err != nil {
+		Error("cannot save context: %s", err.Error())
+	}
+
+	UpdateContext(ctx)
+
+	for _, fleet = range adopted {
+		instances = append(instances, fleet.Instances...)
+	}
+
+	err = LoadAttributeTags(instances)
+	if err != nil {
+		Warning("cannot fetch properties: %s", err.Error())
+	}
+}
+
+func Adopt(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var ctx *Ec2Index
+	var err error
+
+	adoptParams.OptionContext = flags.String("context", DEFAULT_ADOPT_CONTEXT, "")
+	adoptParams.OptionId = NewStringListOption()
+	flags.Var(adoptParams.OptionId, "id", "")
+	adoptParams.OptionOwner = flags.String("owner", DEFAULT_ADOPT_OWNER, "")
+	adoptParams.OptionRegion = flags.String("region", DEFAULT_ADOPT_REGION, "")
+	adoptParams.OptionTag = NewStringListOption()
+	flags.Var(adoptParams.OptionTag, "tag", "")
+	adoptParams.OptionVerbose = flags.Bool("verbose", DEFAULT_ADOPT_VERBOSE, "")
+
+	flags.Parse(args[1:])
+
+	if len(flags.Args()) > 0 {
+		Error("unexpected operand: %s", flags.Args()[0])
+	}
+
+	processAdoptOptionId()
+	processAdoptOptionRegion()
+	processAdoptOptionTag()
+
+	ctx, err = LoadEc2Index(*adoptParams.OptionContext)
+	if err != nil {
+		ctx = NewEc2Index()
+	}
+
+	doAdopt(ctx)
+
+	err = StoreEc2Index(*adoptParams.OptionContext, ctx)
+	if err != nil {
+		Error("cannot save context: %s", err.Error())
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+)
+
+// Set the adopt filters to the given values.
+// Return a function restoring the previous filters.
+//
+func setAdoptTestFilters(ids []string, owner string, tags []string) func() {
+	var params adoptParameters = adoptParams
+	var procIds map[string]bool = adoptProcOptionId
+	var procTags map[string]string = adoptProcOptionTag
+
+	adoptParams.OptionId = NewStringListOption()
+	adoptParams.OptionOwner = &owner
+	adoptParams.OptionTag = NewStringListOption()
+
+	adoptParams.OptionId.Values = ids
+	adoptParams.OptionTag.Values = tags
+
+	processAdoptOptionId()
+	processAdoptOptionTag()
+
+	return func() {
+		adoptParams = params
+		adoptProcOptionId = procIds
+		adoptProcOptionTag = procTags
+	}
+}
+
+func TestMatchAdoptFiltersOwner(t *testing.T) {
+	var mine RemoteFleet = RemoteFleet{Id: "sfr-0", Tags: map[string]string{
+		TAG_CONTEXT: "/ctx", TAG_OWNER: "alice"}}
+	var theirs RemoteFleet = RemoteFleet{Id: "sfr-1", Tags: map[string]string{
+		TAG_CONTEXT: "/ctx", TAG_OWNER: "bob"}}
+	var foreign RemoteFleet = RemoteFleet{Id: "sfr-2", Tags: map[string]string{
+		TAG_OWNER: "alice"}}
+
+	defer setAdoptTestFilters(nil, "alice", nil)()
+
+	if !matchAdoptFilters(&mine) || matchAdoptFilters(&theirs) ||
+		matchAdoptFilters(&foreign) {
+		t.Fail()
+	}
+
+	defer setAdoptTestFilters(nil, "", nil)()
+
+	if !matchAdoptFilters(&mine) || !matchAdoptFilters(&theirs) ||
+		matchAdoptFilters(&foreign) {
+		t.Fail()
+	}
+}
+
+func TestMatchAdoptFiltersId(t *testing.T) {
+	var tagged RemoteFleet = RemoteFleet{Id: "sfr-0", Tags: map[string]string{
+		TAG_CONTEXT: "/ctx", TAG_OWNER: "alice"}}
+	var untagged RemoteFleet = RemoteFleet{Id: "sfr-1",
+		Tags: map[string]string{}}
+
+	defer setAdoptTestFilters([]string{"sfr-1"}, "bob", nil)()
+
+	if matchAdoptFilters(&tagged) || !matchAdoptFilters(&untagged) {
+		t.Fail()
+	}
+}
+
+func TestMatchAdoptFiltersTag(t *testing.T) {
+	var prod RemoteFleet = RemoteFleet{Id: "sfr-0", Tags: map[string]string{
+		TAG_CONTEXT: "/ctx", "stage": "prod"}}
+	var test RemoteFleet = RemoteFleet{Id: "sfr-1", Tags: map[string]string{
+		TAG_CONTEXT: "/ctx", "stage": "test"}}
+	var none RemoteFleet = RemoteFleet{Id: "sfr-2", Tags: map[string]string{
+		TAG_CONTEXT: "/ctx"}}
+
+	defer setAdoptTestFilters(nil, "", []string{"stage=prod"})()
+
+	if !matchAdoptFilters(&prod) || matchAdoptFilters(&test) ||
+		matchAdoptFilters(&none) {
+		t.Fail()
+	}
+
+	defer setAdoptTestFilters([]string{"sfr-1"}, "", []string{"stage=prod"})()
+
+	if matchAdoptFilters(&test) {
+		t.Fail()
+	}
+}
+
+func TestAdoptFleet(t *testing.T) {
+	var ctx *Ec2Index = NewEc2Index()
+	var volumes []*Ec2Volume = []*Ec2Volume{&Ec2Volume{Device: "/dev/sdb",
+		Size: 100}}
+	var named RemoteFleet = RemoteFleet{Id: "sfr-0", Region: "eu-west-1",
+		Size: 3, Volumes: volumes, Tags: map[string]string{
+			TAG_FLEET: "workers", TAG_USER: "admin"}}
+	var anonymous RemoteFleet = RemoteFleet{Id: "sfr-1",
+		Region: "us-east-1", Size: 1, Tags: map[string]string{}}
+	var conflict RemoteFleet = RemoteFleet{Id: "sfr-2",
+		Region: "us-east-1", Size: 1, Tags: map[string]string{
+			TAG_FLEET: "workers"}}
+	var fleet *Ec2Fleet
+
+	fleet = adoptFleet(ctx, &named)
+	if (fleet == nil) || (fleet.Id != "sfr-0") || (fleet.Name != "workers") ||
+		(fleet.User != "admin") || (fleet.Region != "eu-west-1") ||
+		(fleet.Size != 3) || (len(fleet.Volumes) != 1) ||
+		(ctx.FleetsByName["workers"] != fleet) {
+		t.Fail()
+	}
+
+	fleet = adoptFleet(ctx, &anonymous)
+	if (fleet == nil) || (fleet.Name != "sfr-1") ||
+		(fleet.User != DEFAULT_USER) {
+		t.Fail()
+	}
+
+	fleet = adoptFleet(ctx, &conflict)
+	if (fleet != nil) || (len(ctx.FleetsByName) != 2) {
+		t.Fail()
+	}
+}
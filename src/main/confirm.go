@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"os"
+	"strings"
+)
+
+// The error code returned by AWS EC2 when a request sent with DryRun would
+// have succeeded.
+//
+const DRY_RUN_SUCCESS_CODE string = "DryRunOperation"
+
+var DEFAULT_DRY_RUN bool = false
+var DEFAULT_YES bool = false
+
+var optionDryRun *bool
+var optionYes *bool
+
+// Indicate if the given file is a terminal.
+//
+func IsTerminal(file *os.File) bool {
+	var info os.FileInfo
+	var err error
+
+	info, err = file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return ((info.Mode() & os.ModeCharDevice) != 0)
+}
+
+// Interpret the error returned by an AWS EC2 request sent with DryRun.
+// Return nil if the request would have succeeded or the reason why it would
+// have failed otherwise.
+//
+func CheckDryRunError(err error) error {
+	var aerr awserr.Error
+	var ok bool
+
+	if err == nil {
+		return nil
+	}
+
+	aerr, ok = err.(awserr.Error)
+	if ok && (aerr.Code() == DRY_RUN_SUCCESS_CODE) {
+		return nil
+	}
+
+	return err
+}
+
+// Print what a command would do if it was not run in dry-run mode.
+//
+func DryRunPrint(format string, a ...interface{}) {
+	fmt.Printf("[dry-run] ")
+	fmt.Printf(format, a...)
+	fmt.Printf("\n")
+}
+
+// Ask the user to confirm a destructive operation described by the given
+// format and arguments.
+// Do not ask anything and consider the operation confirmed if assumeYes is
+// true or if the standard input is not a terminal.
+// Exit with an error if the user does not confirm.
+//
+func ConfirmOrExit(assumeYes bool, format string, a ...interface{}) {
+	var reader *bufio.Reader
+	var answer string
+	var err error
+
+	if assumeYes || !IsTerminal(os.Stdin) {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, format, a...)
+	fmt.Fprintf(os.Stderr, " [y/N] ")
+
+	reader = bufio.NewReader(os.Stdin)
+	answer, err = reader.ReadString('\n')
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\n")
+	}
+
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	if (answer == "y") || (answer == "yes") {
+		return
+	}
+
+	Warning("operation aborted")
+	os.Exit(1)
+}
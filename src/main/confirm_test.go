@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"testing"
+)
+
+func TestCheckDryRunError(t *testing.T) {
+	var err error
+
+	if CheckDryRunError(nil) != nil {
+		t.Fail()
+	}
+
+	err = awserr.New(DRY_RUN_SUCCESS_CODE, "would succeed", nil)
+	if CheckDryRunError(err) != nil {
+		t.Fail()
+	}
+
+	err = awserr.New("UnauthorizedOperation", "not allowed", nil)
+	if CheckDryRunError(err) != err {
+		t.Fail()
+	}
+
+	err = errors.New("network error")
+	if CheckDryRunError(err) != err {
+		t.Fail()
+	}
+}
@@ -38,6 +38,7 @@ func (this *Ec2IndexError) Error() string {
 type Ec2Index struct {
 	FleetsByName    map[string]*Ec2Fleet    // every fleets listed by Name
 	InstancesByName map[string]*Ec2Instance // every instances by Name
+	SshConfig       *SshConfigSettings      // automatic ssh config or nil
 	uniqueCounter   int                     // unique id of next instance
 }
 
@@ -51,6 +52,7 @@ type Ec2Fleet struct {
 	User      string         // name to use to ssh instances of the fleet
 	Region    string         // ec2 region code for this fleet
 	Size      int            // maximal size of the fleet
+	Volumes   []*Ec2Volume   // storage attached to each instance
 	Instances []*Ec2Instance // instances of this fleet
 	Index     *Ec2Index      // pointer to the index
 }
@@ -102,6 +104,7 @@ func (this *Ec2Index) AddEc2Fleet(id, name, user, region string, size int) (*Ec2
 	fleet.User = user
 	fleet.Region = region
 	fleet.Size = size
+	fleet.Volumes = make([]*Ec2Volume, 0)
 	fleet.Instances = make([]*Ec2Instance, 0)
 	fleet.Index = this
 
@@ -192,7 +195,8 @@ func (this *Ec2Fleet) AddEc2Instance(name, publicIp, privateIp string) (*Ec2Inst
 type ec2index struct {
 	Fleets []*ec2fleet // storage for Ec2Index.FleetsByName
 	// InstancesByName: computable from ec2index.fleets
-	UniqueCounter int // storage for Ec2Index.uniqueCounter
+	UniqueCounter int                // storage for Ec2Index.uniqueCounter
+	SshConfig     *SshConfigSettings `json:",omitempty"` // storage for Ec2Index.SshConfig
 }
 
 // Storage type for Ec2Fleet.
@@ -204,6 +208,7 @@ type ec2fleet struct {
 	User      string         // storage for Ec2Fleet.User
 	Region    string         // storage for Ec2Fleet.Region
 	Size      int            // storage for Ec2Fleet.Size
+	Volumes   []*Ec2Volume   `json:",omitempty"` // storage for Ec2Fleet.Volumes
 	Instances []*ec2instance // storage for Ec2Fleet.Instances
 }
 
@@ -232,6 +237,7 @@ func packEc2Index(idx *Ec2Index) *ec2index {
 
 	pidx.Fleets = make([]*ec2fleet, 0, len(idx.FleetsByName))
 	pidx.UniqueCounter = idx.uniqueCounter
+	pidx.SshConfig = idx.SshConfig
 
 	sortedFleetsName = make([]string, 0, len(idx.FleetsByName))
 
@@ -262,6 +268,7 @@ func packEc2Fleet(fleet *Ec2Fleet) *ec2fleet {
 	pfleet.User = fleet.User
 	pfleet.Region = fleet.Region
 	pfleet.Size = fleet.Size
+	pfleet.Volumes = fleet.Volumes
 	pfleet.Instances = make([]*ec2instance, 0, len(fleet.Instances))
 
 	for _, instance = range fleet.Instances {
@@ -314,6 +321,7 @@ func unpackEc2Index(pidx *ec2index) *Ec2Index {
 	}
 
 	idx.uniqueCounter = pidx.UniqueCounter
+	idx.SshConfig = pidx.SshConfig
 
 	return &idx
 }
@@ -332,6 +340,7 @@ func unpackEc2Fleet(idx *Ec2Index, pfleet *ec2fleet) *Ec2Fleet {
 	fleet.User = pfleet.User
 	fleet.Region = pfleet.Region
 	fleet.Size = pfleet.Size
+	fleet.Volumes = pfleet.Volumes
 	fleet.Instances = make([]*Ec2Instance, 0, len(pfleet.Instances))
 	fleet.Index = idx
 
@@ -386,12 +395,23 @@ func LoadEc2Index(path string) (*Ec2Index, error) {
 // Store an index into a json file.
 // Start by converting the index in a smaller, more compact data structure
 // without pointer loop, then marshal this data structure in json.
+// If the index has an automatic ssh config, write it again, only printing a
+// warning if it fails.
+// The file is removed if the index has no fleet, unless it has an automatic
+// ssh config, which must be kept for the next fleets.
 //
 func StoreEc2Index(path string, idx *Ec2Index) error {
 	var raw []byte
 	var err error
 
-	if len(idx.FleetsByName) == 0 {
+	if idx.SshConfig != nil {
+		err = idx.SshConfig.Write(path, idx)
+		if err != nil {
+			Warning("cannot write ssh config: %s", err.Error())
+		}
+	}
+
+	if (len(idx.FleetsByName) == 0) && (idx.SshConfig == nil) {
 		os.Remove(path)
 		return nil
 	}
@@ -694,3 +714,42 @@ func (this *Ec2Index) Select(specs []string) (*Ec2Selection, error) {
 
 	return &selection, nil
 }
+
+// Return the instances of this selection without duplicates, in the order of
+// their first occurrence.
+//
+func (this *Ec2Selection) Unique() []*Ec2Instance {
+	var seen map[*Ec2Instance]bool = make(map[*Ec2Instance]bool)
+	var instances []*Ec2Instance = make([]*Ec2Instance, 0)
+	var instance *Ec2Instance
+
+	for _, instance = range this.Instances {
+		if seen[instance] {
+			continue
+		}
+
+		seen[instance] = true
+		instances = append(instances, instance)
+	}
+
+	return instances
+}
+
+// Return the instances of this selection with a public IP, without
+// duplicates, in the order of their first occurrence.
+// If warn is true, print a warning for each instance without public IP.
+//
+func (this *Ec2Selection) Reachable(warn bool) []*Ec2Instance {
+	var instances []*Ec2Instance = make([]*Ec2Instance, 0)
+	var instance *Ec2Instance
+
+	for _, instance = range this.Unique() {
+		if instance.PublicIp != "" {
+			instances = append(instances, instance)
+		} else if warn {
+			Warning("instance %s has no public ip", instance.Name)
+		}
+	}
+
+	return instances
+}
@@ -268,6 +268,39 @@ func TestFilterDuplicateInstanceEc2Selection(t *testing.T) {
 	}
 }
 
+func TestUniqueReachableEc2Selection(t *testing.T) {
+	var idx *Ec2Index = NewEc2Index()
+	var instances []*Ec2Instance
+	var fleet *Ec2Fleet
+	var sel *Ec2Selection
+	var err error
+
+	fleet, _ = idx.AddEc2Fleet("0", "fleet0", "u", "r", 3)
+	fleet.AddEc2Instance("i0", "0.0.0.0", "1.0.0.0")
+	fleet.AddEc2Instance("i1", "", "1.0.0.1")
+	fleet.AddEc2Instance("i2", "0.0.0.2", "1.0.0.2")
+
+	sel, err = idx.Select([]string{"i2", "//", "i1"})
+	if (sel == nil) || (err != nil) {
+		t.FailNow()
+	}
+
+	instances = sel.Unique()
+	if len(instances) != 3 {
+		t.FailNow()
+	} else if (instances[0].Name != "i2") ||
+		(instances[1].Name != "i0") || (instances[2].Name != "i1") {
+		t.Fail()
+	}
+
+	instances = sel.Reachable(false)
+	if len(instances) != 2 {
+		t.FailNow()
+	} else if (instances[0].Name != "i2") || (instances[1].Name != "i0") {
+		t.Fail()
+	}
+}
+
 func TestFilterFleetEc2Selection(t *testing.T) {
 	var idx *Ec2Index = NewEc2Index()
 	var fleet0, fleet1 *Ec2Fleet
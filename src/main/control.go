@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The value of the '--control-persist' option which disables the connection
+// multiplexing.
+//
+const CONTROL_PERSIST_NONE string = "none"
+
+var DEFAULT_CONTROL_PERSIST string = "5m"
+
+var optionControlPersist *string
+
+// The ssh connections to the instances are multiplexed with the OpenSSH
+// ControlMaster feature. The first ssh or scp command to an instance opens a
+// master connection which stays in background for a while after the command
+// exits. The next commands to this instance reuse the master connection
+// instead of doing a new TCP and SSH handshake.
+// The control sockets of a context are stored in their own directory so stop
+// can close its master connections.
+//
+type SshControl struct {
+	Directory string // directory of the control sockets
+	Persist   int    // seconds the master connections stay idle
+}
+
+// Return the directory of the control sockets for the context with the given
+// path.
+// The directory name is derived from the absolute context path and kept short
+// because the control socket paths are limited in size.
+//
+func ControlDirectory(contextPath string) string {
+	var sum [sha1.Size]byte
+
+	sum = sha1.Sum([]byte(ContextTagValue(contextPath)))
+
+	return filepath.Join(os.TempDir(), fmt.Sprintf("ec2tools-%d",
+		os.Getuid()), hex.EncodeToString(sum[:])[:16])
+}
+
+// Create a new SshControl for the context with the given path and the given
+// '--control-persist' option value.
+// Return nil with no error if the multiplexing is disabled, or an error if
+// the option value is invalid.
+//
+func NewSshControl(contextPath, persist string) (*SshControl, error) {
+	var this SshControl
+	var ok bool
+
+	if persist == CONTROL_PERSIST_NONE {
+		return nil, nil
+	}
+
+	this.Persist, ok = ParseTimespec(persist)
+	if !ok {
+		return nil, fmt.Errorf("invalid control-persist: '%s'",
+			persist)
+	} else if this.Persist == 0 {
+		return nil, nil
+	}
+
+	this.Directory = ControlDirectory(contextPath)
+
+	return &this, nil
+}
+
+// Create a new SshControl for the context with the given path and the given
+// '--control-persist' option value and prepare its directory.
+// Exit with an error if the option value is invalid. Return nil with a
+// warning if the directory cannot be created.
+//
+func OpenSshControl(contextPath, persist string) *SshControl {
+	var control *SshControl
+	var err error
+
+	control, err = NewSshControl(contextPath, persist)
+	if err != nil {
+		Error("%s", err.Error())
+	} else if control == nil {
+		return nil
+	}
+
+	err = control.Prepare()
+	if err != nil {
+		Warning("cannot reuse ssh connections: %s", err.Error())
+		return nil
+	}
+
+	return control
+}
+
+// Return the path of the control sockets to the instance with the given
+// alias, as an OpenSSH ControlPath pattern.
+// Each instance has its own sockets, one per remote user, so the master
+// connections to an instance can be closed without closing the others.
+//
+func (this *SshControl) Path(alias string) string {
+	return filepath.Join(this.Directory, alias+"-%r")
+}
+
+// Return the ssh options to reuse or open master connections to the instance
+// with the given alias.
+// If master is false, reuse the existing master connections but do not open
+// new ones. This is necessary when the ssh command keeps its stderr open in
+// background, like in verbose mode.
+//
+func (this *SshControl) Options(alias string, master bool) []string {
+	var mode string = "auto"
+
+	if !master {
+		mode = "no"
+	}
+
+	return []string{
+		"-o", "ControlMaster=" + mode,
+		"-o", "ControlPath=" + this.Path(alias),
+		"-o", "ControlPersist=" + strconv.Itoa(this.Persist),
+	}
+}
+
+// Create the directory of the control sockets if it does not exist yet.
+// The directory is only accessible by the current user.
+//
+func (this *SshControl) Prepare() error {
+	return os.MkdirAll(this.Directory, 0700)
+}
+
+// Close the master connections opened to the given instances for the context
+// with the given path, then remove the control socket directory if it is
+// empty.
+// The master connections to the other instances of the context stay open so
+// their running commands are not interrupted.
+//
+func CloseSshControl(contextPath string, instances []*Ec2Instance) {
+	var processes []*Process = make([]*Process, 0)
+	var dir string = ControlDirectory(contextPath)
+	var prefixes []string = make([]string, len(instances))
+	var entries []os.FileInfo
+	var instance *Ec2Instance
+	var entry os.FileInfo
+	var process *Process
+	var prefix string
+	var err error
+	var i int
+
+	for i, instance = range instances {
+		prefixes[i] = instance.Name + "-"
+	}
+
+	entries, err = ioutil.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry = range entries {
+		if (entry.Mode() & os.ModeSocket) == 0 {
+			continue
+		}
+
+		for _, prefix = range prefixes {
+			if !strings.HasPrefix(entry.Name(), prefix) {
+				continue
+			}
+
+			process = NewProcess([]string{"ssh", "-o",
+				"LogLevel=Quiet", "-S",
+				filepath.Join(dir, entry.Name()), "-O", "exit",
+				PROGNAME})
+			process.Start()
+
+			processes = append(processes, process)
+			break
+		}
+	}
+
+	for _, process = range processes {
+		process.WaitFinished()
+	}
+
+	os.Remove(dir)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewSshControl(t *testing.T) {
+	var control *SshControl
+	var options []string
+	var err error
+
+	control, err = NewSshControl("context.json", CONTROL_PERSIST_NONE)
+	if (err != nil) || (control != nil) {
+		t.Fail()
+	}
+
+	control, err = NewSshControl("context.json", "0")
+	if (err != nil) || (control != nil) {
+		t.Fail()
+	}
+
+	_, err = NewSshControl("context.json", "forever")
+	if err == nil {
+		t.Fail()
+	}
+
+	control, err = NewSshControl("context.json", "5m")
+	if (err != nil) || (control == nil) {
+		t.FailNow()
+	}
+
+	if control.Persist != 300 {
+		t.Fail()
+	}
+
+	if control.Directory != ControlDirectory("./context.json") {
+		t.Fail()
+	}
+
+	if control.Directory == ControlDirectory("other.json") {
+		t.Fail()
+	}
+
+	if control.Path("i0") != filepath.Join(control.Directory, "i0-%r") {
+		t.Fail()
+	}
+
+	options = control.Options("i0", true)
+	if strings.Join(options, " ") != "-o ControlMaster=auto -o "+
+		"ControlPath="+control.Path("i0")+" -o ControlPersist=300" {
+		t.Fail()
+	}
+
+	options = control.Options("i0", false)
+	if options[1] != "ControlMaster=no" {
+		t.Fail()
+	}
+}
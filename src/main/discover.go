@@ -0,0 +1,402 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The EC2 tag set by AWS on the instances launched by a spot fleet request.
+//
+const TAG_AWS_FLEET_REQUEST string = "aws:ec2spot:fleet-request-id"
+
+// A spot fleet request as seen on the AWS EC2 servers, whether it is part of
+// a context or not.
+//
+type RemoteFleet struct {
+	Id      string            // ec2 id code for fleet request
+	Region  string            // ec2 region code for this fleet
+	State   string            // state of the fleet request (e.g. 'active')
+	Size    int               // target capacity of the fleet
+	Tags    map[string]string // EC2 tags of the fleet request
+	Volumes []*Ec2Volume      // storage attached to each instance
+}
+
+// An instance as seen on the AWS EC2 servers, whether it is part of a context
+// or not.
+//
+type RemoteInstance struct {
+	Id      string            // ec2 id of the instance
+	Region  string            // ec2 region code for this instance
+	State   string            // state of the instance (e.g. 'running')
+	FleetId string            // id of the spot fleet request or ""
+	Tags    map[string]string // EC2 tags of the instance
+}
+
+// An image owned by the current account as seen on the AWS EC2 servers.
+//
+type RemoteImage struct {
+	Id        string            // ec2 id of the image
+	Region    string            // ec2 region code for this image
+	Name      string            // name of the image
+	State     string            // state of the image (e.g. 'available')
+	Snapshots []string          // ids of the snapshots used by the image
+	Tags      map[string]string // EC2 tags of the image
+}
+
+// A snapshot owned by the current account as seen on the AWS EC2 servers.
+//
+type RemoteSnapshot struct {
+	Id     string            // ec2 id of the snapshot
+	Region string            // ec2 region code for this snapshot
+	Tags   map[string]string // EC2 tags of the snapshot
+}
+
+// Indicate if a spot fleet request in the given state still has or can still
+// have running instances.
+//
+func isActiveFleetState(state string) bool {
+	switch state {
+	case ec2.BatchStateSubmitted:
+		return true
+	case ec2.BatchStateActive:
+		return true
+	case ec2.BatchStateModifying:
+		return true
+	default:
+		return false
+	}
+}
+
+// Create a RemoteFleet from its AWS EC2 description in the given region.
+//
+func newRemoteFleet(region string, config *ec2.SpotFleetRequestConfig) *RemoteFleet {
+	var mapping *ec2.BlockDeviceMapping
+	var data *ec2.SpotFleetRequestConfigData
+	var fleet RemoteFleet
+
+	fleet.Id = aws.StringValue(config.SpotFleetRequestId)
+	fleet.Region = region
+	fleet.State = aws.StringValue(config.SpotFleetRequestState)
+	fleet.Tags = UnpackEc2Tags(config.Tags)
+	fleet.Volumes = make([]*Ec2Volume, 0)
+
+	data = config.SpotFleetRequestConfig
+	if data == nil {
+		return &fleet
+	}
+
+	fleet.Size = int(aws.Int64Value(data.TargetCapacity))
+
+	if len(data.LaunchSpecifications) > 0 {
+		for _, mapping = range data.LaunchSpecifications[0].BlockDeviceMappings {
+			fleet.Volumes = append(fleet.Volumes,
+				NewEc2VolumeFromMapping(mapping))
+		}
+	}
+
+	return &fleet
+}
+
+// Create a new EC2 client for the given region.
+//
+func newRegionClient(region string) *ec2.EC2 {
+	var sess *session.Session = session.New()
+
+	return ec2.New(sess, &aws.Config{Region: aws.String(region)})
+}
+
+// An error related to the regions which cannot be fetched.
+// Implements the error interface.
+//
+type RegionsError struct {
+	Errors map[string]error // error of each failing region
+}
+
+// The implementation of error.Error() method for RegionsError.
+//
+func (this *RegionsError) Error() string {
+	var messages []string = make([]string, 0, len(this.Errors))
+	var region string
+	var err error
+
+	for region, err = range this.Errors {
+		messages = append(messages, region+": "+err.Error())
+	}
+
+	sort.Strings(messages)
+
+	return strings.Join(messages, ", ")
+}
+
+// Apply the given function to each of the given regions in parallel.
+// Return a RegionsError with the error of each failing region or nil if
+// everything goes well.
+//
+func forEachRegion(regions []string, fn func(string) error) error {
+	var errors map[string]error = make(map[string]error)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var region string
+
+	for _, region = range regions {
+		wg.Add(1)
+		go func(region string) {
+			var err error = fn(region)
+
+			if err != nil {
+				lock.Lock()
+				errors[region] = err
+				lock.Unlock()
+			}
+
+			wg.Done()
+		}(region)
+	}
+
+	wg.Wait()
+
+	if len(errors) > 0 {
+		return &RegionsError{Errors: errors}
+	}
+
+	return nil
+}
+
+// Fetch the active spot fleet requests of the given regions.
+// Every region is fetched in parallel.
+// Return the fleets sorted by region and id. If some regions cannot be
+// fetched, also return a RegionsError along with the fleets of the other
+// regions.
+//
+func DiscoverFleets(regions []string) ([]*RemoteFleet, error) {
+	var fleets []*RemoteFleet = make([]*RemoteFleet, 0)
+	var lock sync.Mutex
+	var err error
+
+	err = forEachRegion(regions, func(region string) error {
+		var input ec2.DescribeSpotFleetRequestsInput
+
+		return newRegionClient(region).DescribeSpotFleetRequestsPages(
+			&input, func(page *ec2.DescribeSpotFleetRequestsOutput, last bool) bool {
+				var config *ec2.SpotFleetRequestConfig
+				var state string
+
+				lock.Lock()
+				defer lock.Unlock()
+
+				for _, config = range page.SpotFleetRequestConfigs {
+					state = aws.StringValue(config.SpotFleetRequestState)
+					if !isActiveFleetState(state) {
+						continue
+					}
+
+					fleets = append(fleets,
+						newRemoteFleet(region, config))
+				}
+
+				return true
+			})
+	})
+
+	sort.Slice(fleets, func(i, j int) bool {
+		if fleets[i].Region != fleets[j].Region {
+			return fleets[i].Region < fleets[j].Region
+		}
+		return fleets[i].Id < fleets[j].Id
+	})
+
+	return fleets, err
+}
+
+// Fetch the pending and running instances with the given EC2 tag key in the
+// given regions.
+// Every region is fetched in parallel.
+// Return the instances sorted by region and id, or the first error
+// encountered.
+//
+func DiscoverInstances(tagKey string, regions []string) ([]*RemoteInstance, error) {
+	var instances []*RemoteInstance = make([]*RemoteInstance, 0)
+	var lock sync.Mutex
+	var err error
+
+	err = forEachRegion(regions, func(region string) error {
+		var input ec2.DescribeInstancesInput
+
+		input.Filters = []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(tagKey)},
+			},
+			&ec2.Filter{
+				Name: aws.String("instance-state-name"),
+				Values: []*string{
+					aws.String(ec2.InstanceStateNamePending),
+					aws.String(ec2.InstanceStateNameRunning),
+				},
+			},
+		}
+
+		return newRegionClient(region).DescribeInstancesPages(&input,
+			func(page *ec2.DescribeInstancesOutput, last bool) bool {
+				var reservation *ec2.Reservation
+				var instance *ec2.Instance
+				var remote *RemoteInstance
+
+				lock.Lock()
+				defer lock.Unlock()
+
+				for _, reservation = range page.Reservations {
+					for _, instance = range reservation.Instances {
+						remote = &RemoteInstance{}
+						remote.Id = aws.StringValue(instance.InstanceId)
+						remote.Region = region
+						remote.Tags = UnpackEc2Tags(instance.Tags)
+						remote.FleetId = remote.Tags[TAG_AWS_FLEET_REQUEST]
+						if instance.State != nil {
+							remote.State = aws.StringValue(instance.State.Name)
+						}
+
+						instances = append(instances, remote)
+					}
+				}
+
+				return true
+			})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(instances, func(i, j int) bool {
+		if instances[i].Region != instances[j].Region {
+			return instances[i].Region < instances[j].Region
+		}
+		return instances[i].Id < instances[j].Id
+	})
+
+	return instances, nil
+}
+
+// Fetch every images owned by the current account in the given regions.
+// Every region is fetched in parallel.
+// Return the images sorted by region and id, or the first error encountered.
+//
+func DiscoverImages(regions []string) ([]*RemoteImage, error) {
+	var images []*RemoteImage = make([]*RemoteImage, 0)
+	var lock sync.Mutex
+	var err error
+
+	err = forEachRegion(regions, func(region string) error {
+		var output *ec2.DescribeImagesOutput
+		var input ec2.DescribeImagesInput
+		var mapping *ec2.BlockDeviceMapping
+		var image *ec2.Image
+		var remote *RemoteImage
+		var err error
+
+		input.Owners = []*string{aws.String("self")}
+
+		output, err = newRegionClient(region).DescribeImages(&input)
+		if err != nil {
+			return err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+
+		for _, image = range output.Images {
+			remote = &RemoteImage{}
+			remote.Id = aws.StringValue(image.ImageId)
+			remote.Region = region
+			remote.Name = aws.StringValue(image.Name)
+			remote.State = aws.StringValue(image.State)
+			remote.Snapshots = make([]string, 0)
+			remote.Tags = UnpackEc2Tags(image.Tags)
+
+			for _, mapping = range image.BlockDeviceMappings {
+				if (mapping.Ebs == nil) || (mapping.Ebs.SnapshotId == nil) {
+					continue
+				}
+
+				remote.Snapshots = append(remote.Snapshots,
+					*mapping.Ebs.SnapshotId)
+			}
+
+			images = append(images, remote)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Region != images[j].Region {
+			return images[i].Region < images[j].Region
+		}
+		return images[i].Id < images[j].Id
+	})
+
+	return images, nil
+}
+
+// Fetch the snapshots owned by the current account with the given EC2 tag key
+// in the given regions.
+// Every region is fetched in parallel.
+// Return the snapshots sorted by region and id, or the first error
+// encountered.
+//
+func DiscoverSnapshots(tagKey string, regions []string) ([]*RemoteSnapshot, error) {
+	var snapshots []*RemoteSnapshot = make([]*RemoteSnapshot, 0)
+	var lock sync.Mutex
+	var err error
+
+	err = forEachRegion(regions, func(region string) error {
+		var input ec2.DescribeSnapshotsInput
+
+		input.OwnerIds = []*string{aws.String("self")}
+		input.Filters = []*ec2.Filter{
+			&ec2.Filter{
+				Name:   aws.String("tag-key"),
+				Values: []*string{aws.String(tagKey)},
+			},
+		}
+
+		return newRegionClient(region).DescribeSnapshotsPages(&input,
+			func(page *ec2.DescribeSnapshotsOutput, last bool) bool {
+				var snapshot *ec2.Snapshot
+				var remote *RemoteSnapshot
+
+				lock.Lock()
+				defer lock.Unlock()
+
+				for _, snapshot = range page.Snapshots {
+					remote = &RemoteSnapshot{}
+					remote.Id = aws.StringValue(snapshot.SnapshotId)
+					remote.Region = region
+					remote.Tags = UnpackEc2Tags(snapshot.Tags)
+
+					snapshots = append(snapshots, remote)
+				}
+
+				return true
+			})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		if snapshots[i].Region != snapshots[j].Region {
+			return snapshots[i].Region < snapshots[j].Region
+		}
+		return snapshots[i].Id < snapshots[j].Id
+	})
+
+	return snapshots, nil
+}
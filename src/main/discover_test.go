@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"sync"
+	"testing"
+)
+
+func TestNewRemoteFleet(t *testing.T) {
+	var config ec2.SpotFleetRequestConfig
+	var data ec2.SpotFleetRequestConfigData
+	var spec ec2.SpotFleetLaunchSpecification
+	var fleet *RemoteFleet
+
+	spec.BlockDeviceMappings = []*ec2.BlockDeviceMapping{
+		(&Ec2Volume{Device: "/dev/sda1", Size: 16}).BlockDeviceMapping(),
+		(&Ec2Volume{Device: "/dev/sdc", Ephemeral: "ephemeral0"}).
+			BlockDeviceMapping(),
+	}
+
+	data.TargetCapacity = aws.Int64(4)
+	data.LaunchSpecifications = []*ec2.SpotFleetLaunchSpecification{&spec}
+
+	config.SpotFleetRequestId = aws.String("sfr-0")
+	config.SpotFleetRequestState = aws.String(ec2.BatchStateActive)
+	config.SpotFleetRequestConfig = &data
+	config.Tags = []*ec2.Tag{&ec2.Tag{Key: aws.String(TAG_FLEET),
+		Value: aws.String("workers")}}
+
+	fleet = newRemoteFleet("eu-west-1", &config)
+
+	if (fleet.Id != "sfr-0") || (fleet.Region != "eu-west-1") ||
+		(fleet.State != ec2.BatchStateActive) || (fleet.Size != 4) ||
+		(fleet.Tags[TAG_FLEET] != "workers") ||
+		(len(fleet.Volumes) != 2) {
+		t.FailNow()
+	}
+
+	if (fleet.Volumes[0].String() != "/dev/sda1=16") ||
+		(fleet.Volumes[1].String() != "/dev/sdc=ephemeral0") {
+		t.Fail()
+	}
+}
+
+func TestNewRemoteFleetNoConfig(t *testing.T) {
+	var config ec2.SpotFleetRequestConfig
+	var fleet *RemoteFleet
+
+	config.SpotFleetRequestId = aws.String("sfr-0")
+
+	fleet = newRemoteFleet("eu-west-1", &config)
+
+	if (fleet.Id != "sfr-0") || (fleet.Size != 0) ||
+		(fleet.Volumes == nil) || (len(fleet.Volumes) != 0) ||
+		(fleet.Tags == nil) {
+		t.Fail()
+	}
+}
+
+func TestForEachRegion(t *testing.T) {
+	var done map[string]bool = make(map[string]bool)
+	var regions []string = []string{"region-a", "region-b", "region-c"}
+	var regionsErr *RegionsError
+	var lock sync.Mutex
+	var ok bool
+	var err error
+
+	err = forEachRegion(regions, func(region string) error {
+		lock.Lock()
+		done[region] = true
+		lock.Unlock()
+
+		if region == "region-a" {
+			return nil
+		}
+
+		return fmt.Errorf("disabled")
+	})
+
+	if len(done) != 3 {
+		t.Fail()
+	}
+
+	regionsErr, ok = err.(*RegionsError)
+	if !ok || (len(regionsErr.Errors) != 2) || (regionsErr.Error() !=
+		"region-b: disabled, region-c: disabled") {
+		t.Fail()
+	}
+
+	err = forEachRegion(regions, func(region string) error {
+		return nil
+	})
+
+	if err != nil {
+		t.Fail()
+	}
+}
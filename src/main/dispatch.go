@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type dispatchParameters struct {
+	OptionCommand           *string
+	OptionContext           *string
+	OptionControlPersist    *string
+	OptionNativeConcurrency *int
+	OptionResults           *string
+	OptionRetries           *int
+	OptionSlots             *int
+	OptionTransport         *string
+	OptionUser              *string
+}
+
+var DEFAULT_DISPATCH_COMMAND string = ""
+var DEFAULT_DISPATCH_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_DISPATCH_CONTROL_PERSIST string = DEFAULT_CONTROL_PERSIST
+var DEFAULT_DISPATCH_NATIVE_CONCURRENCY int = DEFAULT_NATIVE_CONCURRENCY
+var DEFAULT_DISPATCH_RESULTS string = "results"
+var DEFAULT_DISPATCH_RETRIES int = 2
+var DEFAULT_DISPATCH_SLOTS int = 1
+var DEFAULT_DISPATCH_TRANSPORT string = DEFAULT_TRANSPORT
+var DEFAULT_DISPATCH_USER string = ""
+
+// The exit status of an ssh process which cannot reach its instance.
+// A job exiting with this status is run again on another instance.
+//
+const DISPATCH_CONNECTION_STATUS int = 255
+
+var dispatchParams dispatchParameters
+
+func PrintDispatchUsage() {
+	fmt.Printf(`Usage: %s dispatch [options] [ <instance-specs...> '--' ] <jobs-file>
+
+Run the jobs listed in a file on the specified instances.
+Each non empty line of the jobs file is a job: a shell command to run on one
+instance. The jobs are queued and given to the instances as they become idle,
+in the order of the file.
+If no instance is specified, then run the jobs on every instances.
+If an instance cannot be reached, its job is queued again for another
+instance, at most the number of times given by '--retries', and the instance
+is not used anymore. A job exiting with the status %d is handled the same
+way.
+The results of each job are written in a directory named by the line number
+of the job in the results directory, in the files 'exit' (exit code),
+'stdout', 'stderr' and 'instance' (name of the instance which ran the job).
+Exit with 0 if every job succeeds, 1 otherwise.
+
+Options:
+
+  --command <cmd>             use a custom ssh command
+
+  --context <path>            path of the context file (default: '%s')
+
+  --control-persist <time>    keep the ssh connections open in background for
+                              <time> after the last job to reuse them, or
+                              'none' to disable (default: '%s')
+
+  --native-concurrency <n>    establish at most <n> connections at the same
+                              time with the native transport, the jobs
+                              are not limited once connected (default: %d)
+
+  --results <path>            path of the results directory (default: '%s')
+
+  --retries <n>               run a job at most <n> more times if its
+                              instance cannot be reached (default: %d)
+
+  --slots <n>                 run at most <n> jobs at the same time on each
+                              instance (default: %d)
+
+  --transport <name>          connect with 'openssh' or 'native' (see
+                              '%s help ssh') (default: '%s')
+
+  --user <user-name>          use a custom user name for the ssh connections
+`,
+		PROGNAME, DISPATCH_CONNECTION_STATUS, DEFAULT_DISPATCH_CONTEXT,
+		DEFAULT_DISPATCH_CONTROL_PERSIST,
+		DEFAULT_DISPATCH_NATIVE_CONCURRENCY, DEFAULT_DISPATCH_RESULTS,
+		DEFAULT_DISPATCH_RETRIES, DEFAULT_DISPATCH_SLOTS, PROGNAME,
+		DEFAULT_DISPATCH_TRANSPORT)
+}
+
+// A job of the jobs file.
+//
+type DispatchJob struct {
+	Id       int    // line number of the job in the jobs file
+	Command  string // shell command to run
+	Attempts int    // number of times the job has been started
+	Status   int    // exit code of the job, once finished
+}
+
+// Read the jobs of the jobs file at the given path.
+// Return the jobs in the file order or an error if the file cannot be read.
+//
+func ReadDispatchJobs(path string) ([]*DispatchJob, error) {
+	var jobs []*DispatchJob = make([]*DispatchJob, 0)
+	var scanner *bufio.Scanner
+	var file *os.File
+	var line string
+	var lineno int
+	var err error
+
+	file, err = os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	scanner = bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		lineno += 1
+
+		line = strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		jobs = append(jobs, &DispatchJob{Id: lineno, Command: line})
+	}
+
+	return jobs, scanner.Err()
+}
+
+// The queue of the jobs to run, shared by the workers.
+//
+type DispatchQueue struct {
+	Retries  int            // how many times a job can run again
+	pending  []*DispatchJob // jobs waiting for a worker
+	running  int            // number of jobs taken by workers
+	finished []*DispatchJob // jobs finished or given up
+	lock     sync.Mutex     // protect the fields above
+	cond     *sync.Cond     // signaled when the fields above change
+}
+
+// Create a new DispatchQueue with the given jobs and number of retries.
+//
+func NewDispatchQueue(jobs []*DispatchJob, retries int) *DispatchQueue {
+	var this DispatchQueue
+
+	this.Retries = retries
+	this.pending = append([]*DispatchJob{}, jobs...)
+	this.finished = make([]*DispatchJob, 0, len(jobs))
+	this.cond = sync.NewCond(&this.lock)
+
+	return &this
+}
+
+// Take the next job to run.
+// Block while there is no pending job but some jobs are running since they
+// may have to run again.
+// Return nil once every job is finished.
+//
+func (this *DispatchQueue) Take() *DispatchJob {
+	var job *DispatchJob
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for (len(this.pending) == 0) && (this.running > 0) {
+		this.cond.Wait()
+	}
+
+	if len(this.pending) == 0 {
+		return nil
+	}
+
+	job = this.pending[0]
+	this.pending = this.pending[1:]
+	this.running += 1
+	job.Attempts += 1
+
+	return job
+}
+
+// Mark the given taken job as finished with the given exit code.
+//
+func (this *DispatchQueue) Finish(job *DispatchJob, status int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	job.Status = status
+	this.finished = append(this.finished, job)
+	this.running -= 1
+	this.cond.Broadcast()
+}
+
+// Queue again the given taken job which could not run because of its
+// instance, or mark it as finished with the given exit code if it already
+// ran too many times.
+// Return true if the job is queued again.
+//
+func (this *DispatchQueue) Retry(job *DispatchJob, status int) bool {
+	this.lock.Lock()
+
+	if job.Attempts > this.Retries {
+		this.lock.Unlock()
+		this.Finish(job, status)
+		return false
+	}
+
+	this.pending = append([]*DispatchJob{job}, this.pending...)
+	this.running -= 1
+	this.cond.Broadcast()
+	this.lock.Unlock()
+
+	return true
+}
+
+// Queue again the given taken job which has not been started.
+//
+func (this *DispatchQueue) Release(job *DispatchJob) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	job.Attempts -= 1
+	this.pending = append([]*DispatchJob{job}, this.pending...)
+	this.running -= 1
+	this.cond.Broadcast()
+}
+
+// Remove the pending jobs from the queue, when no worker is left to run them.
+// Return the removed jobs.
+//
+func (this *DispatchQueue) Abandon() []*DispatchJob {
+	var jobs []*DispatchJob
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	jobs = this.pending
+	this.pending = nil
+	this.cond.Broadcast()
+
+	return jobs
+}
+
+// Return the finished jobs, in the order they finished.
+//
+func (this *DispatchQueue) Finished() []*DispatchJob {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return append([]*DispatchJob{}, this.finished...)
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// A worker running the jobs of a DispatchQueue on an instance.
+// The workers of the same instance share the same alive flag.
+//
+type dispatchWorker struct {
+	Instance  *Ec2Instance   // instance to run the jobs on
+	Queue     *DispatchQueue // queue to take the jobs from
+	Results   string         // path of the results directory
+	connector *sshConnector  // connection settings
+	alive     *bool          // the instance can be reached
+	lock      *sync.Mutex    // protect alive
+}
+
+// Return the results directory of the given job.
+//
+func dispatchJobDirectory(results string, job *DispatchJob) string {
+	return filepath.Join(results, strconv.Itoa(job.Id))
+}
+
+// Write the given content in the file with the given name in the results
+// directory of the given job.
+//
+func (this *dispatchWorker) writeResult(job *DispatchJob, name, content string) error {
+	var path string
+
+	path = filepath.Join(dispatchJobDirectory(this.Results, job), name)
+
+	return writeFileString(path, content)
+}
+
+// Build the ssh Process running the given job on the instance of this worker.
+//
+func (this *dispatchWorker) build(job *DispatchJob) *Process {
+	return this.connector.Builder(this.Instance,
+		[]string{job.Command}).Build()
+}
+
+// Copy the lines of the stdout if mode is true or stderr otherwise of the
+// given process in the given file.
+//
+func copyProcessStream(process *Process, mode bool, file *os.File, done chan bool) {
+	var line string
+	var has bool
+
+	for {
+		line, has = readProcessStream(process, mode)
+		if !has {
+			break
+		}
+
+		file.WriteString(line)
+	}
+
+	file.Close()
+	done <- true
+}
+
+// Run the given job on the instance of this worker and write its results.
+// Return the exit code of the job or an error if the results cannot be
+// written.
+//
+func (this *dispatchWorker) run(job *DispatchJob) (int, error) {
+	var done chan bool = make(chan bool)
+	var stdout, stderr *os.File
+	var process *Process
+	var directory string
+	var code int
+	var err error
+
+	directory = dispatchJobDirectory(this.Results, job)
+
+	err = os.MkdirAll(directory, 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	os.Remove(filepath.Join(directory, "exit"))
+
+	err = this.writeResult(job, "instance", this.Instance.Name+"\n")
+	if err != nil {
+		return 0, err
+	}
+
+	stdout, err = os.Create(filepath.Join(directory, "stdout"))
+	if err != nil {
+		return 0, err
+	}
+
+	stderr, err = os.Create(filepath.Join(directory, "stderr"))
+	if err != nil {
+		stdout.Close()
+		return 0, err
+	}
+
+	process = this.build(job)
+	process.Start()
+	process.CloseStdin()
+
+	go copyProcessStream(process, true, stdout, done)
+	go copyProcessStream(process, false, stderr, done)
+
+	<-done
+	<-done
+
+	process.WaitFinished()
+	code, _ = process.ExitCode()
+
+	return code, this.writeResult(job, "exit", fmt.Sprintf("%d\n", code))
+}
+
+// Take and run jobs until the queue is empty or the instance of this worker
+// cannot be reached anymore.
+//
+func (this *dispatchWorker) Work() {
+	var job *DispatchJob
+	var code int
+	var err error
+
+	for this.Alive() {
+		job = this.Queue.Take()
+		if job == nil {
+			return
+		} else if !this.Alive() {
+			this.Queue.Release(job)
+			return
+		}
+
+		code, err = this.run(job)
+		if err != nil {
+			Error("cannot write results of job %d: %s", job.Id,
+				err.Error())
+		}
+
+		if code != DISPATCH_CONNECTION_STATUS {
+			fmt.Fprintf(os.Stderr, "[ec2tools] job %d exited with "+
+				"%d on %s\n", job.Id, code, this.Instance.Name)
+			this.Queue.Finish(job, code)
+			continue
+		}
+
+		this.retire()
+
+		if this.Queue.Retry(job, code) {
+			Warning("job %d failed on instance %s, queued again",
+				job.Id, this.Instance.Name)
+		} else {
+			Warning("job %d failed on instance %s, giving up",
+				job.Id, this.Instance.Name)
+		}
+	}
+}
+
+// Return true if the instance of this worker can still be reached.
+//
+func (this *dispatchWorker) Alive() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return *this.alive
+}
+
+// Stop to give jobs to the instance of this worker.
+//
+func (this *dispatchWorker) retire() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if *this.alive {
+		Warning("instance %s cannot be reached, not used anymore",
+			this.Instance.Name)
+	}
+
+	*this.alive = false
+}
+
+// Write the given string in the file at the given path, replacing its
+// previous content.
+//
+func writeFileString(path, content string) error {
+	var file *os.File
+	var err error
+
+	file, err = os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.WriteString(content)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// Run the given jobs on the given instances.
+// This function never returns.
+//
+func doDispatch(instances []*Ec2Instance, jobs []*DispatchJob) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var queue *DispatchQueue
+	var connector *sshConnector
+	var instance *Ec2Instance
+	var worker *dispatchWorker
+	var job *DispatchJob
+	var alive *bool
+	var failed, slot int
+
+	queue = NewDispatchQueue(jobs, *dispatchParams.OptionRetries)
+
+	connector = newSshConnector(*dispatchParams.OptionContext,
+		*dispatchParams.OptionControlPersist,
+		*dispatchParams.OptionTransport,
+		*dispatchParams.OptionNativeConcurrency,
+		*dispatchParams.OptionCommand, *dispatchParams.OptionUser, false)
+
+	for _, instance = range instances {
+		alive = new(bool)
+		*alive = true
+
+		for slot = 0; slot < *dispatchParams.OptionSlots; slot++ {
+			worker = &dispatchWorker{
+				Instance:  instance,
+				Queue:     queue,
+				Results:   *dispatchParams.OptionResults,
+				connector: connector,
+				alive:     alive,
+				lock:      &lock,
+			}
+
+			wg.Add(1)
+			go func(worker *dispatchWorker) {
+				worker.Work()
+				wg.Done()
+			}(worker)
+		}
+	}
+
+	wg.Wait()
+
+	for _, job = range queue.Abandon() {
+		Warning("job %d not run: no instance left", job.Id)
+		failed += 1
+	}
+
+	for _, job = range queue.Finished() {
+		if job.Status != 0 {
+			failed += 1
+		}
+	}
+
+	if failed > 0 {
+		Warning("%d jobs out of %d failed", failed, len(jobs))
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
+
+func Dispatch(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var selection *Ec2Selection
+	var instances []*Ec2Instance
+	var jobs []*DispatchJob
+	var specs []string
+	var ctx *Ec2Index
+	var err error
+
+	dispatchParams.OptionCommand = flags.String("command", DEFAULT_DISPATCH_COMMAND, "")
+	dispatchParams.OptionContext = flags.String("context", DEFAULT_DISPATCH_CONTEXT, "")
+	dispatchParams.OptionControlPersist = flags.String("control-persist", DEFAULT_DISPATCH_CONTROL_PERSIST, "")
+	dispatchParams.OptionNativeConcurrency = flags.Int("native-concurrency", DEFAULT_DISPATCH_NATIVE_CONCURRENCY, "")
+	dispatchParams.OptionResults = flags.String("results", DEFAULT_DISPATCH_RESULTS, "")
+	dispatchParams.OptionRetries = flags.Int("retries", DEFAULT_DISPATCH_RETRIES, "")
+	dispatchParams.OptionSlots = flags.Int("slots", DEFAULT_DISPATCH_SLOTS, "")
+	dispatchParams.OptionTransport = flags.String("transport", DEFAULT_DISPATCH_TRANSPORT, "")
+	dispatchParams.OptionUser = flags.String("user", DEFAULT_DISPATCH_USER, "")
+
+	flags.Parse(args[1:])
+	args = flags.Args()
+
+	if len(args) < 1 {
+		Error("missing jobs-file operand")
+	} else if (len(args) > 1) && (args[len(args)-2] != "--") {
+		Error("too many operands")
+	}
+
+	if *dispatchParams.OptionRetries < 0 {
+		Error("invalid value for option --retries: '%d'",
+			*dispatchParams.OptionRetries)
+	} else if *dispatchParams.OptionSlots < 1 {
+		Error("invalid value for option --slots: '%d'",
+			*dispatchParams.OptionSlots)
+	}
+
+	if !IsTransport(*dispatchParams.OptionTransport) {
+		Error("invalid transport: '%s'", *dispatchParams.OptionTransport)
+	} else if (*dispatchParams.OptionTransport == TRANSPORT_NATIVE) &&
+		(*dispatchParams.OptionCommand != "") {
+		Error("cannot use a custom command with the native transport")
+	}
+
+	ctx, err = LoadEc2Index(*dispatchParams.OptionContext)
+	if err != nil {
+		Error("no context: %s", *dispatchParams.OptionContext)
+	}
+
+	specs = args[:len(args)-1]
+	if len(specs) == 0 {
+		specs = []string{"//"}
+	} else {
+		specs = specs[:len(specs)-1]
+	}
+
+	selection, err = ctx.Select(specs)
+	if err != nil {
+		Error("invalid specification: %s", err.Error())
+	}
+
+	jobs, err = ReadDispatchJobs(args[len(args)-1])
+	if err != nil {
+		Error("cannot read jobs file: %s", err.Error())
+	}
+
+	instances = selection.Reachable(true)
+
+	if len(instances) == 0 {
+		Error("no instance to run the jobs")
+	}
+
+	doDispatch(instances, jobs)
+}
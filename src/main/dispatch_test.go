@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestReadDispatchJobs(t *testing.T) {
+	var jobs []*DispatchJob
+	var file *os.File
+	var err error
+
+	file, err = ioutil.TempFile("", "ec2tools-test-jobs.")
+	if err != nil {
+		t.FailNow()
+	}
+
+	defer os.Remove(file.Name())
+
+	file.WriteString("echo a\n\n  \n  echo b  \necho c")
+	file.Close()
+
+	jobs, err = ReadDispatchJobs(file.Name())
+	if (err != nil) || (len(jobs) != 3) {
+		t.FailNow()
+	}
+
+	if (jobs[0].Id != 1) || (jobs[0].Command != "echo a") ||
+		(jobs[1].Id != 4) || (jobs[1].Command != "echo b") ||
+		(jobs[2].Id != 5) || (jobs[2].Command != "echo c") {
+		t.Fail()
+	}
+}
+
+func TestDispatchQueue(t *testing.T) {
+	var jobs []*DispatchJob = []*DispatchJob{
+		&DispatchJob{Id: 1}, &DispatchJob{Id: 2},
+	}
+	var queue *DispatchQueue = NewDispatchQueue(jobs, 1)
+	var taken chan *DispatchJob = make(chan *DispatchJob)
+	var a, b *DispatchJob
+
+	a = queue.Take()
+	b = queue.Take()
+	if (a != jobs[0]) || (b != jobs[1]) {
+		t.FailNow()
+	}
+
+	go func() {
+		taken <- queue.Take()
+	}()
+
+	if !queue.Retry(a, 255) {
+		t.Fail()
+	}
+
+	if (<-taken != a) || (a.Attempts != 2) {
+		t.FailNow()
+	}
+
+	if queue.Retry(a, 255) || (a.Status != 255) {
+		t.Fail()
+	}
+
+	go func() {
+		taken <- queue.Take()
+	}()
+
+	queue.Finish(b, 0)
+
+	if (<-taken != nil) || (len(queue.Finished()) != 2) ||
+		(len(queue.Abandon()) != 0) {
+		t.Fail()
+	}
+}
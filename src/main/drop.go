@@ -3,14 +3,19 @@ package main
 import (
 	"flag"
 	"fmt"
+	"sort"
 	"strings"
 )
 
 type dropParameters struct {
+	OptionDryRun *bool
 	OptionRegion *string
+	OptionYes    *bool
 }
 
+var DEFAULT_DROP_DRY_RUN bool = false
 var DEFAULT_DROP_REGION string = "*"
+var DEFAULT_DROP_YES bool = false
 
 var dropParams dropParameters
 
@@ -24,13 +29,21 @@ deregistered image cannot be used to launch new fleets. However, fleets already
 launched with a deregistered image continue to work normally.
 By default, deregister the image from every AWS EC2 datacenters. This behavior
 can be modified with options.
+When the standard input is a terminal, ask for a confirmation before to
+deregister the images.
 
 Options:
 
+  --dry-run                   print the images which would be deregistered and
+                              check the permissions without deregistering
+                              anything
+
   --region <region-name>      deregister from the specified region instead of
                               every regions, accept multiple region names
                               separated by commas or '*'
 
+  --yes                       do not ask for a confirmation
+
 `,
 		PROGNAME)
 }
@@ -44,8 +57,53 @@ func processDropOptionRegion() {
 	}
 }
 
+// Return the images of the given list sorted by region.
+//
+func sortedImages(ilist *ImageList) []*Image {
+	var images []*Image = make([]*Image, 0, len(ilist.Images))
+	var image *Image
+
+	for _, image = range ilist.Images {
+		images = append(images, image)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Region < images[j].Region
+	})
+
+	return images
+}
+
+// Print the images of the given list which would be deregistered and check
+// the permissions to deregister them without modifying anything.
+// Exit with an error if any image could not be deregistered.
+//
+func dryRunDrop(ilist *ImageList) {
+	var image *Image
+	var failed int
+	var err error
+
+	for _, image = range sortedImages(ilist) {
+		DryRunPrint("deregister image '%s' (%s) in region %s",
+			image.Name, image.Id, image.Region)
+
+		err = image.CheckDeregister()
+		if err != nil {
+			Warning("cannot deregister image '%s': %s", image.Id,
+				err.Error())
+			failed += 1
+		}
+	}
+
+	if failed > 0 {
+		Error("deregister request would fail for %d images", failed)
+	}
+}
+
 func doDrop(spec string) {
+	var regions []string
 	var ilist *ImageList
+	var image *Image
 	var err error
 
 	ilist = NewImageList()
@@ -60,6 +118,20 @@ func doDrop(spec string) {
 		Error("cannot fetch images: %s", err.Error())
 	}
 
+	if *dropParams.OptionDryRun {
+		dryRunDrop(ilist)
+		return
+	}
+
+	if len(ilist.Images) > 0 {
+		for _, image = range sortedImages(ilist) {
+			regions = append(regions, image.Region)
+		}
+
+		ConfirmOrExit(*dropParams.OptionYes, "deregister image '%s' "+
+			"from regions %s?", spec, strings.Join(regions, ", "))
+	}
+
 	err = ilist.Deregister()
 	if err != nil {
 		Error("cannot deregister images: %s", err.Error())
@@ -70,7 +142,9 @@ func Drop(args []string) {
 	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
 	var spec string
 
+	dropParams.OptionDryRun = flags.Bool("dry-run", DEFAULT_DROP_DRY_RUN, "")
 	dropParams.OptionRegion = flags.String("region", DEFAULT_DROP_REGION, "")
+	dropParams.OptionYes = flags.Bool("yes", DEFAULT_DROP_YES, "")
 
 	flags.Parse(args[1:])
 
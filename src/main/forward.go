@@ -0,0 +1,438 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type forwardParameters struct {
+	OptionCommand      *string
+	OptionContext      *string
+	OptionRestartDelay *string
+	OptionSocks        *string
+	OptionUser         *string
+}
+
+var DEFAULT_FORWARD_COMMAND string = ""
+var DEFAULT_FORWARD_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_FORWARD_RESTART_DELAY string = "5s"
+var DEFAULT_FORWARD_SOCKS string = ""
+var DEFAULT_FORWARD_USER string = ""
+
+// The ssh options of the tunnels: fail if a port cannot be forwarded and
+// detect the dead connections.
+//
+var FORWARD_SSH_OPTIONS []string = []string{
+	"-N", "-o", "ExitOnForwardFailure=yes", "-o", "ServerAliveInterval=15",
+	"-o", "ServerAliveCountMax=3",
+}
+
+var forwardParams forwardParameters
+
+func PrintForwardUsage() {
+	fmt.Printf(`Usage: %s forward [options] [ <instance-specs...> '--' ] [ <forward-specs...> ]
+
+Open ssh tunnels to the specified instances and keep them open until
+interrupted. A tunnel which closes is opened again after a delay.
+If no instance is specified, then open tunnels to every instances.
+The host keys of the instances are checked as '%s ssh' does.
+
+A forward-spec has the form '<local-port>:<remote-host>:<remote-port>' and
+forwards the local port to the remote port of the remote host, as seen from
+the instance. Each part is formatted for each instance (see '%s help get')
+then the local and remote ports are evaluated as sums and differences of
+integers, so the local ports can differ for each instance. For instance,
+'8000+%%D:localhost:80' forwards the local port 8000 to the port 80 of the
+first instance, the local port 8001 to the port 80 of the second instance,
+and so on.
+The local ports of all the tunnels must be different.
+
+Options:
+
+  --command <cmd>             use a custom ssh command
+
+  --context <path>            path of the context file (default: '%s')
+
+  --restart-delay <timespec>  wait <timespec> before to open again a tunnel
+                              which closes (default: '%s')
+
+  --socks <local-port>        open a SOCKS proxy on the local port, formatted
+                              and evaluated for each instance as the local port
+                              of the forward-specs, which connects from the
+                              instance
+
+  --user <user-name>          use a custom user name for the ssh connections
+`,
+		PROGNAME, PROGNAME, PROGNAME, DEFAULT_FORWARD_CONTEXT,
+		DEFAULT_FORWARD_RESTART_DELAY)
+}
+
+// A port forwarding specification as given on the command line.
+// Each field is a pattern to format for each instance.
+//
+type ForwardSpec struct {
+	LocalPort  string // pattern of the local port expression
+	RemoteHost string // pattern of the remote host
+	RemotePort string // pattern of the remote port expression
+}
+
+// Parse a forward-spec of the form '<local-port>:<remote-host>:<remote-port>'.
+//
+func ParseForwardSpec(str string) (*ForwardSpec, error) {
+	var parts []string = strings.Split(str, ":")
+
+	if (len(parts) != 3) || (parts[0] == "") || (parts[1] == "") ||
+		(parts[2] == "") {
+		return nil, fmt.Errorf("invalid forward-spec: '%s'", str)
+	}
+
+	return &ForwardSpec{parts[0], parts[1], parts[2]}, nil
+}
+
+// Evaluate the given port expression, a sum or difference of integers like
+// '8000+3'.
+// Return the port or an error if the expression is invalid or if the result
+// is not a valid port number.
+//
+func EvalPortExpression(expr string) (int, error) {
+	var sign, acc, operators, port int
+	var term string
+	var c rune
+	var err error
+
+	sign = 1
+
+	for _, c = range expr + "+" {
+		if (c != '+') && (c != '-') {
+			term += string(c)
+			continue
+		}
+
+		if (strings.TrimSpace(term) == "") && (operators > 0) {
+			return 0, fmt.Errorf("invalid port: '%s'", expr)
+		}
+
+		if strings.TrimSpace(term) != "" {
+			port, err = strconv.Atoi(strings.TrimSpace(term))
+			if err != nil {
+				return 0, fmt.Errorf("invalid port: '%s'", expr)
+			}
+
+			acc += sign * port
+		}
+
+		if c == '+' {
+			sign = 1
+		} else {
+			sign = -1
+		}
+
+		term = ""
+		operators += 1
+	}
+
+	if (acc < 1) || (acc > 65535) {
+		return 0, fmt.Errorf("invalid port: '%s' (%d)", expr, acc)
+	}
+
+	return acc, nil
+}
+
+// Return the local port of the given pattern for the given instance.
+//
+func forwardPort(pattern string, instance *Ec2Instance) (int, error) {
+	return EvalPortExpression(Format(pattern, instance))
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// The tunnels opened to an instance, by the same ssh connection.
+//
+type forwardTunnel struct {
+	Instance    *Ec2Instance // instance of the tunnels
+	Options     []string     // ssh options of the forwardings
+	Description []string     // description of each forwarding
+	process     *Process     // running ssh process or nil
+}
+
+// Add the forwardings given by the given forward-specs and SOCKS local port
+// pattern, if not empty, to the given tunnel.
+// Return an error if a pattern is invalid for the instance of the tunnel.
+//
+func (this *forwardTunnel) add(specs []*ForwardSpec, socks string) error {
+	var spec *ForwardSpec
+	var local, remote int
+	var host string
+	var err error
+
+	for _, spec = range specs {
+		local, err = forwardPort(spec.LocalPort, this.Instance)
+		if err != nil {
+			return err
+		}
+
+		remote, err = forwardPort(spec.RemotePort, this.Instance)
+		if err != nil {
+			return err
+		}
+
+		host = Format(spec.RemoteHost, this.Instance)
+
+		this.Options = append(this.Options, "-L",
+			fmt.Sprintf("%d:%s:%d", local, host, remote))
+		this.Description = append(this.Description,
+			fmt.Sprintf("localhost:%d -> %s:%s:%d", local,
+				this.Instance.Name, host, remote))
+	}
+
+	if socks == "" {
+		return nil
+	}
+
+	local, err = forwardPort(socks, this.Instance)
+	if err != nil {
+		return err
+	}
+
+	this.Options = append(this.Options, "-D", strconv.Itoa(local))
+	this.Description = append(this.Description,
+		fmt.Sprintf("localhost:%d -> %s (socks)", local,
+			this.Instance.Name))
+
+	return nil
+}
+
+// Return the local ports of the forwardings of this tunnel.
+//
+func (this *forwardTunnel) localPorts() []string {
+	var ports []string = make([]string, 0)
+	var i int
+
+	for i = 1; i < len(this.Options); i += 2 {
+		ports = append(ports, strings.SplitN(this.Options[i], ":",
+			2)[0])
+	}
+
+	return ports
+}
+
+// Build the ssh process opening this tunnel.
+//
+func (this *forwardTunnel) build(connector *sshConnector) *Process {
+	var builder *SshProcessBuilder
+	var options []string
+
+	options = append(options, FORWARD_SSH_OPTIONS...)
+	options = append(options, this.Options...)
+
+	builder = connector.BuilderOptions(this.Instance, options, []string{})
+	builder.Isolate()
+
+	return builder.Build()
+}
+
+// Keep this tunnel open, opening it again after the given delay in seconds
+// each time it closes, until the given channel is closed.
+//
+func (this *forwardTunnel) keep(connector *sshConnector, delay int,
+	stop chan bool, lock *sync.Mutex) {
+	var process *Process
+	var line string
+	var has bool
+
+	for {
+		process = this.build(connector)
+
+		lock.Lock()
+		select {
+		case <-stop:
+			lock.Unlock()
+			return
+		default:
+		}
+		this.process = process
+		process.Start()
+		lock.Unlock()
+
+		process.CloseStdin()
+
+		for {
+			line, has = process.ReadStderr()
+			if !has {
+				break
+			}
+
+			fmt.Fprintf(os.Stderr, "[%s] %s", this.Instance.Name,
+				line)
+		}
+
+		process.WaitFinished()
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		Warning("tunnel to %s closed, opening again in %d seconds",
+			this.Instance.Name, delay)
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(time.Duration(delay) * time.Second):
+		}
+	}
+}
+
+// Open the given tunnels and keep them open until this process receives a
+// SIGINT or a SIGTERM.
+// This function never returns.
+//
+func doForward(tunnels []*forwardTunnel, delay int) {
+	var signals chan os.Signal = make(chan os.Signal, 1)
+	var stop chan bool = make(chan bool)
+	var connector *sshConnector
+	var tunnel *forwardTunnel
+	var description string
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	connector = newSshConnector(*forwardParams.OptionContext,
+		CONTROL_PERSIST_NONE, TRANSPORT_OPENSSH,
+		DEFAULT_NATIVE_CONCURRENCY, *forwardParams.OptionCommand,
+		*forwardParams.OptionUser, false)
+
+	for _, tunnel = range tunnels {
+		for _, description = range tunnel.Description {
+			fmt.Printf("%s\n", description)
+		}
+
+		wg.Add(1)
+		go func(tunnel *forwardTunnel) {
+			tunnel.keep(connector, delay, stop, &lock)
+			wg.Done()
+		}(tunnel)
+	}
+
+	<-signals
+
+	lock.Lock()
+	close(stop)
+	for _, tunnel = range tunnels {
+		if tunnel.process != nil {
+			tunnel.process.Kill()
+		}
+	}
+	lock.Unlock()
+
+	wg.Wait()
+	os.Exit(0)
+}
+
+func Forward(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var ports map[string]*Ec2Instance = make(map[string]*Ec2Instance)
+	var tunnels []*forwardTunnel = make([]*forwardTunnel, 0)
+	var selection *Ec2Selection
+	var tunnel *forwardTunnel
+	var instance, other *Ec2Instance
+	var specs []*ForwardSpec
+	var spec *ForwardSpec
+	var operands, selectors []string
+	var hasSpecs, found bool
+	var port, arg string
+	var ctx *Ec2Index
+	var delay int
+	var ok bool
+	var err error
+
+	forwardParams.OptionCommand = flags.String("command", DEFAULT_FORWARD_COMMAND, "")
+	forwardParams.OptionContext = flags.String("context", DEFAULT_FORWARD_CONTEXT, "")
+	forwardParams.OptionRestartDelay = flags.String("restart-delay", DEFAULT_FORWARD_RESTART_DELAY, "")
+	forwardParams.OptionSocks = flags.String("socks", DEFAULT_FORWARD_SOCKS, "")
+	forwardParams.OptionUser = flags.String("user", DEFAULT_FORWARD_USER, "")
+
+	flags.Parse(args[1:])
+
+	delay, ok = ParseTimespec(*forwardParams.OptionRestartDelay)
+	if !ok {
+		Error("invalid value for option --restart-delay: '%s'",
+			*forwardParams.OptionRestartDelay)
+	}
+
+	for _, arg = range flags.Args() {
+		if (arg == "--") && !hasSpecs {
+			hasSpecs = true
+			selectors = operands
+			operands = make([]string, 0)
+			continue
+		}
+
+		operands = append(operands, arg)
+	}
+
+	if !hasSpecs {
+		selectors = []string{"//"}
+	}
+
+	for _, arg = range operands {
+		spec, err = ParseForwardSpec(arg)
+		if err != nil {
+			Error("%s", err.Error())
+		}
+
+		specs = append(specs, spec)
+	}
+
+	if (len(specs) == 0) && (*forwardParams.OptionSocks == "") {
+		Error("missing forward-spec operand")
+	}
+
+	ctx, err = LoadEc2Index(*forwardParams.OptionContext)
+	if err != nil {
+		Error("no context: %s", *forwardParams.OptionContext)
+	}
+
+	selection, err = ctx.Select(selectors)
+	if err != nil {
+		Error("invalid specification: %s", err.Error())
+	}
+
+	for _, instance = range selection.Reachable(true) {
+		tunnel = &forwardTunnel{Instance: instance}
+
+		err = tunnel.add(specs, *forwardParams.OptionSocks)
+		if err != nil {
+			Error("instance %s: %s", instance.Name, err.Error())
+		}
+
+		for _, port = range tunnel.localPorts() {
+			other, found = ports[port]
+			if found {
+				Error("conflicting local port for instances "+
+					"%s and %s: %s", other.Name,
+					instance.Name, port)
+			}
+
+			ports[port] = instance
+		}
+
+		tunnels = append(tunnels, tunnel)
+	}
+
+	if len(tunnels) == 0 {
+		Error("no instance to open tunnels to")
+	}
+
+	doForward(tunnels, delay)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseForwardSpec(t *testing.T) {
+	var spec *ForwardSpec
+	var err error
+
+	spec, err = ParseForwardSpec("8000+%D:localhost:80")
+	if (err != nil) || (spec.LocalPort != "8000+%D") ||
+		(spec.RemoteHost != "localhost") || (spec.RemotePort != "80") {
+		t.Fail()
+	}
+
+	_, err = ParseForwardSpec("8000:80")
+	if err == nil {
+		t.Fail()
+	}
+
+	_, err = ParseForwardSpec("8000::80")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestEvalPortExpression(t *testing.T) {
+	var port int
+	var err error
+
+	port, err = EvalPortExpression("8000")
+	if (err != nil) || (port != 8000) {
+		t.Fail()
+	}
+
+	port, err = EvalPortExpression("8000+3-1")
+	if (err != nil) || (port != 8002) {
+		t.Fail()
+	}
+
+	port, err = EvalPortExpression("-1+8000")
+	if (err != nil) || (port != 7999) {
+		t.Fail()
+	}
+
+	_, err = EvalPortExpression("8000+")
+	if err == nil {
+		t.Fail()
+	}
+
+	_, err = EvalPortExpression("8000+x")
+	if err == nil {
+		t.Fail()
+	}
+
+	_, err = EvalPortExpression("65535+1")
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"sort"
+	"strings"
+)
+
+type gcParameters struct {
+	OptionAnyContext *bool
+	OptionApply      *bool
+	OptionContext    *string
+	OptionOwner      *string
+	OptionRegion     *string
+	OptionVerbose    *bool
+	OptionYes        *bool
+}
+
+var DEFAULT_GC_ANY_CONTEXT bool = false
+var DEFAULT_GC_APPLY bool = false
+var DEFAULT_GC_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_GC_OWNER string = DEFAULT_OWNER
+var DEFAULT_GC_REGION string = "*"
+var DEFAULT_GC_VERBOSE bool = false
+var DEFAULT_GC_YES bool = false
+
+var gcParams gcParameters
+
+var gcProcOptionRegion []string
+
+// The kinds of resources inspected by the gc subcommand, in the order they
+// are reported and collected.
+//
+const (
+	GC_KIND_FLEET    string = "fleet"
+	GC_KIND_INSTANCE string = "instance"
+	GC_KIND_IMAGE    string = "image"
+	GC_KIND_SNAPSHOT string = "snapshot"
+)
+
+// The actions taken by the gc subcommand on orphan resources.
+// An empty action means the resource is kept.
+//
+const (
+	GC_ACTION_KEEP       string = ""
+	GC_ACTION_CANCEL     string = "cancel"
+	GC_ACTION_TERMINATE  string = "terminate"
+	GC_ACTION_DEREGISTER string = "deregister"
+	GC_ACTION_DELETE     string = "delete"
+	GC_ACTION_FORGET     string = "forget"
+)
+
+func PrintGcUsage() {
+	fmt.Printf(`Usage: %s gc [options]
+
+Find the orphan resources created by %s on AWS EC2 and optionally collect
+them. By default, only report the orphans without modifying anything.
+The resources are identified by their '%s' and '%s' tags.
+A resource is an orphan in the following cases:
+
+  fleet       an active spot fleet request not listed in its context, or a
+              fleet listed in the context but not active anymore
+
+  instance    a running instance which is not part of an active fleet of its
+              context
+
+  image       an image which failed to be created
+
+  snapshot    a snapshot which is not used by any image
+
+Orphan fleets are cancelled, or removed from the context if they are not active
+anymore, orphan instances are terminated, orphan images are deregistered and
+orphan snapshots are deleted.
+Do not run this command while a 'save' is in progress as the snapshots of the
+image being saved can be considered as orphans.
+
+Options:
+
+  --any-context               inspect the resources of every contexts with a
+                              local context file instead of only the ones of
+                              the current context
+
+  --apply                     collect the orphan resources instead of only
+                              reporting them, asking for a confirmation when
+                              the standard input is a terminal
+
+  --context <path>            path of the context file (default: '%s')
+
+  --owner <name>              only inspect the resources tagged with the
+                              specified owner, or any owner if empty
+                              (default: '%s')
+
+  --region <region-name>      inspect the specified region instead of every
+                              regions, accept multiple region names separated
+                              by commas or '*'
+
+  --verbose                   also report the resources which are not orphans
+
+  --yes                       do not ask for a confirmation before to collect
+                              the orphan resources
+`,
+		PROGNAME, PROGNAME, TAG_CONTEXT, TAG_OWNER, DEFAULT_CONTEXT,
+		DEFAULT_GC_OWNER)
+}
+
+func processGcOptionRegion() {
+	if *gcParams.OptionRegion == "*" {
+		gcProcOptionRegion = ListRegions()
+	} else {
+		gcProcOptionRegion = strings.Split(*gcParams.OptionRegion, ",")
+	}
+}
+
+// The resources found on AWS EC2 that the gc subcommand inspects.
+//
+type gcScan struct {
+	Fleets    []*RemoteFleet    // active fleets tagged by ec2tools
+	Instances []*RemoteInstance // running instances tagged by ec2tools
+	Images    []*RemoteImage    // images tagged by ec2tools
+	Snapshots []*RemoteSnapshot // snapshots tagged by ec2tools
+	Active    map[string]bool   // ids of every active fleets
+	Used      map[string]bool   // ids of every snapshots used by an image
+}
+
+// A resource inspected by the gc subcommand and what to do with it.
+//
+type gcEntry struct {
+	Kind    string // kind of resource (e.g. GC_KIND_FLEET)
+	Id      string // ec2 id of the resource
+	Region  string // ec2 region code for the resource
+	Context string // context the resource belongs to
+	Action  string // action to take (e.g. GC_ACTION_CANCEL)
+	Reason  string // why the resource is an orphan
+}
+
+// Return the index of the kind of the given entry in the report order.
+//
+func (this *gcEntry) kindOrder() int {
+	switch this.Kind {
+	case GC_KIND_FLEET:
+		return 0
+	case GC_KIND_INSTANCE:
+		return 1
+	case GC_KIND_IMAGE:
+		return 2
+	default:
+		return 3
+	}
+}
+
+// Return the fleet with the given id in the given context or nil if there is
+// no such fleet.
+//
+func findFleetById(ctx *Ec2Index, id string) *Ec2Fleet {
+	var fleet *Ec2Fleet
+
+	for _, fleet = range ctx.FleetsByName {
+		if fleet.Id == id {
+			return fleet
+		}
+	}
+
+	return nil
+}
+
+// Indicate if the resource with the given tags matches the tag filters
+// specified on the command line.
+//
+func matchGcScope(tags map[string]string, contextTag string) bool {
+	var value string
+	var found bool
+
+	value, found = tags[TAG_CONTEXT]
+	if !found {
+		return false
+	} else if !*gcParams.OptionAnyContext && (value != contextTag) {
+		return false
+	}
+
+	if (*gcParams.OptionOwner != "") &&
+		(tags[TAG_OWNER] != *gcParams.OptionOwner) {
+		return false
+	}
+
+	return true
+}
+
+// Fetch the resources to inspect on the specified regions.
+// Only keep the ec2tools resources matching the tag filters specified on the
+// command line, but remember every active fleets and every snapshots used by
+// an image.
+//
+func scanGc(contextTag string) *gcScan {
+	var instances []*RemoteInstance
+	var snapshots []*RemoteSnapshot
+	var instance *RemoteInstance
+	var snapshot *RemoteSnapshot
+	var fleets []*RemoteFleet
+	var images []*RemoteImage
+	var fleet *RemoteFleet
+	var image *RemoteImage
+	var scan gcScan
+	var id string
+	var err error
+
+	fleets, err = DiscoverFleets(gcProcOptionRegion)
+	if err != nil {
+		Error("cannot fetch fleets: %s", err.Error())
+	}
+
+	instances, err = DiscoverInstances(TAG_CONTEXT, gcProcOptionRegion)
+	if err != nil {
+		Error("cannot fetch instances: %s", err.Error())
+	}
+
+	images, err = DiscoverImages(gcProcOptionRegion)
+	if err != nil {
+		Error("cannot fetch images: %s", err.Error())
+	}
+
+	snapshots, err = DiscoverSnapshots(TAG_CONTEXT, gcProcOptionRegion)
+	if err != nil {
+		Error("cannot fetch snapshots: %s", err.Error())
+	}
+
+	scan.Active = make(map[string]bool)
+	scan.Fleets = make([]*RemoteFleet, 0, len(fleets))
+	for _, fleet = range fleets {
+		scan.Active[fleet.Id] = true
+		if matchGcScope(fleet.Tags, contextTag) {
+			scan.Fleets = append(scan.Fleets, fleet)
+		}
+	}
+
+	scan.Instances = make([]*RemoteInstance, 0, len(instances))
+	for _, instance = range instances {
+		if matchGcScope(instance.Tags, contextTag) {
+			scan.Instances = append(scan.Instances, instance)
+		}
+	}
+
+	scan.Used = make(map[string]bool)
+	scan.Images = make([]*RemoteImage, 0, len(images))
+	for _, image = range images {
+		for _, id = range image.Snapshots {
+			scan.Used[id] = true
+		}
+		if matchGcScope(image.Tags, contextTag) {
+			scan.Images = append(scan.Images, image)
+		}
+	}
+
+	scan.Snapshots = make([]*RemoteSnapshot, 0, len(snapshots))
+	for _, snapshot = range snapshots {
+		if matchGcScope(snapshot.Tags, contextTag) {
+			scan.Snapshots = append(scan.Snapshots, snapshot)
+		}
+	}
+
+	return &scan
+}
+
+// Compare the given resources with the given contexts, indexed by the value
+// of their TAG_CONTEXT tag, and return what to do with each resource.
+// The fleets listed in the given contexts are also compared with the active
+// fleets if their region is one of the given regions.
+// Return the entries sorted by kind, region and id.
+//
+func findGcEntries(scan *gcScan, contexts map[string]*Ec2Index, regions []string) []*gcEntry {
+	var entries []*gcEntry = make([]*gcEntry, 0)
+	var scanned map[string]bool = make(map[string]bool)
+	var snapshot *RemoteSnapshot
+	var instance *RemoteInstance
+	var remote *RemoteFleet
+	var image *RemoteImage
+	var region, key string
+	var fleet *Ec2Fleet
+	var ctx *Ec2Index
+	var entry *gcEntry
+	var found bool
+
+	for _, region = range regions {
+		scanned[region] = true
+	}
+
+	for _, remote = range scan.Fleets {
+		key = remote.Tags[TAG_CONTEXT]
+		if ctx, found = contexts[key]; !found {
+			continue
+		}
+
+		entry = &gcEntry{GC_KIND_FLEET, remote.Id, remote.Region, key,
+			GC_ACTION_KEEP, ""}
+		if findFleetById(ctx, remote.Id) == nil {
+			entry.Action = GC_ACTION_CANCEL
+			entry.Reason = "not in context"
+		}
+
+		entries = append(entries, entry)
+	}
+
+	for key, ctx = range contexts {
+		for _, fleet = range ctx.FleetsByName {
+			if !scanned[fleet.Region] || scan.Active[fleet.Id] {
+				continue
+			}
+
+			entries = append(entries, &gcEntry{GC_KIND_FLEET,
+				fleet.Id, fleet.Region, key, GC_ACTION_FORGET,
+				"not active anymore"})
+		}
+	}
+
+	for _, instance = range scan.Instances {
+		key = instance.Tags[TAG_CONTEXT]
+		if ctx, found = contexts[key]; !found {
+			continue
+		}
+
+		entry = &gcEntry{GC_KIND_INSTANCE, instance.Id, instance.Region,
+			key, GC_ACTION_KEEP, ""}
+		if instance.FleetId == "" {
+			entry.Action = GC_ACTION_TERMINATE
+			entry.Reason = "not part of a fleet"
+		} else if !scan.Active[instance.FleetId] {
+			entry.Action = GC_ACTION_TERMINATE
+			entry.Reason = "fleet " + instance.FleetId + " not active"
+		} else if findFleetById(ctx, instance.FleetId) == nil {
+			entry.Action = GC_ACTION_TERMINATE
+			entry.Reason = "fleet " + instance.FleetId +
+				" not in context"
+		}
+
+		entries = append(entries, entry)
+	}
+
+	for _, image = range scan.Images {
+		key = image.Tags[TAG_CONTEXT]
+		if _, found = contexts[key]; !found {
+			continue
+		}
+
+		entry = &gcEntry{GC_KIND_IMAGE, image.Id, image.Region, key,
+			GC_ACTION_KEEP, ""}
+		switch image.State {
+		case ec2.ImageStateFailed, ec2.ImageStateError,
+			ec2.ImageStateInvalid:
+			entry.Action = GC_ACTION_DEREGISTER
+			entry.Reason = "image '" + image.Name + "' " +
+				image.State
+		}
+
+		entries = append(entries, entry)
+	}
+
+	for _, snapshot = range scan.Snapshots {
+		key = snapshot.Tags[TAG_CONTEXT]
+		if _, found = contexts[key]; !found {
+			continue
+		}
+
+		entry = &gcEntry{GC_KIND_SNAPSHOT, snapshot.Id, snapshot.Region,
+			key, GC_ACTION_KEEP, ""}
+		if !scan.Used[snapshot.Id] {
+			entry.Action = GC_ACTION_DELETE
+			entry.Reason = "not used by any image"
+		}
+
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].kindOrder() != entries[j].kindOrder() {
+			return entries[i].kindOrder() < entries[j].kindOrder()
+		} else if entries[i].Region != entries[j].Region {
+			return entries[i].Region < entries[j].Region
+		}
+		return entries[i].Id < entries[j].Id
+	})
+
+	return entries
+}
+
+// Load the contexts to compare the resources with, indexed by the value of
+// their TAG_CONTEXT tag.
+// The current context file is the same as an empty context if it does not
+// exist. The other contexts are only loaded if they exist as local files,
+// since their paths come from EC2 tags possibly written on another machine,
+// so their resources are not inspected otherwise.
+//
+func loadGcContexts(scan *gcScan, contextTag string) map[string]*Ec2Index {
+	var contexts map[string]*Ec2Index = make(map[string]*Ec2Index)
+	var keys []string = []string{contextTag}
+	var skipped map[string]bool = make(map[string]bool)
+	var snapshot *RemoteSnapshot
+	var instance *RemoteInstance
+	var remote *RemoteFleet
+	var image *RemoteImage
+	var found bool
+	var err error
+	var key string
+
+	if *gcParams.OptionAnyContext {
+		for _, remote = range scan.Fleets {
+			keys = append(keys, remote.Tags[TAG_CONTEXT])
+		}
+		for _, instance = range scan.Instances {
+			keys = append(keys, instance.Tags[TAG_CONTEXT])
+		}
+		for _, image = range scan.Images {
+			keys = append(keys, image.Tags[TAG_CONTEXT])
+		}
+		for _, snapshot = range scan.Snapshots {
+			keys = append(keys, snapshot.Tags[TAG_CONTEXT])
+		}
+	}
+
+	for _, key = range keys {
+		if _, found = contexts[key]; found {
+			continue
+		} else if skipped[key] {
+			continue
+		}
+
+		if key != contextTag {
+			_, err = os.Stat(key)
+			if err != nil {
+				Warning("ignore resources of context '%s': no "+
+					"such local file", key)
+				skipped[key] = true
+				continue
+			}
+		}
+
+		contexts[key], err = LoadEc2Index(key)
+		if err != nil {
+			contexts[key] = NewEc2Index()
+		}
+	}
+
+	return contexts
+}
+
+// Print the given entry on the standard output.
+//
+func printGcEntry(entry *gcEntry) {
+	var action string = entry.Action
+
+	if action == GC_ACTION_KEEP {
+		action = "keep"
+	}
+
+	if entry.Reason == "" {
+		fmt.Printf("%s %s %s (%s)\n", action, entry.Kind, entry.Id,
+			entry.Region)
+	} else {
+		fmt.Printf("%s %s %s (%s): %s\n", action, entry.Kind, entry.Id,
+			entry.Region, entry.Reason)
+	}
+}
+
+// Terminate the instances with the given ids in the given region.
+// Return an error if the instances cannot be terminated.
+//
+func terminateInstances(region string, ids []*string) error {
+	var input ec2.TerminateInstancesInput
+	var err error
+
+	input.InstanceIds = ids
+
+	_, err = newRegionClient(region).TerminateInstances(&input)
+	return err
+}
+
+// Delete the snapshot with the given id in the given region.
+// Return an error if the snapshot cannot be deleted.
+//
+func deleteSnapshot(region, id string) error {
+	var input ec2.DeleteSnapshotInput
+	var err error
+
+	input.SnapshotId = aws.String(id)
+
+	_, err = newRegionClient(region).DeleteSnapshot(&input)
+	return err
+}
+
+// Collect the orphan resources of the given entries.
+// The fleets are cancelled before the instances are terminated, and the
+// images are deregistered before their snapshots are deleted.
+// Return the contexts which have been modified.
+//
+func applyGcEntries(entries []*gcEntry, contexts map[string]*Ec2Index) map[string]bool {
+	var modified map[string]bool = make(map[string]bool)
+	var fleets map[string][]*string = make(map[string][]*string)
+	var instances map[string][]*string = make(map[string][]*string)
+	var fleet *Ec2Fleet
+	var entry *gcEntry
+	var err error
+
+	for _, entry = range entries {
+		switch entry.Action {
+		case GC_ACTION_CANCEL:
+			fleets[entry.Region] = append(fleets[entry.Region],
+				aws.String(entry.Id))
+		case GC_ACTION_TERMINATE:
+			instances[entry.Region] = append(instances[entry.Region],
+				aws.String(entry.Id))
+		case GC_ACTION_FORGET:
+			fleet = findFleetById(contexts[entry.Context], entry.Id)
+			if fleet != nil {
+				contexts[entry.Context].RemoveEc2Fleet(fleet)
+				modified[entry.Context] = true
+			}
+		}
+	}
+
+	forEachRegion(sortedRegions(fleets), func(region string) error {
+		if !requestStop(region, fleets[region]) {
+			Warning("cannot cancel fleets for region '%s'", region)
+		}
+		return nil
+	})
+
+	forEachRegion(sortedRegions(instances), func(region string) error {
+		var err error = terminateInstances(region, instances[region])
+		if err != nil {
+			Warning("cannot terminate instances for region '%s': %s",
+				region, err.Error())
+		}
+		return nil
+	})
+
+	for _, entry = range entries {
+		if entry.Action != GC_ACTION_DEREGISTER {
+			continue
+		}
+
+		err = NewImage(entry.Region, entry.Id).Deregister()
+		if err != nil {
+			Warning("cannot deregister image '%s': %s", entry.Id,
+				err.Error())
+		}
+	}
+
+	for _, entry = range entries {
+		if entry.Action != GC_ACTION_DELETE {
+			continue
+		}
+
+		err = deleteSnapshot(entry.Region, entry.Id)
+		if err != nil {
+			Warning("cannot delete snapshot '%s': %s", entry.Id,
+				err.Error())
+		}
+	}
+
+	return modified
+}
+
+// Return the regions indexing the given map in lexical order.
+//
+func sortedRegions(m map[string][]*string) []string {
+	var keys []string = make([]string, 0, len(m))
+	var key string
+
+	for key = range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
+
+func Gc(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var contexts map[string]*Ec2Index
+	var modified map[string]bool
+	var contextTag, key string
+	var entries []*gcEntry
+	var entry *gcEntry
+	var orphans int
+	var scan *gcScan
+	var err error
+
+	gcParams.OptionAnyContext = flags.Bool("any-context", DEFAULT_GC_ANY_CONTEXT, "")
+	gcParams.OptionApply = flags.Bool("apply", DEFAULT_GC_APPLY, "")
+	gcParams.OptionContext = flags.String("context", DEFAULT_GC_CONTEXT, "")
+	gcParams.OptionOwner = flags.String("owner", DEFAULT_GC_OWNER, "")
+	gcParams.OptionRegion = flags.String("region", DEFAULT_GC_REGION, "")
+	gcParams.OptionVerbose = flags.Bool("verbose", DEFAULT_GC_VERBOSE, "")
+	gcParams.OptionYes = flags.Bool("yes", DEFAULT_GC_YES, "")
+
+	flags.Parse(args[1:])
+
+	if len(flags.Args()) > 0 {
+		Error("unexpected operand: %s", flags.Args()[0])
+	}
+
+	processGcOptionRegion()
+
+	contextTag = ContextTagValue(*gcParams.OptionContext)
+
+	scan = scanGc(contextTag)
+	contexts = loadGcContexts(scan, contextTag)
+	entries = findGcEntries(scan, contexts, gcProcOptionRegion)
+
+	orphans = 0
+	for _, entry = range entries {
+		if entry.Action != GC_ACTION_KEEP {
+			orphans += 1
+		} else if !*gcParams.OptionVerbose {
+			continue
+		}
+
+		printGcEntry(entry)
+	}
+
+	if !*gcParams.OptionApply {
+		if orphans > 0 {
+			fmt.Fprintf(os.Stderr, "%d orphans found, use --apply "+
+				"to collect them\n", orphans)
+		}
+		return
+	}
+
+	if orphans == 0 {
+		return
+	}
+
+	ConfirmOrExit(*gcParams.OptionYes, "collect %d orphans?", orphans)
+
+	modified = applyGcEntries(entries, contexts)
+
+	for key = range modified {
+		err = StoreEc2Index(key, contexts[key])
+		if err != nil {
+			Warning("cannot save context '%s': %s", key, err.Error())
+		}
+	}
+}
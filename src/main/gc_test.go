@@ -0,0 +1,147 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildGcTestScan() (*gcScan, map[string]*Ec2Index) {
+	var contexts map[string]*Ec2Index = make(map[string]*Ec2Index)
+	var tags map[string]string = map[string]string{TAG_CONTEXT: "/ctx"}
+	var ctx *Ec2Index = NewEc2Index()
+	var scan gcScan
+
+	ctx.AddEc2Fleet("sfr-known", "known", "user", "region-a", 1)
+	ctx.AddEc2Fleet("sfr-stale", "stale", "user", "region-a", 1)
+	ctx.AddEc2Fleet("sfr-other", "other", "user", "region-b", 1)
+	contexts["/ctx"] = ctx
+
+	scan.Fleets = []*RemoteFleet{
+		&RemoteFleet{Id: "sfr-known", Region: "region-a", Tags: tags},
+		&RemoteFleet{Id: "sfr-lost", Region: "region-a", Tags: tags},
+	}
+	scan.Instances = []*RemoteInstance{
+		&RemoteInstance{Id: "i-0", Region: "region-a",
+			FleetId: "sfr-known", Tags: tags},
+		&RemoteInstance{Id: "i-1", Region: "region-a",
+			FleetId: "sfr-lost", Tags: tags},
+		&RemoteInstance{Id: "i-2", Region: "region-a",
+			FleetId: "sfr-gone", Tags: tags},
+	}
+	scan.Images = []*RemoteImage{
+		&RemoteImage{Id: "ami-0", Region: "region-a", State: "available",
+			Tags: tags},
+		&RemoteImage{Id: "ami-1", Region: "region-a", State: "failed",
+			Tags: tags},
+	}
+	scan.Snapshots = []*RemoteSnapshot{
+		&RemoteSnapshot{Id: "snap-0", Region: "region-a", Tags: tags},
+		&RemoteSnapshot{Id: "snap-1", Region: "region-a", Tags: tags},
+	}
+	scan.Active = map[string]bool{"sfr-known": true, "sfr-lost": true}
+	scan.Used = map[string]bool{"snap-0": true}
+
+	return &scan, contexts
+}
+
+func TestFindGcEntries(t *testing.T) {
+	var expected [][2]string = [][2]string{
+		{"sfr-known", GC_ACTION_KEEP},
+		{"sfr-lost", GC_ACTION_CANCEL},
+		{"sfr-stale", GC_ACTION_FORGET},
+		{"i-0", GC_ACTION_KEEP},
+		{"i-1", GC_ACTION_TERMINATE},
+		{"i-2", GC_ACTION_TERMINATE},
+		{"ami-0", GC_ACTION_KEEP},
+		{"ami-1", GC_ACTION_DEREGISTER},
+		{"snap-0", GC_ACTION_KEEP},
+		{"snap-1", GC_ACTION_DELETE},
+	}
+	var contexts map[string]*Ec2Index
+	var entries []*gcEntry
+	var scan *gcScan
+	var i int
+
+	scan, contexts = buildGcTestScan()
+	entries = findGcEntries(scan, contexts, []string{"region-a"})
+
+	if len(entries) != len(expected) {
+		t.FailNow()
+	}
+
+	for i = range expected {
+		if entries[i].Id != expected[i][0] {
+			t.Fail()
+		} else if entries[i].Action != expected[i][1] {
+			t.Fail()
+		} else if entries[i].Context != "/ctx" {
+			t.Fail()
+		}
+	}
+}
+
+func TestFindGcEntriesOtherContext(t *testing.T) {
+	var contexts map[string]*Ec2Index
+	var entries []*gcEntry
+	var scan *gcScan
+
+	scan, _ = buildGcTestScan()
+
+	contexts = make(map[string]*Ec2Index)
+	contexts["/other"] = NewEc2Index()
+
+	entries = findGcEntries(scan, contexts, []string{"region-a"})
+
+	if len(entries) != 0 {
+		t.Fail()
+	}
+}
+
+func TestLoadGcContextsAnyContext(t *testing.T) {
+	var contexts map[string]*Ec2Index
+	var local, remote, current string
+	var anyContext bool = true
+	var ctx *Ec2Index
+	var dir string
+	var scan gcScan
+	var err error
+
+	dir, err = ioutil.TempDir("", "ec2tools-test-gc.")
+	if err != nil {
+		t.FailNow()
+	}
+
+	defer os.RemoveAll(dir)
+
+	local = filepath.Join(dir, "local")
+	remote = filepath.Join(dir, "remote")
+	current = filepath.Join(dir, "current")
+
+	ctx = NewEc2Index()
+	ctx.AddEc2Fleet("sfr-0", "fleet", "user", "region-a", 1)
+	if StoreEc2Index(local, ctx) != nil {
+		t.FailNow()
+	}
+
+	scan.Fleets = []*RemoteFleet{
+		&RemoteFleet{Id: "sfr-0", Tags: map[string]string{
+			TAG_CONTEXT: local}},
+		&RemoteFleet{Id: "sfr-1", Tags: map[string]string{
+			TAG_CONTEXT: remote}},
+	}
+
+	defer func(saved *bool) {
+		gcParams.OptionAnyContext = saved
+	}(gcParams.OptionAnyContext)
+
+	gcParams.OptionAnyContext = &anyContext
+	contexts = loadGcContexts(&scan, current)
+
+	if (len(contexts) != 2) || (contexts[current] == nil) ||
+		(contexts[local] == nil) ||
+		(len(contexts[local].FleetsByName) != 1) {
+		t.Fail()
+	}
+}
@@ -67,6 +67,7 @@ Properties:
   region            region code the instance runs in (e.g. 'us-east-2')
   uiid              integer that identifies the instance inside its context
   user              username to use for an ssh connection
+  volumes           volumes attached to the instance (see '%s help launch')
   <attribute>       a custom attribute defined with the 'set' subcommand
 
 Instance specification:
@@ -136,7 +137,7 @@ Examples:
       %s get --format 'public-ip: %%I  /  private-ip: %%{private-ip}'
 
 `,
-		PROGNAME, PROGNAME, DEFAULT_CONTEXT,
+		PROGNAME, PROGNAME, DEFAULT_CONTEXT, PROGNAME,
 		PROGNAME, PROGNAME, PROGNAME, PROGNAME, PROGNAME, PROGNAME,
 		PROGNAME, PROGNAME, PROGNAME)
 }
@@ -26,26 +26,46 @@ func Help(args []string) {
 
 	command = args[1]
 
-	if command == "describe" {
+	if (command == "adopt") || (command == "recover") {
+		PrintAdoptUsage()
+	} else if command == "describe" {
 		PrintDescribeUsage()
+	} else if command == "dispatch" {
+		PrintDispatchUsage()
 	} else if command == "drop" {
 		PrintDropUsage()
+	} else if command == "forward" {
+		PrintForwardUsage()
+	} else if command == "gc" {
+		PrintGcUsage()
 	} else if command == "get" {
 		PrintGetUsage()
 	} else if command == "help" {
 		PrintHelpUsage()
+	} else if command == "inventory" {
+		PrintInventoryUsage()
 	} else if command == "launch" {
 		PrintLaunchUsage()
+	} else if command == "login" {
+		PrintLoginUsage()
+	} else if command == "run" {
+		PrintRunUsage()
 	} else if command == "save" {
 		PrintSaveUsage()
 	} else if command == "scp" {
 		PrintScpUsage()
 	} else if command == "set" {
 		PrintSetUsage()
+	} else if command == "shell" {
+		PrintShellUsage()
 	} else if command == "ssh" {
 		PrintSshUsage()
+	} else if command == "ssh-config" {
+		PrintSshConfigUsage()
 	} else if command == "stop" {
 		PrintStopUsage()
+	} else if command == "tmux" {
+		PrintTmuxUsage()
 	} else if command == "update" {
 		PrintUpdateUsage()
 	} else if command == "wait" {
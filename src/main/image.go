@@ -66,6 +66,7 @@ type Image struct {
 	Description string // human readable description
 	State       string // either "", "pending" or "available"
 	Region      string // where the image can be used
+	RootDevice  string // device name of the root volume (e.g. '/dev/sda1')
 }
 
 // Create a new image from the specified instance.
@@ -75,12 +76,13 @@ type Image struct {
 // User supplies human readable name and description.
 // Provided name must be different from any other instance in the same region
 // (this constraint only exists for image creation).
+// The new image and its snapshots are tagged with the given tags.
 // Return the new image and a possible error.
 //
-func CreateImage(instance *Ec2Instance, name, description string) (*Image, error) {
+func CreateImage(instance *Ec2Instance, name, description string, tags map[string]string) (*Image, error) {
 	var errtxt string = "InvalidAMIName.Duplicate: AMI name"
 	var region string = instance.Fleet.Region
-	var req ec2.CreateImageInput
+	var req *ec2.CreateImageInput
 	var rep *ec2.CreateImageOutput
 	var sess *session.Session
 	var client *ec2.EC2
@@ -92,11 +94,9 @@ func CreateImage(instance *Ec2Instance, name, description string) (*Image, error
 		Region: aws.String(region),
 	})
 
-	req.InstanceId = aws.String(instance.Name)
-	req.Name = aws.String(name)
-	req.Description = aws.String(description)
+	req = buildCreateImageInput(instance, name, description, tags)
 
-	rep, err = client.CreateImage(&req)
+	rep, err = client.CreateImage(req)
 	if err != nil {
 		if strings.Index(err.Error(), errtxt) == 0 {
 			return nil, NewImageDuplicateError()
@@ -114,6 +114,41 @@ func CreateImage(instance *Ec2Instance, name, description string) (*Image, error
 	return &this, nil
 }
 
+// Check that an image could be created from the specified instance with the
+// given parameters, using the EC2 DryRun mechanism.
+// Return nil if the image could be created, an error otherwise.
+//
+func CheckCreateImage(instance *Ec2Instance, name, description string, tags map[string]string) error {
+	var req *ec2.CreateImageInput
+	var err error
+
+	req = buildCreateImageInput(instance, name, description, tags)
+	req.DryRun = aws.Bool(true)
+
+	_, err = newRegionClient(instance.Fleet.Region).CreateImage(req)
+	return CheckDryRunError(err)
+}
+
+// Build the request to create an image from the specified instance with the
+// given name, description and tags.
+//
+func buildCreateImageInput(instance *Ec2Instance, name, description string, tags map[string]string) *ec2.CreateImageInput {
+	var req ec2.CreateImageInput
+
+	req.InstanceId = aws.String(instance.Name)
+	req.Name = aws.String(name)
+	req.Description = aws.String(description)
+
+	if len(tags) > 0 {
+		req.TagSpecifications = []*ec2.TagSpecification{
+			BuildTagSpecification(ec2.ResourceTypeImage, tags),
+			BuildTagSpecification(ec2.ResourceTypeSnapshot, tags),
+		}
+	}
+
+	return &req
+}
+
 // Create a new image with a given id on the given region.
 // Useful to create a local object without any network operation, then refresh
 // it later if needed.
@@ -178,6 +213,12 @@ func (this *Image) Refresh() error {
 
 	this.State = *image.State
 
+	if image.RootDeviceName != nil {
+		this.RootDevice = *image.RootDeviceName
+	} else {
+		this.RootDevice = ""
+	}
+
 	return nil
 }
 
@@ -185,6 +226,7 @@ func (this *Image) Refresh() error {
 // The new copy receive the specified name and description.
 // The region may be equals to the region of this Image.
 // The name and description can be equals to the ones of another image.
+// The tags of this image are copied to the new copy.
 // If the copy succeed, return a new Image with a "" State.
 // Otherwise, return no Image and an error.
 //
@@ -200,6 +242,7 @@ func (this *Image) Copy(region, name, description string) (*Image, error) {
 	req.Description = aws.String(description)
 	req.Name = aws.String(name)
 	req.SourceRegion = aws.String(this.Region)
+	req.CopyImageTags = aws.Bool(true)
 
 	sess = session.New()
 	client = ec2.New(sess, &aws.Config{Region: aws.String(region)})
@@ -238,6 +281,21 @@ func (this *Image) Deregister() error {
 
 }
 
+// Check that this Image could be removed from the AWS EC2 servers, using the
+// EC2 DryRun mechanism.
+// Return nil if the image could be deregistered, an error otherwise.
+//
+func (this *Image) CheckDeregister() error {
+	var req ec2.DeregisterImageInput
+	var err error
+
+	req.DryRun = aws.Bool(true)
+	req.ImageId = aws.String(this.Id)
+
+	_, err = newRegionClient(this.Region).DeregisterImage(&req)
+	return CheckDryRunError(err)
+}
+
 // Wait for this image to be either "pending" or "available".
 // User can specify a Timeout for how long to wait (possibly NewTimeoutNone()).
 // Return a boolean to indicate if the image is in the desired state at the
@@ -329,6 +387,9 @@ func (this *ImageList) fetchFrom(req *ec2.DescribeImagesInput, region string) ([
 		rimage.Description = *image.Description
 		rimage.State = *image.State
 		rimage.Region = region
+		if image.RootDeviceName != nil {
+			rimage.RootDevice = *image.RootDeviceName
+		}
 		ret = append(ret, rimage)
 	}
 
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+type inventoryParameters struct {
+	OptionAnsible *bool
+	OptionContext *string
+	OptionHost    *string
+	OptionList    *bool
+	OptionUser    *string
+}
+
+var DEFAULT_INVENTORY_ANSIBLE bool = false
+var DEFAULT_INVENTORY_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_INVENTORY_HOST string = ""
+var DEFAULT_INVENTORY_LIST bool = false
+var DEFAULT_INVENTORY_USER string = ""
+
+// The prefix of the host variables holding the instance properties.
+//
+const INVENTORY_VARIABLE_PREFIX string = "ec2tools_"
+
+// The prefix of the groups of hosts by attribute value, so they cannot be
+// mistaken for the groups by fleet or by region.
+//
+const INVENTORY_ATTRIBUTE_PREFIX string = "attr_"
+
+var inventoryParams inventoryParameters
+
+func PrintInventoryUsage() {
+	fmt.Printf(`Usage: %s inventory --ansible [options] [<instance-specs...>]
+
+Print the specified instances as an inventory for a configuration management
+tool. If no instance is specified, then print every instances.
+The only supported format is the Ansible dynamic inventory, so Ansible can use
+the context through a script like:
+
+    #!/bin/sh
+    exec %s inventory --ansible "$@"
+
+Each instance is a host named by the instance id and reached on its public IP
+by the user of its fleet.
+The hosts are grouped by fleet ('fleet_<name>'), by region
+('region_<region>') and by attribute value ('%s<attribute>_<value>'), with
+the characters other than letters, digits and '_' replaced by '_'.
+Every property of a host is available as a variable named by the property with
+an '%s' prefix, like 'ec2tools_public_ip'.
+
+Options:
+
+  --ansible                   print an Ansible dynamic inventory
+
+  --context <path>            path of the context file (default: '%s')
+
+  --host <name>               print the variables of the given host only
+
+  --list                      print every groups and hosts (default)
+
+  --user <user-name>          use a custom user name for the ssh connections
+`,
+		PROGNAME, PROGNAME, INVENTORY_ATTRIBUTE_PREFIX,
+		INVENTORY_VARIABLE_PREFIX, DEFAULT_INVENTORY_CONTEXT)
+}
+
+// Return the given string with every character other than an ASCII letter,
+// an ASCII digit or '_' replaced by '_', so it can be used as an Ansible
+// group or variable name.
+//
+func ansibleName(str string) string {
+	var name []rune = make([]rune, 0, len(str))
+	var c rune
+
+	for _, c = range str {
+		if ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) ||
+			((c >= '0') && (c <= '9')) {
+			name = append(name, c)
+		} else {
+			name = append(name, '_')
+		}
+	}
+
+	return string(name)
+}
+
+// Return the Ansible variables of the given instance.
+//
+func ansibleHostVariables(instance *Ec2Instance) map[string]string {
+	var variables map[string]string = make(map[string]string)
+	var name, value string
+
+	for name = range TRAIT_GETTERS {
+		variables[INVENTORY_VARIABLE_PREFIX+ansibleName(name)] =
+			GetProperty(instance, name).Value
+	}
+
+	for name, value = range instance.Attributes {
+		variables[INVENTORY_VARIABLE_PREFIX+ansibleName(name)] = value
+	}
+
+	variables["ansible_host"] = instance.PublicIp
+
+	if *inventoryParams.OptionUser != "" {
+		variables["ansible_user"] = *inventoryParams.OptionUser
+	} else {
+		variables["ansible_user"] = instance.Fleet.User
+	}
+
+	return variables
+}
+
+// Return the names of the Ansible groups of the given instance.
+//
+func ansibleHostGroups(instance *Ec2Instance) []string {
+	var groups []string = make([]string, 0)
+	var name, value string
+
+	groups = append(groups, "fleet_"+ansibleName(instance.Fleet.Name))
+	groups = append(groups, "region_"+ansibleName(instance.Fleet.Region))
+
+	for name, value = range instance.Attributes {
+		groups = append(groups, INVENTORY_ATTRIBUTE_PREFIX+
+			ansibleName(name)+"_"+ansibleName(value))
+	}
+
+	sort.Strings(groups)
+
+	return groups
+}
+
+// Return the Ansible dynamic inventory of the given instances, as printed for
+// the '--list' option.
+// The instances must be distinct and have a public IP, as returned by
+// Ec2Selection.Reachable().
+//
+func AnsibleInventory(instances []*Ec2Instance) map[string]interface{} {
+	var groups map[string][]string = make(map[string][]string)
+	var hostvars map[string]interface{} = make(map[string]interface{})
+	var inventory map[string]interface{} = make(map[string]interface{})
+	var instance *Ec2Instance
+	var group string
+	var hosts []string
+
+	for _, instance = range instances {
+		hostvars[instance.Name] = ansibleHostVariables(instance)
+
+		for _, group = range ansibleHostGroups(instance) {
+			groups[group] = append(groups[group], instance.Name)
+		}
+	}
+
+	for group, hosts = range groups {
+		inventory[group] = map[string][]string{"hosts": hosts}
+	}
+
+	inventory["_meta"] = map[string]interface{}{"hostvars": hostvars}
+
+	return inventory
+}
+
+func Inventory(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var selection *Ec2Selection
+	var instance *Ec2Instance
+	var output interface{}
+	var specs []string
+	var ctx *Ec2Index
+	var raw []byte
+	var err error
+
+	inventoryParams.OptionAnsible = flags.Bool("ansible", DEFAULT_INVENTORY_ANSIBLE, "")
+	inventoryParams.OptionContext = flags.String("context", DEFAULT_INVENTORY_CONTEXT, "")
+	inventoryParams.OptionHost = flags.String("host", DEFAULT_INVENTORY_HOST, "")
+	inventoryParams.OptionList = flags.Bool("list", DEFAULT_INVENTORY_LIST, "")
+	inventoryParams.OptionUser = flags.String("user", DEFAULT_INVENTORY_USER, "")
+
+	flags.Parse(args[1:])
+
+	if !*inventoryParams.OptionAnsible {
+		Error("missing inventory format, use option --ansible")
+	} else if *inventoryParams.OptionList &&
+		(*inventoryParams.OptionHost != "") {
+		Error("cannot use option --list with option --host")
+	}
+
+	ctx, err = LoadEc2Index(*inventoryParams.OptionContext)
+	if err != nil {
+		Error("no context: %s", *inventoryParams.OptionContext)
+	}
+
+	specs = flags.Args()
+	if len(specs) == 0 {
+		specs = []string{"//"}
+	}
+
+	selection, err = ctx.Select(specs)
+	if err != nil {
+		Error("invalid specification: %s", err.Error())
+	}
+
+	if *inventoryParams.OptionHost != "" {
+		output = map[string]string{}
+
+		for _, instance = range selection.Instances {
+			if instance.Name == *inventoryParams.OptionHost {
+				output = ansibleHostVariables(instance)
+			}
+		}
+	} else {
+		output = AnsibleInventory(selection.Reachable(false))
+	}
+
+	raw, err = json.MarshalIndent(output, "", "  ")
+	if err != nil {
+		Error("cannot print inventory: %s", err.Error())
+	}
+
+	os.Stdout.Write(append(raw, '\n'))
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAnsibleName(t *testing.T) {
+	if ansibleName("my-fleet.2_b") != "my_fleet_2_b" {
+		t.Fail()
+	}
+}
+
+func TestAnsibleInventory(t *testing.T) {
+	var idx *Ec2Index = NewEc2Index()
+	var inventory map[string]interface{}
+	var hostvars map[string]interface{}
+	var variables map[string]string
+	var user string = ""
+	var fleet *Ec2Fleet
+	var instance *Ec2Instance
+
+	defer func(saved *string) {
+		inventoryParams.OptionUser = saved
+	}(inventoryParams.OptionUser)
+
+	inventoryParams.OptionUser = &user
+
+	fleet, _ = idx.AddEc2Fleet("0", "my-fleet", "ubuntu", "us-east-2", 3)
+	instance, _ = fleet.AddEc2Instance("i0", "0.0.0.0", "1.0.0.0")
+	instance.Attributes["role"] = "db"
+	instance.Attributes["fleet"] = "my-fleet"
+	fleet.AddEc2Instance("i1", "0.0.0.1", "1.0.0.1")
+	fleet.AddEc2Instance("i2", "", "1.0.0.2")
+
+	inventory = AnsibleInventory((&Ec2Selection{Instances: append(
+		fleet.Instances, instance)}).Reachable(false))
+
+	if (len(inventory["fleet_my_fleet"].(map[string][]string)["hosts"]) != 2) ||
+		(len(inventory["region_us_east_2"].(map[string][]string)["hosts"]) != 2) ||
+		(len(inventory["attr_role_db"].(map[string][]string)["hosts"]) != 1) ||
+		(len(inventory["attr_fleet_my_fleet"].(map[string][]string)["hosts"]) != 1) {
+		t.FailNow()
+	}
+
+	hostvars = inventory["_meta"].(map[string]interface{})["hostvars"].(map[string]interface{})
+	if len(hostvars) != 2 {
+		t.FailNow()
+	}
+
+	variables = hostvars["i0"].(map[string]string)
+	if (variables["ansible_host"] != "0.0.0.0") ||
+		(variables["ansible_user"] != "ubuntu") ||
+		(variables["ec2tools_private_ip"] != "1.0.0.0") ||
+		(variables["ec2tools_fiid"] != "0") ||
+		(variables["ec2tools_role"] != "db") {
+		t.Fail()
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The suffix appended to the context path to obtain the path of its
+// known_hosts file.
+//
+const KNOWN_HOSTS_SUFFIX string = ".known_hosts"
+
+// The lines delimiting the host keys printed by cloud-init on the console of
+// the instances.
+//
+const (
+	CONSOLE_HOST_KEYS_BEGIN string = "-----BEGIN SSH HOST KEY KEYS-----"
+	CONSOLE_HOST_KEYS_END   string = "-----END SSH HOST KEY KEYS-----"
+)
+
+// The host keys of the instances of a context.
+// The keys are stored in a known_hosts file next to the context file, in the
+// OpenSSH format. Each key is recorded under the instance id instead of its
+// IP address (with the OpenSSH HostKeyAlias option) so a public IP reused by
+// another instance never matches the key of a previous instance, while a key
+// which changes for a given instance is always detected.
+// The keys are either collected from the console output of the instances or
+// trusted on first use.
+//
+type KnownHosts struct {
+	Path string     // path of the known_hosts file
+	lock sync.Mutex // serialize the modifications of the file
+}
+
+// Create a new KnownHosts for the context with the given path.
+//
+func NewKnownHosts(contextPath string) *KnownHosts {
+	var this KnownHosts
+
+	this.Path = contextPath + KNOWN_HOSTS_SUFFIX
+
+	return &this
+}
+
+// Return the ssh options to verify the host key of the host with the given
+// alias against this known_hosts file.
+// Unknown hosts are trusted on first use and their key is recorded.
+//
+func (this *KnownHosts) Options(alias string) []string {
+	return []string{
+		"-o", "StrictHostKeyChecking=accept-new",
+		"-o", "UserKnownHostsFile=" + this.Path,
+		"-o", "GlobalKnownHostsFile=/dev/null",
+		"-o", "HashKnownHosts=no",
+		"-o", "HostKeyAlias=" + alias,
+	}
+}
+
+// Parse the content of a known_hosts file.
+// Return the keys indexed by host alias. Markers, hashed hosts and invalid
+// lines are ignored.
+//
+func parseKnownHosts(content []byte) map[string][]ssh.PublicKey {
+	var keys map[string][]ssh.PublicKey
+	var hosts []string
+	var key ssh.PublicKey
+	var marker, host string
+	var err error
+
+	keys = make(map[string][]ssh.PublicKey)
+
+	for len(content) > 0 {
+		marker, hosts, key, _, content, err = ssh.ParseKnownHosts(
+			content)
+		if err != nil {
+			break
+		} else if marker != "" {
+			continue
+		}
+
+		for _, host = range hosts {
+			keys[host] = append(keys[host], key)
+		}
+	}
+
+	return keys
+}
+
+// Return the keys recorded for the host with the given alias.
+// Return an empty slice if the file does not exist.
+//
+func (this *KnownHosts) Keys(alias string) ([]ssh.PublicKey, error) {
+	var content []byte
+	var err error
+
+	content, err = ioutil.ReadFile(this.Path)
+	if os.IsNotExist(err) {
+		return []ssh.PublicKey{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return parseKnownHosts(content)[alias], nil
+}
+
+// Format a known_hosts line for the given alias and key.
+//
+func formatKnownHost(alias string, key ssh.PublicKey) string {
+	return alias + " " + string(ssh.MarshalAuthorizedKey(key))
+}
+
+// Record the given keys for the host with the given alias if it has no key
+// recorded yet.
+// The keys are appended with a single write, as ssh does when it accepts a
+// new key, so the lines written by concurrent ssh processes never interleave.
+// Return true if the keys have been recorded.
+//
+func (this *KnownHosts) Add(alias string, keys []ssh.PublicKey) (bool, error) {
+	var known []ssh.PublicKey
+	var key ssh.PublicKey
+	var buffer bytes.Buffer
+	var file *os.File
+	var err error
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	known, err = this.Keys(alias)
+	if err != nil {
+		return false, err
+	} else if (len(known) > 0) || (len(keys) == 0) {
+		return false, nil
+	}
+
+	for _, key = range keys {
+		buffer.WriteString(formatKnownHost(alias, key))
+	}
+
+	file, err = os.OpenFile(this.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+		0600)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = file.Write(buffer.Bytes())
+	if err != nil {
+		file.Close()
+		return false, err
+	}
+
+	return true, file.Close()
+}
+
+// Remove the keys of the hosts with the given aliases.
+// Other lines of the file are left untouched.
+//
+func (this *KnownHosts) Remove(aliases []string) error {
+	var removed map[string]bool = make(map[string]bool)
+	var lines []string = make([]string, 0)
+	var content []byte
+	var alias, line string
+	var fields []string
+	var err error
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	content, err = ioutil.ReadFile(this.Path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, alias = range aliases {
+		removed[alias] = true
+	}
+
+	for _, line = range strings.SplitAfter(string(content), "\n") {
+		fields = strings.Fields(line)
+		if (len(fields) > 0) && removed[fields[0]] {
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+
+	return ioutil.WriteFile(this.Path, []byte(strings.Join(lines, "")),
+		0600)
+}
+
+// Check the given key presented by the host with the given alias.
+// If the host is unknown, record the key and accept it, as the OpenSSH
+// 'StrictHostKeyChecking=accept-new' option does.
+// Return an error if the host is known with other keys.
+//
+func (this *KnownHosts) Check(alias string, key ssh.PublicKey) error {
+	var known []ssh.PublicKey
+	var other ssh.PublicKey
+	var added bool
+	var err error
+
+	added, err = this.Add(alias, []ssh.PublicKey{key})
+	if err != nil {
+		return err
+	} else if added {
+		return nil
+	}
+
+	known, err = this.Keys(alias)
+	if err != nil {
+		return err
+	}
+
+	for _, other = range known {
+		if bytes.Equal(other.Marshal(), key.Marshal()) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("host key for %s has changed (%s)", alias,
+		this.Path)
+}
+
+// Return an ssh.HostKeyCallback checking the keys of the host with the given
+// alias.
+//
+func (this *KnownHosts) HostKeyCallback(alias string) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return this.Check(alias, key)
+	}
+}
+
+// Return the host key algorithms to negotiate with the host with the given
+// alias so it presents one of its recorded keys.
+// Return nil if the host is unknown, letting the client use its default
+// algorithms.
+//
+func (this *KnownHosts) HostKeyAlgorithms(alias string) []string {
+	var algorithms []string = make([]string, 0)
+	var keys []ssh.PublicKey
+	var key ssh.PublicKey
+	var err error
+
+	keys, err = this.Keys(alias)
+	if (err != nil) || (len(keys) == 0) {
+		return nil
+	}
+
+	for _, key = range keys {
+		if key.Type() == ssh.KeyAlgoRSA {
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512,
+				ssh.KeyAlgoRSASHA256)
+		}
+
+		algorithms = append(algorithms, key.Type())
+	}
+
+	return algorithms
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Console output related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// Parse the host keys printed by cloud-init in the given console output.
+// The keys are printed between the CONSOLE_HOST_KEYS_BEGIN and
+// CONSOLE_HOST_KEYS_END lines, possibly with a prefix on each line.
+//
+func ParseConsoleHostKeys(output string) []ssh.PublicKey {
+	var keys []ssh.PublicKey = make([]ssh.PublicKey, 0)
+	var inside bool = false
+	var line, field string
+	var key ssh.PublicKey
+	var fields []string
+	var i int
+	var err error
+
+	for _, line = range strings.Split(output, "\n") {
+		if strings.Contains(line, CONSOLE_HOST_KEYS_BEGIN) {
+			inside = true
+			continue
+		} else if strings.Contains(line, CONSOLE_HOST_KEYS_END) {
+			inside = false
+			continue
+		} else if !inside {
+			continue
+		}
+
+		fields = strings.Fields(line)
+
+		for i, field = range fields {
+			if strings.HasPrefix(field, "ssh-") ||
+				strings.HasPrefix(field, "ecdsa-") {
+				break
+			}
+		}
+
+		if i >= (len(fields) - 1) {
+			continue
+		}
+
+		key, _, _, _, err = ssh.ParseAuthorizedKey([]byte(
+			strings.Join(fields[i:], " ")))
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys
+}
+
+// Fetch the host keys of the given instance from its console output.
+// Return an empty slice if the console output does not contain any key yet.
+//
+func FetchConsoleHostKeys(instance *Ec2Instance) ([]ssh.PublicKey, error) {
+	var output *ec2.GetConsoleOutputOutput
+	var client *ec2.EC2
+	var decoded []byte
+	var err error
+
+	client = newRegionClient(instance.Fleet.Region)
+
+	output, err = client.GetConsoleOutput(&ec2.GetConsoleOutputInput{
+		InstanceId: aws.String(instance.Name),
+	})
+	if err != nil {
+		return nil, err
+	} else if output.Output == nil {
+		return []ssh.PublicKey{}, nil
+	}
+
+	decoded, err = base64.StdEncoding.DecodeString(*output.Output)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConsoleHostKeys(string(decoded)), nil
+}
+
+// Collect the host keys of the given instance from its console output if it
+// has no key recorded yet.
+// Return true if the keys are known after the call.
+//
+func (this *KnownHosts) Collect(instance *Ec2Instance) (bool, error) {
+	var keys []ssh.PublicKey
+	var err error
+
+	keys, err = this.Keys(instance.Name)
+	if err != nil {
+		return false, err
+	} else if len(keys) > 0 {
+		return true, nil
+	}
+
+	keys, err = FetchConsoleHostKeys(instance)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = this.Add(instance.Name, keys)
+	if err != nil {
+		return false, err
+	}
+
+	return (len(keys) > 0), nil
+}
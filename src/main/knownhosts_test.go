@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	var pub ed25519.PublicKey
+	var key ssh.PublicKey
+	var err error
+
+	pub, _, err = ed25519.GenerateKey(nil)
+	if err != nil {
+		t.FailNow()
+	}
+
+	key, err = ssh.NewPublicKey(pub)
+	if err != nil {
+		t.FailNow()
+	}
+
+	return key
+}
+
+func TestParseConsoleHostKeys(t *testing.T) {
+	var key ssh.PublicKey = newTestHostKey(t)
+	var keys []ssh.PublicKey
+	var output string
+
+	output = "[   12.345] cloud-init[1234]: booting\n" +
+		"ec2: " + CONSOLE_HOST_KEYS_BEGIN + "\n" +
+		"ec2: " + strings.TrimSpace(string(
+		ssh.MarshalAuthorizedKey(key))) + " root@ip-10-0-0-1\n" +
+		"ec2: garbage line\n" +
+		"ec2: " + CONSOLE_HOST_KEYS_END + "\n" +
+		string(ssh.MarshalAuthorizedKey(newTestHostKey(t)))
+
+	keys = ParseConsoleHostKeys(output)
+	if len(keys) != 1 {
+		t.FailNow()
+	}
+
+	if string(keys[0].Marshal()) != string(key.Marshal()) {
+		t.Fail()
+	}
+
+	if len(ParseConsoleHostKeys("no key here\n")) != 0 {
+		t.Fail()
+	}
+}
+
+func TestKnownHosts(t *testing.T) {
+	var key0 ssh.PublicKey = newTestHostKey(t)
+	var key1 ssh.PublicKey = newTestHostKey(t)
+	var knownHosts *KnownHosts
+	var keys []ssh.PublicKey
+	var added bool
+	var dir string
+	var err error
+
+	dir, err = ioutil.TempDir("", "ec2tools-test")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	knownHosts = NewKnownHosts(filepath.Join(dir, "context"))
+
+	keys, err = knownHosts.Keys("i-0")
+	if (err != nil) || (len(keys) != 0) {
+		t.Fail()
+	}
+
+	added, err = knownHosts.Add("i-0", []ssh.PublicKey{key0})
+	if (err != nil) || !added {
+		t.Fail()
+	}
+
+	added, err = knownHosts.Add("i-0", []ssh.PublicKey{key1})
+	if (err != nil) || added {
+		t.Fail()
+	}
+
+	if knownHosts.Check("i-0", key0) != nil {
+		t.Fail()
+	}
+
+	if knownHosts.Check("i-0", key1) == nil {
+		t.Fail()
+	}
+
+	if knownHosts.Check("i-1", key1) != nil {
+		t.Fail()
+	}
+
+	err = knownHosts.Remove([]string{"i-0"})
+	if err != nil {
+		t.Fail()
+	}
+
+	keys, err = knownHosts.Keys("i-0")
+	if (err != nil) || (len(keys) != 0) {
+		t.Fail()
+	}
+
+	keys, err = knownHosts.Keys("i-1")
+	if (err != nil) || (len(keys) != 1) {
+		t.Fail()
+	}
+}
@@ -16,9 +16,13 @@ var DEFAULT_AVAILABILITY_ZONE string = ""
 var DEFAULT_IMAGE string = "ubuntu/images/hvm-ssd/ubuntu-xenial-16.04-amd64-server-20181114"
 var DEFAULT_KEY string = "default"
 var DEFAULT_PLACEMENT_GROUP string = ""
+var DEFAULT_LAUNCH_OWNER string = DEFAULT_OWNER
 var DEFAULT_PRICE float64 = 1
 var DEFAULT_REGION string = "ap-southeast-2"
 var DEFAULT_REPLACE bool = false
+var DEFAULT_ROOT_IOPS int = 0
+var DEFAULT_ROOT_SIZE int = 0
+var DEFAULT_ROOT_TYPE string = ""
 var DEFAULT_SECGROUP string = "openall"
 var DEFAULT_SIZE int64 = 1
 var DEFAULT_TIME string = "1h"
@@ -28,18 +32,28 @@ var DEFAULT_USER string = "ubuntu"
 var optionAvailabilityZone *string
 var optionImage *string
 var optionKey *string
+var optionOwner *string
 var optionPlacementGroup *string
 var optionPrice *float64
 var optionRegion *string
 var optionReplace *bool
+var optionRootIops *int
+var optionRootSize *int
+var optionRootType *string
 var optionSecgroup *string
 var optionSize *int64
+var optionTag *StringListOption
 var optionTime *string
 var optionType *string
 var optionUser *string
+var optionVolume *StringListOption
+
+var launchProcOptionTag map[string]string
 
 var launchProcOptionTime *Timeout
 
+var launchProcOptionVolume []*Ec2Volume
+
 func PrintLaunchUsage() {
 	fmt.Printf(`Usage: %s launch [options] <fleet-name>
 
@@ -53,11 +67,17 @@ Options:
 
   --context <path>            path of the context file (default: '%s')
 
+  --dry-run                   print the fleet which would be launched and check
+                              the request without launching anything
+
   --image <id | name>         name of the instance image or id if it starts by
                               'ami-' (default: '%s')
 
   --key <key-name>            name of the ssh key to use (default: '%s')
 
+  --owner <name>              owner of the fleet, written in the EC2 tags of
+                              the fleet and its instances (default: '%s')
+
   --placement-group <group>   name of the placement group to use (default: '%s')
 
   --price <float>             maximum price per unit hour (default: %f)
@@ -66,65 +86,189 @@ Options:
 
   --replace                   replace the fleet with the same name if any
 
+  --root-iops <int>           provisioned IOPS of the root volume, requires
+                              --root-type 'io1', 'io2' or 'gp3' (default:
+                              volume type default)
+
+  --root-size <GiB>           size of the root volume (default: image default)
+
+  --root-type <volume-type>   type of the root volume, like 'gp2' or 'io1'
+                              (default: image default)
+
   --secgroup <id>             name of the security group or id if it starts by
                               'sg-' (default: '%s')
 
   --size <int>                number of instances in the fleet (default: %d)
 
+  --tag <key>=<value>         add an EC2 tag to the fleet and its instances,
+                              can be specified several times
+
   --time <timespec>           maximum life duration of the fleet (default: '%s')
 
   --type <instance-type>      type of instance (default: '%s')
 
   --user <user-name>          user to ssh connect to instances (default: '%s')
 
+  --volume <volume-spec>      attach an additional volume to every instances,
+                              can be specified several times (see Volumes)
+
+  --yes                       do not ask for a confirmation before to replace
+                              an existing fleet
+
+Volumes:
+  An additional volume is either an EBS volume or an instance store volume
+  mapped on a device name. An EBS volume is described by its size in GiB and
+  optionally by its type and provisioned IOPS, only for the 'io1', 'io2' and
+  'gp3' types. An instance store volume is described by its virtual name.
+
+      /dev/sdb=100            a 100 GiB EBS volume of default type
+
+      /dev/sdb=500:io1:5000   a 500 GiB io1 EBS volume with 5000 IOPS
+
+      /dev/sdc=ephemeral0     the first instance store volume
+
+  The volumes of a fleet can be printed with the 'volumes' property of the
+  'get' subcommand.
+
+Tags:
+  The fleet and its instances are tagged on EC2 with their fleet name, the
+  ssh user name, the owner and the absolute path of the context file, in
+  addition to the tags specified with '--tag'. The 'Name' tag is set to the
+  fleet name unless specified with '--tag'.
+
 `,
 		PROGNAME, DEFAULT_AVAILABILITY_ZONE, DEFAULT_CONTEXT,
-		DEFAULT_IMAGE, DEFAULT_KEY, DEFAULT_PLACEMENT_GROUP,
+		DEFAULT_IMAGE, DEFAULT_KEY, DEFAULT_LAUNCH_OWNER,
+		DEFAULT_PLACEMENT_GROUP,
 		DEFAULT_PRICE, DEFAULT_REGION, DEFAULT_SECGROUP, DEFAULT_SIZE,
 		DEFAULT_TIME, DEFAULT_TYPE, DEFAULT_USER)
 }
 
-func buildFleetRequest() *ec2.RequestSpotFleetInput {
+// Indicate if the root volume of the image must be modified.
+//
+func needRootVolume() bool {
+	return (*optionRootSize > 0) || (*optionRootType != "") ||
+		(*optionRootIops > 0)
+}
+
+// Fetch the image to launch the fleet with from the launch region.
+// The image is specified either by its id or by its name.
+// Exit with an error if there is not exactly one such image.
+//
+func fetchLaunchImage() *Image {
+	var ilist *ImageList = NewImageList()
+	var image *Image
+	var err error
+
+	if IsImageId(*optionImage) {
+		err = ilist.Find(*optionImage, *optionRegion)
+	} else {
+		err = ilist.Fetch(*optionImage, *optionRegion)
+	}
+
+	if err != nil {
+		Error("cannot use image '%s': %s", *optionImage, err.Error())
+	}
+
+	if len(ilist.Images) > 1 {
+		Error("more than one image named '%s' in region %s",
+			*optionImage, *optionRegion)
+	}
+
+	_, err = ilist.WaitAvailable(NewTimeoutNone())
+	if err != nil {
+		Error("cannot wait image '%s' to be available", *optionImage)
+	}
+
+	if len(ilist.Images) < 1 {
+		Error("no image named '%s' in region %s", *optionImage,
+			*optionRegion)
+	}
+
+	for _, image = range ilist.Images {
+		break
+	}
+
+	return image
+}
+
+// Add the root volume described by the '--root-*' options to the volumes to
+// launch the fleet with.
+// The root volume is mapped on the root device of the given image.
+//
+func addRootVolume(image *Image) {
+	var root Ec2Volume
+	var volume *Ec2Volume
+
+	if image.RootDevice == "" {
+		Error("cannot find root device of image '%s'", image.Id)
+	}
+
+	for _, volume = range launchProcOptionVolume {
+		if volume.Device == image.RootDevice {
+			Error("conflicting volume for root device '%s'",
+				image.RootDevice)
+		}
+	}
+
+	root.Device = image.RootDevice
+	root.Size = *optionRootSize
+	root.Type = *optionRootType
+	root.Iops = *optionRootIops
+
+	launchProcOptionVolume = append([]*Ec2Volume{&root},
+		launchProcOptionVolume...)
+}
+
+// Return the EC2 tags to apply to a fleet with the given name and to its
+// instances.
+//
+func buildFleetTags(fleetName string) map[string]string {
+	var tags map[string]string
+	var key, value string
+
+	tags = NewContextTags(*optionContext, *optionOwner)
+	tags[TAG_NAME] = fleetName
+	tags[TAG_FLEET] = fleetName
+	tags[TAG_USER] = *optionUser
+
+	for key, value = range launchProcOptionTag {
+		tags[key] = value
+	}
+
+	return tags
+}
+
+func buildFleetRequest(fleetName string) *ec2.RequestSpotFleetInput {
+	var tags map[string]string = buildFleetTags(fleetName)
 	var spec ec2.SpotFleetLaunchSpecification
 	var conf ec2.SpotFleetRequestConfigData
 	var placement ec2.SpotPlacement
 	var req ec2.RequestSpotFleetInput
 	var until time.Time = launchProcOptionTime.DeadlineDate()
-	var ilist *ImageList
+	var volume *Ec2Volume
 	var sgroupid *string
 	var image *Image
 	var err error
 
-	if IsImageId(*optionImage) {
+	if IsImageId(*optionImage) && !needRootVolume() {
 		spec.ImageId = aws.String(*optionImage)
 	} else {
-		ilist = NewImageList()
+		image = fetchLaunchImage()
+		spec.ImageId = aws.String(image.Id)
 
-		err = ilist.Fetch(*optionImage, *optionRegion)
-		if err != nil {
-			Error("cannot use image '%s': %s", *optionImage,
-				err.Error())
-		}
-
-		if len(ilist.Images) > 1 {
-			Error("more than one image named '%s' in region %s",
-				*optionImage, *optionRegion)
-		}
-
-		_, err = ilist.WaitAvailable(NewTimeoutNone())
-		if err != nil {
-			Error("cannot wait image '%s' to be available",
-				*optionImage)
-		}
-
-		if len(ilist.Images) < 1 {
-			Error("no image named '%s' in region %s",
-				*optionImage, *optionRegion)
+		if needRootVolume() {
+			addRootVolume(image)
 		}
+	}
 
-		for _, image = range ilist.Images {
-			spec.ImageId = aws.String(image.Id)
-			break
+	if len(launchProcOptionVolume) > 0 {
+		spec.BlockDeviceMappings = make([]*ec2.BlockDeviceMapping, 0,
+			len(launchProcOptionVolume))
+		for _, volume = range launchProcOptionVolume {
+			spec.BlockDeviceMappings = append(
+				spec.BlockDeviceMappings,
+				volume.BlockDeviceMapping())
 		}
 	}
 
@@ -142,6 +286,12 @@ func buildFleetRequest() *ec2.RequestSpotFleetInput {
 
 	spec.InstanceType = optionType
 	spec.KeyName = optionKey
+	spec.TagSpecifications = []*ec2.SpotFleetTagSpecification{
+		&ec2.SpotFleetTagSpecification{
+			ResourceType: aws.String(ec2.ResourceTypeInstance),
+			Tags:         BuildEc2Tags(tags),
+		},
+	}
 	spec.SecurityGroups = []*ec2.GroupIdentifier{
 		&ec2.GroupIdentifier{
 			GroupId: aws.String(*sgroupid),
@@ -170,6 +320,9 @@ func buildFleetRequest() *ec2.RequestSpotFleetInput {
 	conf.LaunchSpecifications = []*ec2.SpotFleetLaunchSpecification{
 		&spec,
 	}
+	conf.TagSpecifications = []*ec2.TagSpecification{
+		BuildTagSpecification(ec2.ResourceTypeSpotFleetRequest, tags),
+	}
 
 	req.DryRun = aws.Bool(false)
 	req.SpotFleetRequestConfig = &conf
@@ -177,22 +330,79 @@ func buildFleetRequest() *ec2.RequestSpotFleetInput {
 	return &req
 }
 
+// Print the fleet which would be launched with the given request and the
+// fleet it would replace if any, then check the request using the EC2 DryRun
+// mechanism.
+//
+func dryRunLaunch(ctx *Ec2Index, fleetName string, fleetRequest *ec2.RequestSpotFleetInput) {
+	var conf *ec2.SpotFleetRequestConfigData
+	var spec *ec2.SpotFleetLaunchSpecification
+	var volume *Ec2Volume
+	var client *ec2.EC2
+	var fleet *Ec2Fleet
+	var err error
+
+	conf = fleetRequest.SpotFleetRequestConfig
+	spec = conf.LaunchSpecifications[0]
+
+	fleet = ctx.FleetsByName[fleetName]
+	if fleet != nil {
+		if !*optionReplace {
+			Error("fleet '%s' already exists", fleetName)
+		}
+
+		DryRunPrint("cancel fleet '%s' (%s) in region %s and "+
+			"terminate its %d instances", fleet.Name, fleet.Id,
+			fleet.Region, len(fleet.Instances))
+	}
+
+	DryRunPrint("request fleet '%s' of %d %s instances with image %s in "+
+		"region %s until %s", fleetName, *conf.TargetCapacity,
+		*spec.InstanceType, *spec.ImageId, *optionRegion,
+		conf.ValidUntil.Format(time.RFC3339))
+
+	for _, volume = range launchProcOptionVolume {
+		DryRunPrint("attach volume %s to each instance",
+			volume.String())
+	}
+
+	fleetRequest.DryRun = aws.Bool(true)
+
+	client = newRegionClient(*optionRegion)
+	_, err = client.RequestSpotFleet(fleetRequest)
+
+	err = CheckDryRunError(err)
+	if err != nil {
+		Error("launch request would fail: %s", err.Error())
+	}
+}
+
 func doLaunch(fleetName string) {
-	var fleetRequest *ec2.RequestSpotFleetInput = buildFleetRequest()
+	var fleetRequest *ec2.RequestSpotFleetInput
 	var response *ec2.RequestSpotFleetOutput
 	var sess *session.Session
 	var req *request.Request
 	var client *ec2.EC2
+	var fleet *Ec2Fleet
 	var ctx *Ec2Index
 	var err error
 
+	fleetRequest = buildFleetRequest(fleetName)
+
 	ctx, err = LoadEc2Index(*optionContext)
 	if err != nil {
 		ctx = NewEc2Index()
 	}
 
+	if *optionDryRun {
+		dryRunLaunch(ctx, fleetName, fleetRequest)
+		return
+	}
+
 	if ctx.FleetsByName[fleetName] != nil {
 		if *optionReplace {
+			ConfirmOrExit(*optionYes, "replace fleet '%s'?",
+				fleetName)
 			DoStop(ctx, []string{fleetName})
 		} else {
 			Error("fleet '%s' already exists", fleetName)
@@ -208,8 +418,9 @@ func doLaunch(fleetName string) {
 		Error("launch request failed: %s", err.Error())
 	}
 
-	ctx.AddEc2Fleet(*response.SpotFleetRequestId, fleetName, *optionUser,
-		*optionRegion, int(*optionSize))
+	fleet, _ = ctx.AddEc2Fleet(*response.SpotFleetRequestId, fleetName,
+		*optionUser, *optionRegion, int(*optionSize))
+	fleet.Volumes = launchProcOptionVolume
 
 	StoreEc2Index(*optionContext, ctx)
 }
@@ -222,6 +433,53 @@ func processLaunchOptionTime() {
 	}
 }
 
+func processLaunchOptionTag() {
+	var err error
+
+	launchProcOptionTag = make(map[string]string)
+
+	err = ParseTagSpecs(launchProcOptionTag, optionTag.Values)
+	if err != nil {
+		Error("invalid value for option --tag: %s", err.Error())
+	}
+}
+
+func processLaunchOptionVolume() {
+	var devices map[string]bool = make(map[string]bool)
+	var volume *Ec2Volume
+	var spec string
+	var err error
+
+	launchProcOptionVolume = make([]*Ec2Volume, 0)
+
+	for _, spec = range optionVolume.Values {
+		volume, err = ParseVolumeSpec(spec)
+		if err != nil {
+			Error("invalid value for option --volume: %s",
+				err.Error())
+		}
+
+		if devices[volume.Device] {
+			Error("conflicting volumes for device '%s'",
+				volume.Device)
+		}
+
+		devices[volume.Device] = true
+		launchProcOptionVolume = append(launchProcOptionVolume, volume)
+	}
+
+	if *optionRootSize < 0 {
+		Error("invalid value for option --root-size: %d",
+			*optionRootSize)
+	} else if *optionRootIops < 0 {
+		Error("invalid value for option --root-iops: %d",
+			*optionRootIops)
+	} else if (*optionRootIops > 0) && !isIopsVolumeType(*optionRootType) {
+		Error("option --root-iops requires option --root-type with " +
+			"'io1', 'io2' or 'gp3'")
+	}
+}
+
 func Launch(args []string) {
 	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
 	var fleetName string
@@ -229,18 +487,28 @@ func Launch(args []string) {
 	optionAvailabilityZone = flags.String("availability-zone",
 		DEFAULT_AVAILABILITY_ZONE, "")
 	optionContext = flags.String("context", DEFAULT_CONTEXT, "")
+	optionDryRun = flags.Bool("dry-run", DEFAULT_DRY_RUN, "")
 	optionImage = flags.String("image", DEFAULT_IMAGE, "")
 	optionKey = flags.String("key", DEFAULT_KEY, "")
+	optionOwner = flags.String("owner", DEFAULT_LAUNCH_OWNER, "")
 	optionPlacementGroup = flags.String("placement-group",
 		DEFAULT_PLACEMENT_GROUP, "")
 	optionPrice = flags.Float64("price", DEFAULT_PRICE, "")
 	optionRegion = flags.String("region", DEFAULT_REGION, "")
 	optionReplace = flags.Bool("replace", DEFAULT_REPLACE, "")
+	optionRootIops = flags.Int("root-iops", DEFAULT_ROOT_IOPS, "")
+	optionRootSize = flags.Int("root-size", DEFAULT_ROOT_SIZE, "")
+	optionRootType = flags.String("root-type", DEFAULT_ROOT_TYPE, "")
 	optionSecgroup = flags.String("secgroup", DEFAULT_SECGROUP, "")
 	optionSize = flags.Int64("size", DEFAULT_SIZE, "")
+	optionTag = NewStringListOption()
+	flags.Var(optionTag, "tag", "")
 	optionTime = flags.String("time", DEFAULT_TIME, "")
 	optionType = flags.String("type", DEFAULT_TYPE, "")
 	optionUser = flags.String("user", DEFAULT_USER, "")
+	optionVolume = NewStringListOption()
+	flags.Var(optionVolume, "volume", "")
+	optionYes = flags.Bool("yes", DEFAULT_YES, "")
 
 	flags.Parse(args[1:])
 
@@ -252,7 +520,9 @@ func Launch(args []string) {
 
 	fleetName = flags.Args()[0]
 
+	processLaunchOptionTag()
 	processLaunchOptionTime()
+	processLaunchOptionVolume()
 
 	doLaunch(fleetName)
 }
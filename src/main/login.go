@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+type loginParameters struct {
+	OptionCommand        *string
+	OptionContext        *string
+	OptionControlPersist *string
+	OptionUser           *string
+}
+
+var DEFAULT_LOGIN_COMMAND string = ""
+var DEFAULT_LOGIN_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_LOGIN_CONTROL_PERSIST string = DEFAULT_CONTROL_PERSIST
+var DEFAULT_LOGIN_USER string = ""
+
+var loginParams loginParameters
+
+func PrintLoginUsage() {
+	fmt.Printf(`Usage: %s login [options] [<instance-specs...>]
+
+Open an interactive terminal on one instance.
+If the specifications match several instances, or if no instance is
+specified, then print the matching instances and ask which one to log in.
+The connection uses the user of the fleet of the instance and checks its host
+key as '%s ssh' does.
+
+Options:
+
+  --command <cmd>             use a custom ssh command
+
+  --context <path>            path of the context file (default: '%s')
+
+  --control-persist <time>    keep the ssh connection open in background for
+                              <time> after the logout, or 'none' (default:
+                              '%s')
+
+  --user <user-name>          use a custom user name for the ssh connection
+`,
+		PROGNAME, PROGNAME, DEFAULT_LOGIN_CONTEXT,
+		DEFAULT_LOGIN_CONTROL_PERSIST)
+}
+
+// Print the given instances with their number on the stderr and ask the user
+// to pick one of them.
+// Return the picked instance or exit with an error if the answer is invalid.
+//
+func pickInstance(instances []*Ec2Instance) *Ec2Instance {
+	var reader *bufio.Reader = bufio.NewReader(os.Stdin)
+	var instance *Ec2Instance
+	var format, answer string
+	var width, i, n int
+	var err error
+
+	width = len(strconv.Itoa(len(instances)))
+	format = fmt.Sprintf("  %%%dd) %%s  %%s/%%d  %%s\n", width)
+
+	for i, instance = range instances {
+		fmt.Fprintf(os.Stderr, format, i+1, instance.Name,
+			instance.Fleet.Name, instance.FleetIndex,
+			instance.PublicIp)
+	}
+
+	fmt.Fprintf(os.Stderr, "Select an instance [1-%d]: ", len(instances))
+
+	answer, err = reader.ReadString('\n')
+	if (err != nil) && (answer == "") {
+		fmt.Fprintf(os.Stderr, "\n")
+		Error("no instance selected")
+	}
+
+	n, err = strconv.Atoi(strings.TrimSpace(answer))
+	if (err != nil) || (n < 1) || (n > len(instances)) {
+		Error("invalid instance number: '%s'", strings.TrimSpace(answer))
+	}
+
+	return instances[n-1]
+}
+
+// Replace this process by an interactive ssh session on the given instance.
+// This function never returns.
+//
+func doLogin(instance *Ec2Instance) {
+	var connector *sshConnector
+	var builder *SshProcessBuilder
+	var cmdline []string
+	var path string
+	var err error
+
+	if instance.PublicIp == "" {
+		Error("instance %s has no public ip", instance.Name)
+	}
+
+	connector = newSshConnector(*loginParams.OptionContext,
+		*loginParams.OptionControlPersist, TRANSPORT_OPENSSH,
+		DEFAULT_NATIVE_CONCURRENCY, *loginParams.OptionCommand,
+		*loginParams.OptionUser, false)
+
+	builder = connector.Builder(instance, []string{})
+	builder.Tty()
+
+	cmdline = builder.Cmdline()
+
+	path, err = exec.LookPath(cmdline[0])
+	if err != nil {
+		Error("cannot find ssh command: %s", err.Error())
+	}
+
+	err = syscall.Exec(path, cmdline, os.Environ())
+	Error("cannot execute ssh command: %s", err.Error())
+}
+
+func Login(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var selection *Ec2Selection
+	var instances []*Ec2Instance
+	var specs []string
+	var ctx *Ec2Index
+	var err error
+
+	loginParams.OptionCommand = flags.String("command", DEFAULT_LOGIN_COMMAND, "")
+	loginParams.OptionContext = flags.String("context", DEFAULT_LOGIN_CONTEXT, "")
+	loginParams.OptionControlPersist = flags.String("control-persist", DEFAULT_LOGIN_CONTROL_PERSIST, "")
+	loginParams.OptionUser = flags.String("user", DEFAULT_LOGIN_USER, "")
+
+	flags.Parse(args[1:])
+
+	ctx, err = LoadEc2Index(*loginParams.OptionContext)
+	if err != nil {
+		Error("no context: %s", *loginParams.OptionContext)
+	}
+
+	specs = flags.Args()
+	if len(specs) == 0 {
+		specs = []string{"//"}
+	}
+
+	selection, err = ctx.Select(specs)
+	if err != nil {
+		Error("invalid specification: %s", err.Error())
+	}
+
+	instances = selection.Unique()
+
+	if len(instances) == 0 {
+		Error("no instance matches the specification")
+	} else if len(instances) == 1 {
+		doLogin(instances[0])
+	} else {
+		doLogin(pickInstance(instances))
+	}
+}
@@ -32,16 +32,27 @@ Provide a convenient way to use Amazon EC2 spot instances over several regions
 from simple bash scripts.
 
 Commands:
+  adopt        rebuild the context from the fleets running on EC2
   describe     describe a saved base image
+  dispatch     run a queue of jobs on instances
   drop         deregister a saved base image
+  forward      open ssh tunnels to instances
+  gc           find and collect orphan resources on EC2
   get          obtain information on fleets or instances
   help         display help on a specific command
+  inventory    print instances as an Ansible inventory
   launch       launch a new fleet of instances
+  login        open an interactive terminal on an instance
+  recover      same as adopt
+  run          run a local script on instances
   save         save an instance as a base image
   stop         stop one, several or all instances
   scp          copy files from and to instances
   set          add information on fleets or instances
+  shell        open an interactive shell on instances
   ssh          launch arbitrary commands on instances
+  ssh-config   print an OpenSSH configuration for instances
+  tmux         open a tmux session with a terminal on instances
   update       update the state of the launched instances
   wait         wait for some instances to be ready
 `, PROGNAME)
@@ -76,26 +87,46 @@ func main() {
 
 	command = flag.Args()[0]
 
-	if command == "describe" {
+	if (command == "adopt") || (command == "recover") {
+		Adopt(flag.Args())
+	} else if command == "describe" {
 		Describe(flag.Args())
+	} else if command == "dispatch" {
+		Dispatch(flag.Args())
 	} else if command == "drop" {
 		Drop(flag.Args())
+	} else if command == "forward" {
+		Forward(flag.Args())
+	} else if command == "gc" {
+		Gc(flag.Args())
 	} else if command == "get" {
 		Get(flag.Args())
 	} else if command == "help" {
 		Help(flag.Args())
+	} else if command == "inventory" {
+		Inventory(flag.Args())
 	} else if command == "launch" {
 		Launch(flag.Args())
+	} else if command == "login" {
+		Login(flag.Args())
+	} else if command == "run" {
+		Run(flag.Args())
 	} else if command == "save" {
 		Save(flag.Args())
 	} else if command == "scp" {
 		Scp(flag.Args())
 	} else if command == "set" {
 		Set(flag.Args())
+	} else if command == "shell" {
+		Shell(flag.Args())
 	} else if command == "ssh" {
 		Ssh(flag.Args())
+	} else if command == "ssh-config" {
+		SshConfig(flag.Args())
 	} else if command == "stop" {
 		Stop(flag.Args())
+	} else if command == "tmux" {
+		Tmux(flag.Args())
 	} else if command == "update" {
 		Update(flag.Args())
 	} else if command == "wait" {
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+)
+
+// A command line option which can be specified several times.
+// Each occurence of the option appends its value to the list of values.
+// Implements the flag.Value interface.
+//
+type StringListOption struct {
+	Values []string // values given to the option, in command line order
+}
+
+// Create a new StringListOption with no value.
+//
+func NewStringListOption() *StringListOption {
+	var this StringListOption
+
+	this.Values = make([]string, 0)
+
+	return &this
+}
+
+// The implementation of flag.Value.String() for StringListOption.
+// Return all the values separated by commas.
+//
+func (this *StringListOption) String() string {
+	return strings.Join(this.Values, ",")
+}
+
+// The implementation of flag.Value.Set() for StringListOption.
+// Append the given value to the list of values and never fail.
+//
+func (this *StringListOption) Set(value string) error {
+	this.Values = append(this.Values, value)
+	return nil
+}
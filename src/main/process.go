@@ -116,6 +116,56 @@ func (this *Pipe) Close() {
 	this.lock.Unlock()
 }
 
+// A command executed asynchronously, with streams and an exit status.
+// The standard exec.Cmd implements this interface but a command can also be
+// implemented in Go, for instance to execute a command on a remote host.
+//
+type Command interface {
+	// Return a stream to read the standard output of the command.
+	// Must be called before Command.Start().
+	//
+	StdoutPipe() (io.ReadCloser, error)
+
+	// Return a stream to read the standard error of the command.
+	// Must be called before Command.Start().
+	//
+	StderrPipe() (io.ReadCloser, error)
+
+	// Return a stream to write on the standard input of the command.
+	// Must be called before Command.Start().
+	//
+	StdinPipe() (io.WriteCloser, error)
+
+	// Start the command without waiting for it to finish.
+	//
+	Start() error
+
+	// Wait for the command to finish.
+	// Return nil if the command exits successfully or an error otherwise.
+	//
+	Wait() error
+}
+
+// A Command which can be killed before it finishes.
+// The standard exec.Cmd is killed through its os.Process instead.
+//
+type KillableCommand interface {
+	// Kill the command if it is running.
+	//
+	Kill() error
+}
+
+// An error reporting the exit status of a command which does not exit
+// successfully.
+//
+type ExitStatusError interface {
+	error
+
+	// Return the exit status of the command.
+	//
+	ExitStatus() int
+}
+
 // An external process, monitored by the go process.
 // The Go process read its stdout and stderr and write its stdin.
 // The Go process also can wait for the termination of the external process and
@@ -125,12 +175,14 @@ func (this *Pipe) Close() {
 // termination.
 //
 type Process struct {
-	command  *exec.Cmd // internal Go representation of an external process
+	command  Command   // internal Go representation of an external process
 	stdout   *Pipe     // pipe input buffer for stdout stream
 	stderr   *Pipe     // pipe input buffer for stderr stream
 	stdin    *Pipe     // pipe output buffer for stdin stream
 	exitcode chan *int // exit code (or nil) protected by implicit lock
 	exitwait chan bool // unlock-once condition for Process.WaitFinished
+
+	cancel context.CancelFunc // release the timeout context, if any
 }
 
 // Create a new Process structure with a nil Process.command
@@ -144,6 +196,7 @@ func newProcess() *Process {
 	this.stdin = NewPipe()
 	this.exitcode = make(chan *int, 1) // must have buffer of 1
 	this.exitwait = make(chan bool, 1) // must have buffer of 1
+	this.cancel = nil
 
 	this.exitcode <- nil // fill exitcode pointer with initial nil value
 
@@ -161,6 +214,34 @@ func NewProcess(cmdline []string) *Process {
 	return this
 }
 
+// Create a new process with the specified command line in its own process
+// group, so it does not receive the signals the terminal sends to the
+// foreground process group, like the SIGINT of a Ctrl-C.
+// The Process does not start immediately.
+//
+func NewProcessIsolated(cmdline []string) *Process {
+	var this *Process = newProcess()
+	var cmd *exec.Cmd
+
+	cmd = exec.Command(cmdline[0], cmdline[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	this.command = cmd
+
+	return this
+}
+
+// Create a new process executing the specified Command.
+// The Process does not start immediately.
+//
+func NewProcessCommand(command Command) *Process {
+	var this *Process = newProcess()
+
+	this.command = command
+
+	return this
+}
+
 // Create a new process with the specified command line, sopping after a given
 // number of seconds.
 // The Process does not start immediately.
@@ -172,7 +253,7 @@ func NewProcessTimeout(cmdline []string, timeout int) *Process {
 
 	lifetime = time.Duration(timeout) * time.Second
 
-	ctx, _ = context.WithTimeout(context.Background(), lifetime)
+	ctx, this.cancel = context.WithTimeout(context.Background(), lifetime)
 
 	this.command = exec.CommandContext(ctx, cmdline[0], cmdline[1:]...)
 
@@ -190,6 +271,10 @@ func (this *Process) wait() {
 
 	err = this.command.Wait()
 
+	if this.cancel != nil {
+		this.cancel()
+	}
+
 	if err == nil {
 		status = 0
 	} else {
@@ -197,6 +282,8 @@ func (this *Process) wait() {
 		case *exec.ExitError:
 			exerr = err.(*exec.ExitError)
 			status = exerr.Sys().(syscall.WaitStatus).ExitStatus()
+		case ExitStatusError:
+			status = err.(ExitStatusError).ExitStatus()
 		default:
 			status = -1
 		}
@@ -286,6 +373,47 @@ func (this *Process) Start() {
 	}()
 }
 
+// Mark this process as finished with the given exit status without starting
+// it.
+// The output streams are closed and what is written on the input stream is
+// discarded.
+// Must not be called after Process.Start().
+//
+func (this *Process) Abort(status int) {
+	this.stdout.Close()
+	this.stderr.Close()
+	this.stdin.Close()
+
+	<-this.exitcode
+	this.exitcode <- &status
+	this.exitwait <- true
+}
+
+// Kill this process if it is running.
+// Has no effect if the process is not started yet or already finished.
+//
+func (this *Process) Kill() error {
+	var killable KillableCommand
+	var cmd *exec.Cmd
+	var ok bool
+
+	cmd, ok = this.command.(*exec.Cmd)
+	if ok {
+		if cmd.Process == nil {
+			return nil
+		}
+
+		return cmd.Process.Kill()
+	}
+
+	killable, ok = this.command.(KillableCommand)
+	if ok {
+		return killable.Kill()
+	}
+
+	return nil
+}
+
 // Read the next line from this process standard output.
 // Block if there is no line available yet.
 // Return false in second value if the standard output is closed.
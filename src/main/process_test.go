@@ -117,3 +117,28 @@ func TestWriteStdin(t *testing.T) {
 	proc.CloseStdin()
 	proc.WaitFinished()
 }
+
+func TestAbort(t *testing.T) {
+	var proc *Process = NewProcess([]string{"true"})
+	var code int
+	var has bool
+
+	proc.WriteStdin("never read\n")
+	proc.Abort(42)
+	proc.WaitFinished()
+
+	code, has = proc.ExitCode()
+	if !has || (code != 42) {
+		t.FailNow()
+	}
+
+	_, has = proc.ReadStdout()
+	if has {
+		t.FailNow()
+	}
+
+	_, has = proc.ReadStderr()
+	if has {
+		t.FailNow()
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"strconv"
+	"strings"
 )
 
 // The property of a given instance.
@@ -83,6 +84,20 @@ func GetUser(instance *Ec2Instance) *Property {
 	return newTraitProperty(instance, "user", instance.Fleet.User)
 }
 
+// Return the volumes property of the instance, as a space separated list of
+// volume specifications.
+//
+func GetVolumes(instance *Ec2Instance) *Property {
+	var specs []string = make([]string, 0, len(instance.Fleet.Volumes))
+	var volume *Ec2Volume
+
+	for _, volume = range instance.Fleet.Volumes {
+		specs = append(specs, volume.String())
+	}
+
+	return newTraitProperty(instance, "volumes", strings.Join(specs, " "))
+}
+
 // Return the attribute of the instance with the given name.
 // If the instance has no attribute with this name, return a Property with a
 // Value field set to the empty string and a Defined field set to false.
@@ -98,36 +113,53 @@ func GetAttribute(instance *Ec2Instance, name string) *Property {
 	return &property
 }
 
+// A function returning a trait property of an instance.
+//
+type TraitGetter func(*Ec2Instance) *Property
+
+// The functions returning the trait properties, by trait name.
+//
+var TRAIT_GETTERS map[string]TraitGetter = map[string]TraitGetter{
+	"fleet":      GetFleet,
+	"fiid":       GetFiid,
+	"name":       GetName,
+	"public-ip":  GetPublicIp,
+	"private-ip": GetPrivateIp,
+	"region":     GetRegion,
+	"uiid":       GetUiid,
+	"user":       GetUser,
+	"volumes":    GetVolumes,
+}
+
+// The trait names accepted in place of others.
+//
+var TRAIT_ALIASES map[string]string = map[string]string{
+	"ip": "public-ip",
+}
+
 // Return the property of the instance with the given name.
-// If the name correspond to a trait name, return the trait property.
+// If the name correspond to a trait name or alias, return the trait property.
 // Otherwise, return the attribute property.
 // If the instance has no trait nor attribute with this name, return am
 // attribute Property with a Value field set to the empty string and a Defined
 // field set to false.
 //
 func GetProperty(instance *Ec2Instance, name string) *Property {
-	switch name {
-	case "fleet":
-		return GetFleet(instance)
-	case "fiid":
-		return GetFiid(instance)
-	case "ip":
-		return GetPublicIp(instance)
-	case "name":
-		return GetName(instance)
-	case "public-ip":
-		return GetPublicIp(instance)
-	case "private-ip":
-		return GetPrivateIp(instance)
-	case "region":
-		return GetRegion(instance)
-	case "uiid":
-		return GetUiid(instance)
-	case "user":
-		return GetUser(instance)
-	default:
-		return GetAttribute(instance, name)
+	var getter TraitGetter
+	var trait string
+	var found bool
+
+	trait, found = TRAIT_ALIASES[name]
+	if found {
+		name = trait
+	}
+
+	getter, found = TRAIT_GETTERS[name]
+	if found {
+		return getter(instance)
 	}
+
+	return GetAttribute(instance, name)
 }
 
 // Return the trait name corresponding to a given one letter shortcut.
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+type runParameters struct {
+	OptionMode     *string
+	OptionTemplate *bool
+}
+
+var DEFAULT_RUN_MODE string = "stream"
+var DEFAULT_RUN_TEMPLATE bool = false
+
+// The remote path of the scripts uploaded by '--mode upload', with a random
+// token.
+//
+const REMOTE_SCRIPT_PATTERN string = "/tmp/.ec2tools-run-%s"
+
+var runParams runParameters
+
+func PrintRunUsage() {
+	fmt.Printf(`Usage: %s run [options] [ <instance-specs...> '--' ] <script> [ <args...> ]
+
+Run a local script with the given arguments on one or many instances.
+If no instance is specified, then run the script on every instances.
+The script is copied in a temporary file on each instance, executed with its
+interpreter line, if any, and removed once finished.
+The output streams and exit codes are aggregated as '%s ssh' does and every
+'%s ssh' option is accepted (see '%s help ssh').
+
+Options:
+  --format                    interpret the args as printf format for each
+                              instance (see '%s help get')
+  --mode <mode>               how to copy the script (default: '%s')
+  --template                  interpret the script content as printf format
+                              for each instance (see '%s help get')
+
+Modes:
+  stream                      Send the script on the stdin of the ssh
+                              connection which runs it. The script reads an
+                              empty input.
+
+  upload                      Upload the script with a first ssh connection,
+                              then run it with a second one. The script
+                              reads the stdin as the '--stdin' and
+                              '--stdin-file' options specify.
+`,
+		PROGNAME, PROGNAME, PROGNAME, PROGNAME, PROGNAME,
+		DEFAULT_RUN_MODE, PROGNAME)
+}
+
+// Return the given arguments quoted for the remote shell.
+//
+func quoteScriptArgs(args []string) []string {
+	var quoted []string = make([]string, len(args))
+	var i int
+
+	for i = range args {
+		quoted[i] = ShellQuote(args[i])
+	}
+
+	return quoted
+}
+
+// Return the remote shell command line running the script at the given
+// remote path with the given arguments, then removing the script and exiting
+// with the exit code of the script.
+//
+func runScriptCmdline(path string, args []string) []string {
+	var cmdline []string = []string{path}
+
+	cmdline = append(cmdline, quoteScriptArgs(args)...)
+
+	return append(cmdline, "; s=$? ; rm -f", path, "; exit $s")
+}
+
+// Return the remote shell command line copying its stdin to a temporary
+// script and running it with the given arguments and an empty stdin, then
+// removing the script and exiting with the exit code of the script.
+//
+func runStreamCmdline(args []string) []string {
+	var cmdline []string
+
+	cmdline = []string{"P=$(mktemp /tmp/.ec2tools-run.XXXXXXXXXX) &&",
+		"cat > \"$P\" && chmod 700 \"$P\" && \"$P\""}
+	cmdline = append(cmdline, quoteScriptArgs(args)...)
+
+	return append(cmdline, "< /dev/null ; s=$? ; rm -f \"$P\" ; exit $s")
+}
+
+// Return the content of the script for each instance of the given selection,
+// formatted for the instance if the '--template' option is set.
+//
+func runScriptInputs(instances *Ec2Selection, script string) []string {
+	var inputs []string = make([]string, len(instances.Instances))
+	var instance *Ec2Instance
+	var i int
+
+	for i, instance = range instances.Instances {
+		if *runParams.OptionTemplate {
+			inputs[i] = Format(script, instance)
+		} else {
+			inputs[i] = script
+		}
+	}
+
+	return inputs
+}
+
+// Run the given remote command lines on the instances with the same index in
+// the given selection with the string of the same index as stdin and wait for
+// them to finish.
+// Return the indices of the instances where the command fails, after
+// printing a warning, about the given action on the script, with the stderr
+// of the command.
+//
+func runScriptStep(instances *Ec2Selection, connector *sshConnector,
+	cmdlines [][]string, inputs []string, action string) []int {
+	var processes []*Process = make([]*Process, len(instances.Instances))
+	var failed []int = make([]int, 0)
+	var instance *Ec2Instance
+	var line string
+	var code, i int
+	var has bool
+
+	for i, instance = range instances.Instances {
+		processes[i] = connector.Builder(instance, cmdlines[i]).Build()
+		processes[i].Start()
+		processes[i].WriteStdin(inputs[i])
+		processes[i].CloseStdin()
+	}
+
+	for i, instance = range instances.Instances {
+		for {
+			_, has = processes[i].ReadStdout()
+			if !has {
+				break
+			}
+		}
+
+		processes[i].WaitFinished()
+
+		code, _ = processes[i].ExitCode()
+		if code == 0 {
+			continue
+		}
+
+		Warning("cannot %s script on instance %s", action,
+			instance.Name)
+
+		for {
+			line, has = processes[i].ReadStderr()
+			if !has {
+				break
+			}
+
+			fmt.Fprintf(os.Stderr, "  %s", line)
+		}
+
+		failed = append(failed, i)
+	}
+
+	return failed
+}
+
+// Upload the given scripts on the instances with the same index in the given
+// selection, at a different remote path for each index.
+// Return the remote paths. Exit with an error, after removing the uploaded
+// scripts, if an upload fails.
+//
+func uploadScripts(instances *Ec2Selection, connector *sshConnector,
+	inputs []string) []string {
+	var paths []string = make([]string, len(instances.Instances))
+	var uploads [][]string = make([][]string, len(instances.Instances))
+	var removes [][]string = make([][]string, len(instances.Instances))
+	var token [8]byte
+	var failed []int
+	var i int
+
+	for i = range instances.Instances {
+		rand.Read(token[:])
+
+		paths[i] = fmt.Sprintf(REMOTE_SCRIPT_PATTERN,
+			hex.EncodeToString(token[:]))
+		uploads[i] = []string{"cat", ">", paths[i], "&&", "chmod",
+			"700", paths[i]}
+		removes[i] = []string{"rm", "-f", paths[i]}
+	}
+
+	failed = runScriptStep(instances, connector, uploads, inputs,
+		"upload")
+	if len(failed) == 0 {
+		return paths
+	}
+
+	runScriptStep(instances, connector, removes,
+		make([]string, len(instances.Instances)), "remove")
+
+	Error("cannot upload script on %d instances", len(failed))
+	return nil
+}
+
+func Run(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var instances *Ec2Selection
+	var connector *sshConnector
+	var cmdlines [][]string
+	var inputs, paths []string
+	var operands, cmdargs []string
+	var instance *Ec2Instance
+	var content []byte
+	var i, j int
+	var err error
+
+	registerSshOptions(flags)
+	runParams.OptionMode = flags.String("mode", DEFAULT_RUN_MODE, "")
+	runParams.OptionTemplate = flags.Bool("template", DEFAULT_RUN_TEMPLATE, "")
+
+	flags.Parse(args[1:])
+	args = flags.Args()
+
+	if len(args) < 1 {
+		Error("missing script operand")
+	}
+
+	processSshOptions()
+
+	if *runParams.OptionMode == "stream" {
+		if (*optionStdin != DEFAULT_STDIN) || (*optionStdinFile != "") {
+			Error("options --stdin and --stdin-file require " +
+				"'--mode upload'")
+		}
+
+		*optionStdin = "none"
+	} else if *runParams.OptionMode != "upload" {
+		Error("invalid mode: '%s'", *runParams.OptionMode)
+	}
+
+	instances, operands = selectSshOperands(args)
+	if len(operands) < 1 {
+		Error("missing script operand")
+	}
+
+	checkStreamFiles(instances, []string{*optionOutmode, *optionErrmode})
+
+	content, err = ioutil.ReadFile(operands[0])
+	if err != nil {
+		Error("cannot read script: %s", err.Error())
+	}
+
+	inputs = runScriptInputs(instances, string(content))
+	cmdlines = make([][]string, len(instances.Instances))
+	connector = newOptionSshConnector()
+
+	if *runParams.OptionMode == "upload" {
+		paths = uploadScripts(instances, connector, inputs)
+		inputs = nil
+	}
+
+	for i, instance = range instances.Instances {
+		cmdargs = make([]string, len(operands)-1)
+		for j = range cmdargs {
+			if *optionFormat {
+				cmdargs[j] = Format(operands[j+1], instance)
+			} else {
+				cmdargs[j] = operands[j+1]
+			}
+		}
+
+		if paths != nil {
+			cmdlines[i] = runScriptCmdline(paths[i], cmdargs)
+		} else {
+			cmdlines[i] = runStreamCmdline(cmdargs)
+		}
+	}
+
+	runSsh(instances, connector, cmdlines, inputs)
+}
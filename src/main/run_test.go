@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRunStreamCmdline(t *testing.T) {
+	var cmdline []string = runStreamCmdline([]string{"a b", "it's"})
+	var process *Process
+	var stdout string
+	var code int
+
+	process = NewProcess([]string{"sh", "-c", strings.Join(cmdline, " ")})
+	process.WriteStdin("#!/bin/sh\nprintf '[%s]' \"$@\" \"$0\" ; echo ; " +
+		"read line && echo read ; exit 3")
+
+	stdout, _, code = readShellCommand(process)
+	if !strings.HasPrefix(stdout, "[a b][it's][/tmp/.ec2tools-run.") ||
+		strings.Contains(stdout, "read") || (code != 3) {
+		t.Fail()
+	}
+
+	process = NewProcess([]string{"sh", "-c", "ls " +
+		strings.TrimPrefix(strings.TrimSuffix(stdout, "]\n"), "[a b][it's][")})
+	_, _, code = readShellCommand(process)
+	if code == 0 {
+		t.Fail()
+	}
+}
+
+func TestRunScriptCmdline(t *testing.T) {
+	var process *Process
+	var file *os.File
+	var stdout string
+	var code int
+	var err error
+
+	file, err = ioutil.TempFile("", "ec2tools-test-run.")
+	if err != nil {
+		t.FailNow()
+	}
+
+	file.WriteString("#!/bin/sh\nprintf '[%s]' \"$@\" ; echo ; exit 4\n")
+	file.Chmod(0700)
+	file.Close()
+
+	process = NewProcess([]string{"sh", "-c", strings.Join(
+		runScriptCmdline(file.Name(), []string{"a b", "$HOME"}), " ")})
+
+	stdout, _, code = readShellCommand(process)
+	if (stdout != "[a b][$HOME]\n") || (code != 4) {
+		t.Fail()
+	}
+
+	_, err = os.Stat(file.Name())
+	if !os.IsNotExist(err) {
+		os.Remove(file.Name())
+		t.Fail()
+	}
+}
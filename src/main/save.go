@@ -9,23 +9,32 @@ import (
 type saveParameters struct {
 	OptionContext     *string
 	OptionDescription *string
+	OptionDryRun      *bool
 	OptionNoWait      *bool
+	OptionOwner       *string
 	OptionRegion      *string
 	OptionReplace     *bool
+	OptionTag         *StringListOption
 	OptionVerbose     *bool
+	OptionYes         *bool
 }
 
 var DEFAULT_SAVE_CONTEXT string = DEFAULT_CONTEXT
 var DEFAULT_SAVE_DESCRIPTION string = "generated by ec2tools"
+var DEFAULT_SAVE_DRY_RUN bool = false
 var DEFAULT_SAVE_NOWAIT bool = false
+var DEFAULT_SAVE_OWNER string = DEFAULT_OWNER
 var DEFAULT_SAVE_REGION string = ""
 var DEFAULT_SAVE_REPLACE bool = false
 var DEFAULT_SAVE_VERBOSE bool = false
+var DEFAULT_SAVE_YES bool = false
 
 var saveParams saveParameters
 
 var saveProcOptionRegion []string
 
+var saveProcOptionTag map[string]string
+
 func PrintSaveUsage() {
 	fmt.Printf(`Usage: %s save [options] [<intance-spec> --] <name>
 
@@ -41,21 +50,40 @@ Options:
 
   --description <text>        optional description of the snapshot
 
+  --dry-run                   print the images which would be created, copied
+                              or replaced and check the permissions without
+                              modifying anything
+
   --no-wait                   return as soon as possible instead of waiting
                               for the snapshot to be available
 
+  --owner <name>              owner of the snapshot, written in the EC2 tags
+                              of the snapshot (default: '%s')
+
   --region <region-name>      make the snapshot available for the specified
                               region (by default, the snapshot is available
                               only in the saved instance region), accept
                               multiple region names separated by commas or '*'
 
   --replace                   if an image with the same name already exists,
-                              then replace it
+                              then replace it, asking for a confirmation when
+                              the standard input is a terminal
+
+  --tag <key>=<value>         add an EC2 tag to the snapshot, can be specified
+                              several times
 
   --verbose                   print what is happening during the save
 
+  --yes                       do not ask for a confirmation before to replace
+                              existing images
+
+The snapshot is tagged on EC2 with its name, the saved instance and fleet, the
+owner and the absolute path of the context file, in addition to the tags
+specified with '--tag'. The copies of the snapshot in other regions receive
+the same tags.
+
 `,
-		PROGNAME, DEFAULT_CONTEXT)
+		PROGNAME, DEFAULT_CONTEXT, DEFAULT_SAVE_OWNER)
 }
 
 func savePrint(format string, a ...interface{}) {
@@ -160,7 +188,96 @@ func doSpread(image *Image, ilist *ImageList) {
 	}
 }
 
+// Return the EC2 tags to apply to the image with the given name saved from the
+// given instance.
+//
+func buildSaveTags(instance *Ec2Instance, name string) map[string]string {
+	var tags map[string]string
+	var key, value string
+
+	tags = NewContextTags(*saveParams.OptionContext,
+		*saveParams.OptionOwner)
+	tags[TAG_NAME] = name
+	tags[TAG_FLEET] = instance.Fleet.Name
+	tags[TAG_INSTANCE] = instance.Name
+
+	for key, value = range saveProcOptionTag {
+		tags[key] = value
+	}
+
+	return tags
+}
+
+// Fetch the images with the given name in the destination regions.
+//
+func fetchSaveDuplicates(name string) *ImageList {
+	var ilist *ImageList = NewImageList()
+	var err error
+
+	err = ilist.Fetch(name, saveProcOptionRegion...)
+	if err != nil {
+		Error("cannot fetch images: %s", err.Error())
+	}
+
+	return ilist
+}
+
+// Ask for a confirmation before to replace the images with the given name in
+// the destination regions, if any.
+//
+func confirmSaveReplace(name string) {
+	var regions []string = make([]string, 0)
+	var image *Image
+
+	for _, image = range sortedImages(fetchSaveDuplicates(name)) {
+		regions = append(regions, image.Region)
+	}
+
+	if len(regions) > 0 {
+		ConfirmOrExit(*saveParams.OptionYes, "replace image '%s' in "+
+			"regions %s?", name, strings.Join(regions, ", "))
+	}
+}
+
+// Print the images which would be created, copied and replaced by saving the
+// given instance with the given name, then check the permissions to create
+// the image without modifying anything.
+//
+func dryRunSave(instance *Ec2Instance, name string) {
+	var tags map[string]string = buildSaveTags(instance, name)
+	var image *Image
+	var region string
+	var err error
+
+	for _, image = range sortedImages(fetchSaveDuplicates(name)) {
+		if !*saveParams.OptionReplace {
+			Error("image '%s' already exists in region %s", name,
+				image.Region)
+		}
+
+		DryRunPrint("deregister image '%s' (%s) in region %s",
+			image.Name, image.Id, image.Region)
+	}
+
+	DryRunPrint("create image '%s' from instance %s in region %s", name,
+		instance.Name, instance.Fleet.Region)
+
+	for _, region = range saveProcOptionRegion {
+		if region != instance.Fleet.Region {
+			DryRunPrint("copy image '%s' to region %s", name,
+				region)
+		}
+	}
+
+	err = CheckCreateImage(instance, name,
+		*saveParams.OptionDescription, tags)
+	if err != nil {
+		Error("cannot create image: %s", err.Error())
+	}
+}
+
 func doSave(instance *Ec2Instance, name string) {
+	var tags map[string]string = buildSaveTags(instance, name)
 	var proceedReplace bool
 	var description string
 	var ilist *ImageList
@@ -170,7 +287,7 @@ func doSave(instance *Ec2Instance, name string) {
 	savePrint("create image from %s with name '%s' on region %s",
 		instance.Name, name, instance.Fleet.Region)
 	description = *saveParams.OptionDescription
-	image, err = CreateImage(instance, name, description)
+	image, err = CreateImage(instance, name, description, tags)
 	if err != nil {
 		switch err.(type) {
 		case *ImageDuplicateError:
@@ -209,7 +326,7 @@ func doSave(instance *Ec2Instance, name string) {
 
 		savePrint("create image from %s with name '%s' on region %s",
 			instance.Name, name, instance.Fleet.Region)
-		image, err = CreateImage(instance, name, description)
+		image, err = CreateImage(instance, name, description, tags)
 		if err != nil {
 			Error("cannot create image: %s", err.Error())
 		}
@@ -248,6 +365,17 @@ func processSaveOptionRegion(sourceRegion string) {
 	}
 }
 
+func processSaveOptionTag() {
+	var err error
+
+	saveProcOptionTag = make(map[string]string)
+
+	err = ParseTagSpecs(saveProcOptionTag, saveParams.OptionTag.Values)
+	if err != nil {
+		Error("invalid value for option --tag: %s", err.Error())
+	}
+}
+
 func Save(args []string) {
 	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
 	var instances *Ec2Selection
@@ -260,14 +388,21 @@ func Save(args []string) {
 
 	saveParams.OptionContext = flags.String("context", DEFAULT_SAVE_CONTEXT, "")
 	saveParams.OptionDescription = flags.String("description", DEFAULT_SAVE_DESCRIPTION, "")
+	saveParams.OptionDryRun = flags.Bool("dry-run", DEFAULT_SAVE_DRY_RUN, "")
 	saveParams.OptionNoWait = flags.Bool("no-wait", DEFAULT_SAVE_NOWAIT, "")
+	saveParams.OptionOwner = flags.String("owner", DEFAULT_SAVE_OWNER, "")
 	saveParams.OptionRegion = flags.String("region", DEFAULT_SAVE_REGION, "")
 	saveParams.OptionReplace = flags.Bool("replace", DEFAULT_SAVE_REPLACE, "")
+	saveParams.OptionTag = NewStringListOption()
+	flags.Var(saveParams.OptionTag, "tag", "")
 	saveParams.OptionVerbose = flags.Bool("verbose", DEFAULT_SAVE_VERBOSE, "")
+	saveParams.OptionYes = flags.Bool("yes", DEFAULT_SAVE_YES, "")
 
 	flags.Parse(args[1:])
 	args = flags.Args()
 
+	processSaveOptionTag()
+
 	if len(args) < 1 {
 		Error("missing name operand")
 	} else if len(args) == 1 {
@@ -319,5 +454,14 @@ func Save(args []string) {
 			instances.Instances[0].Fleet.Region)
 	}
 
+	if *saveParams.OptionDryRun {
+		dryRunSave(instances.Instances[0], name)
+		return
+	}
+
+	if *saveParams.OptionReplace {
+		confirmSaveReplace(name)
+	}
+
 	doSave(instances.Instances[0], name)
 }
@@ -26,6 +26,16 @@ If the last path starts with a ':', this is a remote path. Send all the local
 paths to this remote path. If there are more than one local path, the remote
 path must be an existing remote directory.
 
+With the --relay option, upload the files to one instance per group, then let
+the instances copy them among themselves, over their private IPs within a
+region: at each round, every instance holding the files sends them to another
+one, so the number of rounds grows with the logarithm of the number of
+instances. The local ssh agent is forwarded to the instances for these copies
+and the host key of each receiving instance is checked against the keys
+recorded in the context, as '%s ssh' does.
+The remote path must be an existing remote directory and the files are checked
+against their local sha256 checksums on every instance.
+
 In receive mode, copy one or more remote files or directories to the paths
 specified by the local pattern.
 If there is more than one remote path, they must all start with a ':'
@@ -36,6 +46,8 @@ The pattern must produce different strings for each instance.
 
 If no instance is specified, apply to all instances.
 
+The host keys of the instances are checked as for '%s ssh'.
+
 Return zero if all copies success. Otherwise, return a non zero exit status and
 print failing instances errors.
 
@@ -45,22 +57,106 @@ Options:
 
   --context <path>            path of the context file (default: '%s')
 
+  --control-persist <time>    keep the ssh connections open in background for
+                              <time> after the last copy to reuse them, or
+                              'none' to disable (default: '%s')
+
+  --delete                    with --rsync, delete the files of the target
+                              directories which are not in the sources
+
+  --exclude <pattern>         with --rsync, do not copy the files matching the
+                              rsync pattern, unless an earlier --include
+                              matches them (can be repeated)
+
+  --include <pattern>         with --rsync, copy the files matching the rsync
+                              pattern even if a later --exclude matches them
+                              (can be repeated)
+
+  --native-concurrency <n>    establish at most <n> connections at the same
+                              time with the native transport, the copies
+                              are not limited once connected (default: %d)
+
+  --relay <mode>              in send mode, upload the files once per
+                              'region' or once for all instances ('global')
+                              then relay them between instances, or 'none'
+                              to upload them to each instance (default: '%s')
+
+  --rsync                     copy with 'rsync' instead of 'scp', only
+                              transferring the differences with the target
+                              files, as 'rsync -az' does
+
+  --transport <name>          copy with 'openssh' (external scp command) or
+                              'native' (built-in client sharing one connection
+                              per instance) (default: '%s')
+
   --user <user-name>          user to ssh connect to instances (default: contextual)
 
   --verbose                   print scp debug output in case of failure
 `,
-		PROGNAME, PROGNAME, PROGNAME,
-		DEFAULT_CONTEXT)
+		PROGNAME, PROGNAME, PROGNAME, PROGNAME, PROGNAME,
+		DEFAULT_CONTEXT, DEFAULT_CONTROL_PERSIST,
+		DEFAULT_NATIVE_CONCURRENCY, DEFAULT_RELAY, DEFAULT_TRANSPORT)
 }
 
 // - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 // Generalistic scp code
 // - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 
+var DEFAULT_RSYNC bool = false
+var DEFAULT_DELETE bool = false
+var DEFAULT_RELAY string = RELAY_NONE
+
+var optionRsync *bool
+var optionDelete *bool
+var optionRelay *string
+
+// The '--include' and '--exclude' options, as rsync options in command line
+// order since the first matching pattern applies.
+//
+var optionRsyncFilters *StringListOption
+
+// A command line option appending its values, prefixed with a given string, to
+// a StringListOption shared with other options.
+// Implements the flag.Value interface.
+//
+type prefixedListOption struct {
+	Prefix string            // prefix of the values of this option
+	List   *StringListOption // list shared with other options
+}
+
+// The implementation of flag.Value.String() for prefixedListOption.
+//
+func (this *prefixedListOption) String() string {
+	if this.List == nil {
+		return ""
+	}
+
+	return this.List.String()
+}
+
+// The implementation of flag.Value.Set() for prefixedListOption.
+//
+func (this *prefixedListOption) Set(value string) error {
+	return this.List.Set(this.Prefix + value)
+}
+
+// The native transport used when '--transport native' is specified.
+//
+var scpTransport *NativeSshTransport
+
+// The connection multiplexing used unless '--control-persist none' is
+// specified.
+//
+var scpControl *SshControl
+
+// The host keys of the context instances.
+//
+var scpKnownHosts *KnownHosts
+
 // Return the scp command line as a string slice with the specified source and
-// target operands (see man scp).
+// target operands (see man scp) to copy from or to the given instance.
 //
-func buildScpCmdline(operands []string) []string {
+func buildScpCmdline(instance *Ec2Instance, operands []string) []string {
 	var cmdline []string
 
 	if *optionCommand == "" {
@@ -70,12 +166,61 @@ func buildScpCmdline(operands []string) []string {
 	}
 
 	if cmdline[0] == "scp" {
-		cmdline = append(cmdline, "-o", "StrictHostKeyChecking=no")
-		cmdline = append(cmdline, "-o", "LogLevel=Quiet")
-		cmdline = append(cmdline, "-o", "UserKnownHostsFile=/dev/null")
+		cmdline = append(cmdline,
+			scpKnownHosts.Options(instance.Name)...)
+		cmdline = append(cmdline, "-o", "LogLevel=Error")
 		cmdline = append(cmdline, "-r")
+
+		if scpControl != nil {
+			cmdline = append(cmdline, scpControl.Options(
+				instance.Name, !*optionVerbose)...)
+		}
+	}
+
+	if *optionVerbose {
+		cmdline = append(cmdline, "-v")
+	}
+
+	cmdline = append(cmdline, operands...)
+
+	return cmdline
+}
+
+// Return the rsync command line as a string slice with the specified source
+// and target operands to copy from or to the given instance.
+// The remote shell of rsync is ssh with the same options as for scp.
+//
+func buildRsyncCmdline(instance *Ec2Instance, operands []string) []string {
+	var sshcmd, cmdline []string
+	var word string
+	var words []string
+
+	if *optionCommand == "" {
+		cmdline = append(cmdline, "rsync")
+	} else {
+		cmdline = strings.Split(*optionCommand, " ")
+	}
+
+	sshcmd = append([]string{"ssh"}, scpKnownHosts.Options(instance.Name)...)
+	sshcmd = append(sshcmd, "-o", "LogLevel=Error")
+
+	if scpControl != nil {
+		sshcmd = append(sshcmd,
+			scpControl.Options(instance.Name, !*optionVerbose)...)
 	}
 
+	for _, word = range sshcmd {
+		words = append(words, ShellQuote(word))
+	}
+
+	cmdline = append(cmdline, "-az", "-e", strings.Join(words, " "))
+
+	if *optionDelete {
+		cmdline = append(cmdline, "--delete")
+	}
+
+	cmdline = append(cmdline, optionRsyncFilters.Values...)
+
 	if *optionVerbose {
 		cmdline = append(cmdline, "-v")
 	}
@@ -183,7 +328,18 @@ func buildScpReceive(instance *Ec2Instance, sources []string, target string) *Pr
 		operands = append(operands, remote+":"+source)
 	}
 	operands = append(operands, target)
-	cmdline = buildScpCmdline(operands)
+
+	if scpTransport != nil {
+		scpTransport.SetHostKeyAlias(instance.PublicIp, instance.Name)
+		return NewProcessCommand(scpTransport.ScpReceive(user,
+			instance.PublicIp, sources, target, 0, *optionVerbose))
+	}
+
+	if *optionRsync {
+		cmdline = buildRsyncCmdline(instance, operands)
+	} else {
+		cmdline = buildScpCmdline(instance, operands)
+	}
 
 	return NewProcess(cmdline)
 }
@@ -281,9 +437,20 @@ func buildScpSend(instance *Ec2Instance, sources []string, target string) *Proce
 		user = instance.Fleet.User
 	}
 
+	if scpTransport != nil {
+		scpTransport.SetHostKeyAlias(instance.PublicIp, instance.Name)
+		return NewProcessCommand(scpTransport.ScpSend(user,
+			instance.PublicIp, sources, target, 0, *optionVerbose))
+	}
+
 	remote = user + "@" + instance.PublicIp
 	operands = append(sources, remote+":"+target)
-	cmdline = buildScpCmdline(operands)
+
+	if *optionRsync {
+		cmdline = buildRsyncCmdline(instance, operands)
+	} else {
+		cmdline = buildScpCmdline(instance, operands)
+	}
 
 	return NewProcess(cmdline)
 }
@@ -343,6 +510,10 @@ func scpSend(instances *Ec2Selection, paths []string) {
 		}
 	}
 
+	if *optionRelay != RELAY_NONE {
+		scpDoRelay(instances, sources, target, *optionRelay)
+	}
+
 	scpDoSend(instances, sources, target)
 }
 
@@ -361,9 +532,21 @@ func Scp(args []string) {
 
 	optionCommand = flags.String("command", "", "")
 	optionContext = flags.String("context", DEFAULT_CONTEXT, "")
+	optionControlPersist = flags.String("control-persist", DEFAULT_CONTROL_PERSIST, "")
+	optionDelete = flags.Bool("delete", DEFAULT_DELETE, "")
+	optionNativeConcurrency = flags.Int("native-concurrency", DEFAULT_NATIVE_CONCURRENCY, "")
+	optionRelay = flags.String("relay", DEFAULT_RELAY, "")
+	optionRsync = flags.Bool("rsync", DEFAULT_RSYNC, "")
+	optionTransport = flags.String("transport", DEFAULT_TRANSPORT, "")
 	optionUser = flags.String("user", "", "")
 	optionVerbose = flags.Bool("verbose", DEFAULT_VERBOSE, "")
 
+	optionRsyncFilters = NewStringListOption()
+	flags.Var(&prefixedListOption{"--exclude=", optionRsyncFilters},
+		"exclude", "")
+	flags.Var(&prefixedListOption{"--include=", optionRsyncFilters},
+		"include", "")
+
 	flags.Parse(args[1:])
 	args = flags.Args()
 
@@ -371,6 +554,31 @@ func Scp(args []string) {
 		Error("missing first path operand")
 	}
 
+	if !IsTransport(*optionTransport) {
+		Error("invalid transport: '%s'", *optionTransport)
+	} else if (*optionTransport == TRANSPORT_NATIVE) &&
+		(*optionCommand != "") {
+		Error("cannot use a custom command with the native transport")
+	}
+
+	if *optionRsync && (*optionTransport == TRANSPORT_NATIVE) {
+		Error("cannot use option --rsync with the native transport")
+	} else if !*optionRsync && *optionDelete {
+		Error("option --delete requires option --rsync")
+	} else if !*optionRsync && (len(optionRsyncFilters.Values) > 0) {
+		Error("options --include and --exclude require option --rsync")
+	}
+
+	if (*optionRelay != RELAY_NONE) && (*optionRelay != RELAY_REGION) &&
+		(*optionRelay != RELAY_GLOBAL) {
+		Error("invalid relay mode: '%s'", *optionRelay)
+	} else if (*optionRelay != RELAY_NONE) && *optionRsync {
+		Error("cannot use option --relay with option --rsync")
+	} else if (*optionRelay != RELAY_NONE) &&
+		(*optionTransport == TRANSPORT_NATIVE) {
+		Error("cannot use option --relay with the native transport")
+	}
+
 	hasSpecs = false
 	for _, arg = range args {
 		if (arg == "--") && !hasSpecs {
@@ -398,6 +606,14 @@ func Scp(args []string) {
 		Error("no context: %s", *optionContext)
 	}
 
+	scpKnownHosts = NewKnownHosts(*optionContext)
+	scpControl = OpenSshControl(*optionContext, *optionControlPersist)
+
+	if *optionTransport == TRANSPORT_NATIVE {
+		scpTransport = OpenNativeSshTransport(scpKnownHosts,
+			*optionNativeConcurrency)
+	}
+
 	if !hasSpecs {
 		instances, _ = ctx.Select([]string{"//"})
 	} else {
@@ -408,6 +624,10 @@ func Scp(args []string) {
 	}
 
 	if paths[0][0] == ':' {
+		if *optionRelay != RELAY_NONE {
+			Error("cannot use option --relay in receive mode")
+		}
+
 		scpReceive(instances, paths)
 	} else {
 		scpSend(instances, paths)
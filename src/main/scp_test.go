@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildRsyncCmdline(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet", User: "ec2-user"}
+	var instance Ec2Instance = Ec2Instance{Name: "i-0", Fleet: &fleet,
+		PublicIp: "10.0.0.1"}
+	var command string = ""
+	var verbose, deleteFiles bool = false, true
+	var cmdline []string
+	var joined string
+
+	optionCommand = &command
+	optionVerbose = &verbose
+	optionDelete = &deleteFiles
+	optionRsyncFilters = NewStringListOption()
+	optionRsyncFilters.Set("--include=*.go")
+	optionRsyncFilters.Set("--exclude=*")
+	scpKnownHosts = NewKnownHosts("/ctx")
+	scpControl = nil
+
+	cmdline = buildRsyncCmdline(&instance, []string{"src",
+		"ec2-user@10.0.0.1:dst"})
+
+	if (len(cmdline) != 9) || (cmdline[0] != "rsync") ||
+		(cmdline[1] != "-az") || (cmdline[2] != "-e") ||
+		(cmdline[4] != "--delete") || (cmdline[5] != "--include=*.go") ||
+		(cmdline[6] != "--exclude=*") || (cmdline[7] != "src") ||
+		(cmdline[8] != "ec2-user@10.0.0.1:dst") {
+		t.FailNow()
+	}
+
+	joined = cmdline[3]
+	if !strings.HasPrefix(joined, "'ssh' ") ||
+		!strings.Contains(joined, "'HostKeyAlias=i-0'") ||
+		!strings.Contains(joined, "'UserKnownHostsFile=/ctx"+
+			KNOWN_HOSTS_SUFFIX+"'") {
+		t.Fail()
+	}
+}
+
+func TestBuildSha256Manifest(t *testing.T) {
+	var dir, other, manifest string
+	var process *Process
+	var code int
+	var err error
+
+	dir, err = ioutil.TempDir("", "ec2tools-test-relay.")
+	if err != nil {
+		t.FailNow()
+	}
+
+	defer os.RemoveAll(dir)
+
+	other = filepath.Join(dir, "other")
+	os.MkdirAll(filepath.Join(dir, "data", "sub"), 0755)
+	os.MkdirAll(other, 0755)
+	ioutil.WriteFile(filepath.Join(dir, "data", "a"), []byte("a\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "data", "sub", "b"), []byte("b"), 0644)
+	ioutil.WriteFile(filepath.Join(other, "c"), []byte("c\n"), 0644)
+
+	manifest, err = buildSha256Manifest([]string{
+		filepath.Join(dir, "data") + "/", filepath.Join(other, "c")})
+	if err != nil {
+		t.FailNow()
+	}
+
+	if (strings.Count(manifest, "\n") != 3) ||
+		!strings.Contains(manifest, "  data/a\n") ||
+		!strings.Contains(manifest, "  data/sub/b\n") ||
+		!strings.Contains(manifest, "  c\n") {
+		t.FailNow()
+	}
+
+	os.Rename(filepath.Join(other, "c"), filepath.Join(dir, "c"))
+
+	process = NewProcess([]string{"sh", "-c", "cd " + ShellQuote(dir) +
+		" && sha256sum --quiet -c -"})
+	process.WriteStdin(manifest)
+	_, _, code = readShellCommand(process)
+	if code != 0 {
+		t.Fail()
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "data", "a"), []byte("A\n"), 0644)
+
+	process = NewProcess([]string{"sh", "-c", "cd " + ShellQuote(dir) +
+		" && sha256sum --quiet -c -"})
+	process.WriteStdin(manifest)
+	_, _, code = readShellCommand(process)
+	if code == 0 {
+		t.Fail()
+	}
+}
+
+func TestRelayGroups(t *testing.T) {
+	var east Ec2Fleet = Ec2Fleet{Name: "east", Region: "us-east-1"}
+	var west Ec2Fleet = Ec2Fleet{Name: "west", Region: "us-west-2"}
+	var instances []*Ec2Instance = []*Ec2Instance{
+		&Ec2Instance{Name: "i-0", Fleet: &west},
+		&Ec2Instance{Name: "i-1", Fleet: &east},
+		&Ec2Instance{Name: "i-2", Fleet: &west},
+	}
+	var groups [][]*Ec2Instance
+
+	groups = relayGroups(instances, RELAY_REGION)
+	if (len(groups) != 2) || (len(groups[0]) != 2) ||
+		(groups[0][0] != instances[0]) ||
+		(groups[0][1] != instances[2]) || (len(groups[1]) != 1) ||
+		(groups[1][0] != instances[1]) {
+		t.Fail()
+	}
+
+	groups = relayGroups(instances, RELAY_GLOBAL)
+	if (len(groups) != 1) || (len(groups[0]) != 3) {
+		t.Fail()
+	}
+}
+
+func TestRelayRound(t *testing.T) {
+	var holders, pending, senders, receivers []*Ec2Instance
+	var rounds, i int
+
+	holders = []*Ec2Instance{&Ec2Instance{Name: "i-0"}}
+	for i = 1; i < 11; i++ {
+		pending = append(pending, &Ec2Instance{})
+	}
+
+	for len(pending) > 0 {
+		senders, receivers = relayRound(holders, pending)
+		if (len(senders) != len(receivers)) || (len(senders) == 0) {
+			t.FailNow()
+		}
+
+		pending = pending[len(receivers):]
+		holders = append(holders, receivers...)
+		rounds += 1
+	}
+
+	if (rounds != 4) || (len(holders) != 11) {
+		t.Fail()
+	}
+}
+
+func TestRelayCommand(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet", User: "u", Region: "r"}
+	var holder Ec2Instance = Ec2Instance{Name: "i-0", Fleet: &fleet,
+		PublicIp: "0.0.0.0", PrivateIp: "1.0.0.0"}
+	var receiver Ec2Instance = Ec2Instance{Name: "i-1", Fleet: &fleet,
+		PublicIp: "0.0.0.1", PrivateIp: "1.0.0.1"}
+	var relay scpRelay = scpRelay{Names: []string{"data set"},
+		Target: "dir"}
+	var path string = os.Getenv("PATH")
+	var user string = ""
+	var process *Process
+	var content []byte
+	var dir string
+	var code int
+	var err error
+
+	defer func(saved *string) {
+		optionUser = saved
+	}(optionUser)
+
+	optionUser = &user
+
+	dir, err = ioutil.TempDir("", "ec2tools-test")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "dir", "data set"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "ssh"), []byte("#!/bin/sh\n"+
+		"for arg ; do\n"+
+		"    echo \"$arg\" >> args\n"+
+		"    case \"$arg\" in UserKnownHostsFile=*)\n"+
+		"        cp \"${arg#UserKnownHostsFile=}\" ../known\n"+
+		"        echo \"${arg#UserKnownHostsFile=}\" > ../path ;;\n"+
+		"    esac\n"+
+		"done\n"+
+		"mv args ..\n"+
+		"cat > /dev/null\n"+
+		"exit 3\n"), 0755)
+
+	os.Setenv("PATH", dir+":"+path)
+	defer os.Setenv("PATH", path)
+
+	process = NewProcess([]string{"sh", "-c", "cd " + ShellQuote(dir) +
+		" && " + relay.relayCommand(&holder, &receiver)})
+	process.Start()
+	process.WriteStdin("i-1 ssh-ed25519 AAAA\n")
+	process.CloseStdin()
+	process.WaitFinished()
+
+	code, _ = process.ExitCode()
+	if code != 3 {
+		t.Fail()
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "known"))
+	if (err != nil) || (string(content) != "i-1 ssh-ed25519 AAAA\n") {
+		t.Fail()
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "path"))
+	if err != nil {
+		t.FailNow()
+	}
+
+	_, err = os.Stat(strings.TrimSpace(string(content)))
+	if err == nil {
+		t.Fail()
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "args"))
+	if (err != nil) ||
+		!strings.Contains(string(content), "\nStrictHostKeyChecking=yes\n") ||
+		!strings.Contains(string(content), "\nHostKeyAlias=i-1\n") ||
+		!strings.Contains(string(content), "\nu@1.0.0.1\n") {
+		t.Fail()
+	}
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The exit status of a native scp command which fails to copy a file, as the
+// one of the 'scp' command.
+//
+const NATIVE_SCP_FAILURE_STATUS int = 1
+
+// One side of an scp protocol session.
+// The remote side is an 'scp' command in source ('-f') or sink ('-t') mode.
+//
+type scpPeer struct {
+	reader *bufio.Reader  // stream from the remote scp
+	writer io.WriteCloser // stream to the remote scp
+	stderr io.Writer      // where to print the local warnings
+}
+
+// Read an acknowledgment from the remote side.
+// Return nil for a positive acknowledgment or an error with the message sent
+// by the remote side otherwise.
+//
+func (this *scpPeer) readAck() error {
+	var message string
+	var code byte
+	var err error
+
+	code, err = this.reader.ReadByte()
+	if err != nil {
+		return err
+	} else if code == 0 {
+		return nil
+	}
+
+	message, err = this.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	return newNativeCommandError(NATIVE_SCP_FAILURE_STATUS, "%s",
+		strings.TrimRight(message, "\n"))
+}
+
+// Send a positive acknowledgment to the remote side.
+//
+func (this *scpPeer) writeAck() error {
+	var err error
+
+	_, err = this.writer.Write([]byte{0})
+	return err
+}
+
+// Send a protocol line to the remote side and wait for its acknowledgment.
+//
+func (this *scpPeer) writeLine(format string, a ...interface{}) error {
+	var err error
+
+	_, err = fmt.Fprintf(this.writer, format, a...)
+	if err != nil {
+		return err
+	}
+
+	return this.readAck()
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Native scp send mode related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// Send the regular file with the given local path to the remote side.
+//
+func (this *scpPeer) sendFile(path string, info os.FileInfo) error {
+	var file *os.File
+	var err error
+
+	file, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	err = this.writeLine("C%04o %d %s\n", info.Mode().Perm(), info.Size(),
+		info.Name())
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(this.writer, file, info.Size())
+	if err != nil {
+		return err
+	}
+
+	err = this.writeAck()
+	if err != nil {
+		return err
+	}
+
+	return this.readAck()
+}
+
+// Send the directory with the given local path and its content to the remote
+// side.
+//
+func (this *scpPeer) sendDirectory(path string, info os.FileInfo) error {
+	var entries []os.FileInfo
+	var entry os.FileInfo
+	var err error
+
+	entries, err = ioutil.ReadDir(path)
+	if err != nil {
+		return err
+	}
+
+	err = this.writeLine("D%04o 0 %s\n", info.Mode().Perm(), info.Name())
+	if err != nil {
+		return err
+	}
+
+	for _, entry = range entries {
+		err = this.sendPath(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	return this.writeLine("E\n")
+}
+
+// Send the file or directory with the given local path to the remote side.
+// Symbolic links are followed.
+//
+func (this *scpPeer) sendPath(path string) error {
+	var info os.FileInfo
+	var err error
+
+	info, err = os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return this.sendDirectory(path, info)
+	} else if info.Mode().IsRegular() {
+		return this.sendFile(path, info)
+	} else {
+		return fmt.Errorf("%s: not a regular file", path)
+	}
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Native scp receive mode related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// Parse a file or directory protocol line of the form
+// '<C|D><mode> <size> <name>'.
+// Return the mode, the size and the name or an error if the line is ill
+// formed or if the name is not a plain file name.
+//
+func parseScpHeader(line string) (os.FileMode, int64, string, error) {
+	var mode, size uint64
+	var fields []string
+	var err error
+
+	fields = strings.SplitN(strings.TrimRight(line[1:], "\n"), " ", 3)
+	if len(fields) != 3 {
+		return 0, 0, "", fmt.Errorf("protocol error: '%s'", line)
+	}
+
+	mode, err = strconv.ParseUint(fields[0], 8, 32)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("protocol error: '%s'", line)
+	}
+
+	size, err = strconv.ParseUint(fields[1], 10, 63)
+	if err != nil {
+		return 0, 0, "", fmt.Errorf("protocol error: '%s'", line)
+	}
+
+	if (fields[2] == "") || (fields[2] == ".") || (fields[2] == "..") ||
+		strings.Contains(fields[2], "/") {
+		return 0, 0, "", fmt.Errorf("invalid file name: '%s'",
+			fields[2])
+	}
+
+	return os.FileMode(mode).Perm(), int64(size), fields[2], nil
+}
+
+// Receive the content of a regular file of the given size from the remote
+// side and write it at the given local path.
+//
+func (this *scpPeer) receiveFile(path string, mode os.FileMode, size int64) error {
+	var file *os.File
+	var err error
+
+	err = this.writeAck()
+	if err != nil {
+		return err
+	}
+
+	file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		io.CopyN(ioutil.Discard, this.reader, size)
+		this.readAck()
+		return err
+	}
+
+	_, err = io.CopyN(file, this.reader, size)
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = this.readAck()
+	if err != nil {
+		return err
+	}
+
+	return this.writeAck()
+}
+
+// Receive the files and directories sent by the remote side and write them at
+// the given local target.
+// If the target is an existing directory, the received files are written
+// inside. Otherwise, the received file or directory is written at the target
+// path.
+// Return the number of warnings printed on the stderr or an error.
+//
+func (this *scpPeer) receive(target string) (int, error) {
+	var dirs []string = make([]string, 0)
+	var targetIsDir bool
+	var info os.FileInfo
+	var mode os.FileMode
+	var line, name, path string
+	var warnings int
+	var size int64
+	var err error
+
+	info, err = os.Stat(target)
+	targetIsDir = (err == nil) && info.IsDir()
+
+	err = this.writeAck()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		line, err = this.reader.ReadString('\n')
+		if err == io.EOF {
+			return warnings, nil
+		} else if err != nil {
+			return warnings, err
+		}
+
+		switch line[0] {
+		case 1:
+			fmt.Fprintf(this.stderr, "%s", line[1:])
+			warnings += 1
+			continue
+		case 2:
+			return warnings, fmt.Errorf("%s",
+				strings.TrimRight(line[1:], "\n"))
+		case 'T':
+			err = this.writeAck()
+			if err != nil {
+				return warnings, err
+			}
+			continue
+		case 'E':
+			if len(dirs) == 0 {
+				return warnings, fmt.Errorf("protocol error: " +
+					"unexpected end of directory")
+			}
+
+			dirs = dirs[:(len(dirs) - 1)]
+
+			err = this.writeAck()
+			if err != nil {
+				return warnings, err
+			}
+			continue
+		case 'C', 'D':
+		default:
+			return warnings, fmt.Errorf("protocol error: '%s'",
+				strings.TrimRight(line, "\n"))
+		}
+
+		mode, size, name, err = parseScpHeader(line)
+		if err != nil {
+			return warnings, err
+		}
+
+		if len(dirs) > 0 {
+			path = filepath.Join(dirs[len(dirs)-1], name)
+		} else if targetIsDir {
+			path = filepath.Join(target, name)
+		} else {
+			path = target
+		}
+
+		if line[0] == 'D' {
+			err = os.Mkdir(path, mode|0700)
+			if (err != nil) && !os.IsExist(err) {
+				return warnings, err
+			}
+
+			dirs = append(dirs, path)
+
+			err = this.writeAck()
+			if err != nil {
+				return warnings, err
+			}
+			continue
+		}
+
+		err = this.receiveFile(path, mode, size)
+		if err != nil {
+			return warnings, err
+		}
+	}
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Native scp commands related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// Start the remote scp command with the given arguments on the given session
+// and return the corresponding peer.
+//
+func startScpPeer(cmd *nativeCommand, session *ssh.Session, args string) (*scpPeer, error) {
+	var stdout io.Reader
+	var peer scpPeer
+	var err error
+
+	session.Stderr = cmd.stderr
+
+	stdout, err = session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	peer.writer, err = session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	peer.reader = bufio.NewReader(stdout)
+	peer.stderr = cmd.stderr
+
+	err = session.Start("scp " + args)
+	if err != nil {
+		return nil, err
+	}
+
+	return &peer, nil
+}
+
+// Return a Command copying the given local sources to the given target on the
+// given host for the given user, as the 'scp -r' command does.
+// An empty target designates the home directory of the remote user.
+//
+func (this *NativeSshTransport) ScpSend(user, host string, sources []string, target string, timeout int, verbose bool) Command {
+	return newNativeCommand(func(cmd *nativeCommand) error {
+		var session *ssh.Session
+		var args, source string
+		var peer *scpPeer
+		var err error
+
+		session, err = this.openSession(cmd, user, host, timeout,
+			verbose)
+		if err != nil {
+			return err
+		}
+
+		defer session.Close()
+
+		cmd.onKill(func() { session.Close() })
+
+		if target == "" {
+			target = "."
+		}
+
+		if len(sources) > 1 {
+			args = "-r -d -t " + target
+		} else {
+			args = "-r -t " + target
+		}
+
+		peer, err = startScpPeer(cmd, session, args)
+		if err == nil {
+			err = peer.readAck()
+		}
+
+		for _, source = range sources {
+			if err != nil {
+				break
+			}
+
+			err = peer.sendPath(source)
+		}
+
+		if peer != nil {
+			peer.writer.Close()
+		}
+
+		if err != nil {
+			fmt.Fprintf(cmd.stderr, "scp: %s\n", err.Error())
+			session.Wait()
+			return newNativeCommandError(NATIVE_SCP_FAILURE_STATUS,
+				"%s", err.Error())
+		}
+
+		return session.Wait()
+	})
+}
+
+// Return a Command copying the given remote sources from the given host for
+// the given user to the given local target, as the 'scp -r' command does.
+//
+func (this *NativeSshTransport) ScpReceive(user, host string, sources []string, target string, timeout int, verbose bool) Command {
+	return newNativeCommand(func(cmd *nativeCommand) error {
+		var session *ssh.Session
+		var info os.FileInfo
+		var peer *scpPeer
+		var warnings int
+		var err error
+
+		if len(sources) > 1 {
+			info, err = os.Stat(target)
+			if (err != nil) || !info.IsDir() {
+				fmt.Fprintf(cmd.stderr, "scp: %s: not a "+
+					"directory\n", target)
+				return newNativeCommandError(
+					NATIVE_SCP_FAILURE_STATUS,
+					"%s: not a directory", target)
+			}
+		}
+
+		session, err = this.openSession(cmd, user, host, timeout,
+			verbose)
+		if err != nil {
+			return err
+		}
+
+		defer session.Close()
+
+		cmd.onKill(func() { session.Close() })
+
+		peer, err = startScpPeer(cmd, session,
+			"-r -f "+strings.Join(sources, " "))
+		if err == nil {
+			warnings, err = peer.receive(target)
+			peer.writer.Close()
+		}
+
+		if err != nil {
+			fmt.Fprintf(cmd.stderr, "scp: %s\n", err.Error())
+			session.Wait()
+			return newNativeCommandError(NATIVE_SCP_FAILURE_STATUS,
+				"%s", err.Error())
+		}
+
+		err = session.Wait()
+		if (err == nil) && (warnings > 0) {
+			return newNativeCommandError(NATIVE_SCP_FAILURE_STATUS,
+				"%d files not copied", warnings)
+		}
+
+		return err
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseScpHeader(t *testing.T) {
+	var mode os.FileMode
+	var name string
+	var size int64
+	var err error
+
+	mode, size, name, err = parseScpHeader("C0644 12 file.txt\n")
+	if (err != nil) || (mode != 0644) || (size != 12) ||
+		(name != "file.txt") {
+		t.Fail()
+	}
+
+	mode, size, name, err = parseScpHeader("D0755 0 my dir\n")
+	if (err != nil) || (mode != 0755) || (size != 0) ||
+		(name != "my dir") {
+		t.Fail()
+	}
+
+	_, _, _, err = parseScpHeader("C0644 12\n")
+	if err == nil {
+		t.Fail()
+	}
+
+	_, _, _, err = parseScpHeader("C0644 -1 file.txt\n")
+	if err == nil {
+		t.Fail()
+	}
+
+	_, _, _, err = parseScpHeader("C0644 12 ../file.txt\n")
+	if err == nil {
+		t.Fail()
+	}
+
+	_, _, _, err = parseScpHeader("D0755 0 ..\n")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestScpPeerRoundTrip(t *testing.T) {
+	var source, target string
+	var sender, receiver scpPeer
+	var sendReader, recvReader *io.PipeReader
+	var sendWriter, recvWriter *io.PipeWriter
+	var done chan error = make(chan error)
+	var content []byte
+	var err error
+
+	source, err = ioutil.TempDir("", "ec2tools-test")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(source)
+
+	target, err = ioutil.TempDir("", "ec2tools-test")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(target)
+
+	os.Mkdir(filepath.Join(source, "dir"), 0755)
+	os.Mkdir(filepath.Join(source, "dir", "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(source, "dir", "a"), []byte("hello\n"),
+		0644)
+	ioutil.WriteFile(filepath.Join(source, "dir", "sub", "b"), []byte{},
+		0600)
+
+	recvReader, sendWriter = io.Pipe()
+	sendReader, recvWriter = io.Pipe()
+
+	sender.reader = bufio.NewReader(sendReader)
+	sender.writer = sendWriter
+	sender.stderr = ioutil.Discard
+
+	receiver.reader = bufio.NewReader(recvReader)
+	receiver.writer = recvWriter
+	receiver.stderr = ioutil.Discard
+
+	go func() {
+		var err error
+
+		err = sender.readAck()
+		if err == nil {
+			err = sender.sendPath(filepath.Join(source, "dir"))
+		}
+
+		sender.writer.Close()
+		done <- err
+	}()
+
+	_, err = receiver.receive(target)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if <-done != nil {
+		t.FailNow()
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(target, "dir", "a"))
+	if (err != nil) || (string(content) != "hello\n") {
+		t.Fail()
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(target, "dir", "sub",
+		"b"))
+	if (err != nil) || (len(content) != 0) {
+		t.Fail()
+	}
+}
@@ -0,0 +1,489 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The values of the '--relay' option of scp.
+//
+const (
+	RELAY_NONE   string = "none"
+	RELAY_REGION string = "region"
+	RELAY_GLOBAL string = "global"
+)
+
+// The ssh options used by an instance to copy files to another instance.
+// The host key of the receiving instance is checked against the keys recorded
+// in the context, given to the sending instance in a temporary known_hosts
+// file.
+//
+var RELAY_SSH_OPTIONS []string = []string{
+	"-o", "StrictHostKeyChecking=yes", "-o", "LogLevel=Error",
+	"-o", "BatchMode=yes",
+}
+
+// Return the manifest of the given local sources, in the 'sha256sum' format,
+// with the paths relative to the directory containing each source.
+// Symbolic links are followed.
+//
+func buildSha256Manifest(sources []string) (string, error) {
+	var lines []string = make([]string, 0)
+	var source string
+	var err error
+
+	for _, source = range sources {
+		err = appendSha256Manifest(filepath.Clean(source),
+			filepath.Base(filepath.Clean(source)), &lines)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	sort.Strings(lines)
+
+	return strings.Join(lines, ""), nil
+}
+
+// Append the manifest lines of the given local path, with the given relative
+// name, to the given lines.
+//
+func appendSha256Manifest(path, name string, lines *[]string) error {
+	var entries []os.FileInfo
+	var entry os.FileInfo
+	var hash = sha256.New()
+	var info os.FileInfo
+	var file *os.File
+	var err error
+
+	info, err = os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		entries, err = ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+
+		for _, entry = range entries {
+			err = appendSha256Manifest(
+				filepath.Join(path, entry.Name()),
+				filepath.Join(name, entry.Name()), lines)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s: not a regular file", path)
+	}
+
+	file, err = os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+
+	*lines = append(*lines, fmt.Sprintf("%s  %s\n",
+		hex.EncodeToString(hash.Sum(nil)), name))
+
+	return nil
+}
+
+// Split the given instances in the groups distributing the files among
+// themselves for the given relay mode.
+// The groups are in the order of their first instance.
+//
+func relayGroups(instances []*Ec2Instance, mode string) [][]*Ec2Instance {
+	var groups [][]*Ec2Instance = make([][]*Ec2Instance, 0)
+	var indices map[string]int = make(map[string]int)
+	var instance *Ec2Instance
+	var key string
+	var index int
+	var found bool
+
+	for _, instance = range instances {
+		if mode == RELAY_REGION {
+			key = instance.Fleet.Region
+		}
+
+		index, found = indices[key]
+		if !found {
+			index = len(groups)
+			indices[key] = index
+			groups = append(groups, make([]*Ec2Instance, 0))
+		}
+
+		groups[index] = append(groups[index], instance)
+	}
+
+	return groups
+}
+
+// Return the pairs of instances copying the files in the next relay round,
+// as two slices of the same length, the holders and the receivers, given the
+// instances holding the files and the ones waiting for them.
+// Each holder sends the files to at most one receiver per round, so the
+// number of holders doubles each round.
+//
+func relayRound(holders, pending []*Ec2Instance) ([]*Ec2Instance, []*Ec2Instance) {
+	var n int = len(holders)
+
+	if len(pending) < n {
+		n = len(pending)
+	}
+
+	return holders[:n], pending[:n]
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// The distribution of local files to instances through a single upload per
+// group of instances, then copies between instances.
+//
+type scpRelay struct {
+	Sources   []string      // local paths to send
+	Names     []string      // base names of the sources
+	Target    string        // remote directory, '.' for the home directory
+	Manifest  string        // checksums of the sources files
+	connector *sshConnector // connection settings
+	failures  int           // number of instances which failed
+	lock      sync.Mutex
+}
+
+// Build the ssh Process running the given shell command on the given
+// instance, with the given additional ssh options.
+//
+func (this *scpRelay) build(instance *Ec2Instance, options []string, command string) *Process {
+	return this.connector.BuilderOptions(instance, options,
+		[]string{command}).Build()
+}
+
+// Run the given process for the given instance with the given stdin.
+// Return true if it succeeds, otherwise print its stderr with the given
+// description of the step and return false.
+//
+func (this *scpRelay) run(instance *Ec2Instance, process *Process, input, step string) bool {
+	var lines []string = make([]string, 0)
+	var line string
+	var code int
+	var has bool
+
+	process.Start()
+	process.WriteStdin(input)
+	process.CloseStdin()
+
+	for {
+		_, has = process.ReadStdout()
+		if !has {
+			break
+		}
+	}
+
+	for {
+		line, has = process.ReadStderr()
+		if !has {
+			break
+		}
+
+		lines = append(lines, line)
+	}
+
+	process.WaitFinished()
+
+	code, _ = process.ExitCode()
+	if code == 0 {
+		return true
+	}
+
+	this.fail(instance, step, lines)
+
+	return false
+}
+
+// Record the failure of the given instance and print the given description
+// of the failed step with the given error lines.
+//
+func (this *scpRelay) fail(instance *Ec2Instance, step string, lines []string) {
+	var line string
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.failures += 1
+
+	fmt.Fprintf(os.Stderr, "instance %s failed to %s:\n", instance.Name,
+		step)
+
+	for _, line = range lines {
+		fmt.Fprintf(os.Stderr, "  %s", line)
+	}
+}
+
+// Return the known_hosts lines of the given instance as recorded in the
+// context, connecting to it first if it is not known yet so its key is
+// trusted on first use as for any other connection.
+// Return false if the instance cannot be reached or has no recorded key.
+//
+func (this *scpRelay) knownHosts(instance *Ec2Instance) (string, bool) {
+	var keys []ssh.PublicKey
+	var key ssh.PublicKey
+	var lines string
+	var err error
+
+	keys, err = this.connector.knownHosts.Keys(instance.Name)
+
+	if (err == nil) && (len(keys) == 0) {
+		if !this.run(instance, this.build(instance, []string{}, "true"),
+			"", "check its host key") {
+			return "", false
+		}
+
+		keys, err = this.connector.knownHosts.Keys(instance.Name)
+	}
+
+	if err != nil {
+		this.fail(instance, "read its host key", []string{err.Error() +
+			"\n"})
+		return "", false
+	} else if len(keys) == 0 {
+		this.fail(instance, "record its host key", []string{})
+		return "", false
+	}
+
+	for _, key = range keys {
+		lines += formatKnownHost(instance.Name, key)
+	}
+
+	return lines, true
+}
+
+// Verify the files received by the given instance against the manifest.
+// Return true if they match.
+//
+func (this *scpRelay) verify(instance *Ec2Instance) bool {
+	var process *Process
+
+	process = this.build(instance, []string{}, "cd "+
+		ShellQuote(this.Target)+" && sha256sum --quiet -c -")
+
+	return this.run(instance, process, this.Manifest, "verify the files")
+}
+
+// Upload the files from the local host to the given instance then verify
+// them.
+// Return true if it succeeds.
+//
+func (this *scpRelay) upload(instance *Ec2Instance) bool {
+	var process *Process
+
+	process = buildScpSend(instance, this.Sources, this.Target)
+
+	if !this.run(instance, process, "", "receive the files") {
+		return false
+	}
+
+	return this.verify(instance)
+}
+
+// Return the shell command making the given holder instance copy the files
+// to the given receiver instance, over its private IP if they are in the same
+// region.
+// The command reads the known_hosts lines of the receiver on its stdin and
+// checks the host key of the receiver against them.
+//
+func (this *scpRelay) relayCommand(holder, receiver *Ec2Instance) string {
+	var user, host, command, name string
+	var names []string
+
+	if *optionUser != "" {
+		user = *optionUser
+	} else {
+		user = receiver.Fleet.User
+	}
+
+	if (holder.Fleet.Region == receiver.Fleet.Region) &&
+		(receiver.PrivateIp != "") {
+		host = receiver.PrivateIp
+	} else {
+		host = receiver.PublicIp
+	}
+
+	for _, name = range this.Names {
+		names = append(names, ShellQuote(name))
+	}
+
+	command = "known=$(mktemp) || exit 1 ; cat > \"$known\" ; cd " +
+		ShellQuote(this.Target) + " && tar cf - " +
+		strings.Join(names, " ") + " | ssh"
+
+	for _, name = range RELAY_SSH_OPTIONS {
+		command += " " + ShellQuote(name)
+	}
+
+	command += " -o \"UserKnownHostsFile=$known\" -o " +
+		ShellQuote("HostKeyAlias="+receiver.Name) + " " +
+		ShellQuote(user+"@"+host) + " " +
+		ShellQuote("cd "+ShellQuote(this.Target)+" && tar xf -") +
+		" ; status=$? ; rm -f \"$known\" ; exit $status"
+
+	return command
+}
+
+// Copy the files from the given holder instance to the given receiver
+// instance then verify them.
+// The holder connects to the receiver with the forwarded ssh agent and checks
+// its host key against the keys recorded in the context.
+// Return true if it succeeds.
+//
+func (this *scpRelay) relay(holder, receiver *Ec2Instance) bool {
+	var process *Process
+	var known string
+	var ok bool
+
+	known, ok = this.knownHosts(receiver)
+	if !ok {
+		return false
+	}
+
+	process = this.build(holder, []string{"-A"},
+		this.relayCommand(holder, receiver))
+
+	if !this.run(receiver, process, known, "receive the files from "+
+		holder.Name) {
+		return false
+	}
+
+	return this.verify(receiver)
+}
+
+// Distribute the files to the given group of instances.
+// The files are uploaded to the first instance which accepts them, then each
+// round, each instance holding the files sends them to one more instance.
+//
+func (this *scpRelay) distribute(group []*Ec2Instance) {
+	var holders, senders, receivers []*Ec2Instance
+	var succeeded []bool
+	var wg sync.WaitGroup
+	var i int
+
+	for len(group) > 0 {
+		if this.upload(group[0]) {
+			holders = append(holders, group[0])
+			group = group[1:]
+			break
+		}
+
+		group = group[1:]
+	}
+
+	for (len(group) > 0) && (len(holders) > 0) {
+		senders, receivers = relayRound(holders, group)
+		group = group[len(receivers):]
+		succeeded = make([]bool, len(receivers))
+
+		for i = range receivers {
+			wg.Add(1)
+			go func(i int) {
+				succeeded[i] = this.relay(senders[i],
+					receivers[i])
+				wg.Done()
+			}(i)
+		}
+
+		wg.Wait()
+
+		for i = range receivers {
+			if succeeded[i] {
+				holders = append(holders, receivers[i])
+			}
+		}
+	}
+
+	if len(group) > 0 {
+		this.lock.Lock()
+		this.failures += len(group)
+		this.lock.Unlock()
+
+		Warning("%d instances did not receive the files: no instance "+
+			"of their group holds them", len(group))
+	}
+}
+
+// Perform the scp send for the specified instances selection with the given
+// source local paths and the given target remote directory (that may be
+// empty) in the given relay mode.
+// This function never returns.
+//
+func scpDoRelay(instances *Ec2Selection, sources []string, target, mode string) {
+	var names map[string]bool = make(map[string]bool)
+	var unique []*Ec2Instance = make([]*Ec2Instance, 0)
+	var group []*Ec2Instance
+	var wg sync.WaitGroup
+	var relay scpRelay
+	var source, name string
+	var err error
+
+	relay.Sources = sources
+	relay.Target = target
+	relay.connector = newSshConnector(*optionContext,
+		*optionControlPersist, TRANSPORT_OPENSSH,
+		DEFAULT_NATIVE_CONCURRENCY, "", *optionUser, false)
+
+	if relay.Target == "" {
+		relay.Target = "."
+	}
+
+	for _, source = range sources {
+		name = filepath.Base(filepath.Clean(source))
+		if names[name] {
+			Error("several local paths with the same name: '%s'",
+				name)
+		}
+
+		names[name] = true
+		relay.Names = append(relay.Names, name)
+	}
+
+	relay.Manifest, err = buildSha256Manifest(sources)
+	if err != nil {
+		Error("cannot read local files: %s", err.Error())
+	}
+
+	unique = instances.Reachable(true)
+	relay.failures = len(instances.Unique()) - len(unique)
+
+	for _, group = range relayGroups(unique, mode) {
+		wg.Add(1)
+		go func(group []*Ec2Instance) {
+			relay.distribute(group)
+			wg.Done()
+		}(group)
+	}
+
+	wg.Wait()
+
+	if relay.failures > 0 {
+		os.Exit(1)
+	}
+
+	os.Exit(0)
+}
@@ -6,18 +6,21 @@ import (
 )
 
 type setParameters struct {
-	OptionContext *string
-	OptionDelete  *bool
+	OptionContext  *string
+	OptionDelete   *bool
+	OptionSyncTags *bool
 }
 
 var DEFAULT_SET_CONTEXT string = DEFAULT_CONTEXT
 var DEFAULT_SET_DELETE bool = false
+var DEFAULT_SET_SYNC_TAGS bool = false
 
 var setParams setParameters
 
 func PrintSetUsage() {
 	fmt.Printf(`Usage: %s set [options] [<instances-specs...> --] <property> <value>
        %s set [options] --delete [<instances-specs...> --] <property>
+       %s set [options] --sync-tags [<instances-specs...> --]
 
 Set an abritrary property for one or many instances.
 If no instance is specified, set the property for all instances.
@@ -28,12 +31,20 @@ The property value is an arbitrary string that may be empty.
 The first syntax set a property value, the second syntax delete a property.
 There is a difference between an defined but empty property and an undefined
 property.
+The third syntax writes the properties of the instances in their EC2 tags, as
+'%s<property>' tags, and removes the tags of the deleted properties.
 
 Options:
 
   --context <path>            path of the context file (default: '%s')
+
+  --delete                    delete the property instead of setting it
+
+  --sync-tags                 write the properties of the instances in their
+                              EC2 tags after the set or delete operation
 `,
-		PROGNAME, PROGNAME, DEFAULT_CONTEXT)
+		PROGNAME, PROGNAME, PROGNAME, TAG_ATTRIBUTE_PREFIX,
+		DEFAULT_CONTEXT)
 }
 
 func DoDelete(instances *Ec2Selection, attribute string) {
@@ -56,13 +67,14 @@ func Set(args []string) {
 	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
 	var specs, properties []string
 	var instances *Ec2Selection
-	var hasSpecs bool
+	var hasSpecs, syncOnly bool
 	var ctx *Ec2Index
 	var arg string
 	var err error
 
 	setParams.OptionContext = flags.String("context", DEFAULT_SET_CONTEXT, "")
 	setParams.OptionDelete = flags.Bool("delete", DEFAULT_SET_DELETE, "")
+	setParams.OptionSyncTags = flags.Bool("sync-tags", DEFAULT_SET_SYNC_TAGS, "")
 
 	flags.Parse(args[1:])
 	args = flags.Args()
@@ -82,7 +94,14 @@ func Set(args []string) {
 		properties = append(properties, arg)
 	}
 
-	if *setParams.OptionDelete {
+	syncOnly = *setParams.OptionSyncTags && !*setParams.OptionDelete &&
+		(len(properties) == 0)
+
+	if syncOnly {
+		if len(specs) < 1 {
+			Error("missing instance-spec operand")
+		}
+	} else if *setParams.OptionDelete {
 		if len(properties) < 1 {
 			Error("missing property operand")
 		} else if len(properties) > 1 {
@@ -102,15 +121,21 @@ func Set(args []string) {
 		}
 	}
 
-	if len(properties[0]) == 0 {
-		Error("invalid empty property name")
-	} else if (properties[0] == "name") || (properties[0] == "ip") ||
-		(properties[0] == "public-ip") ||
-		(properties[0] == "private-ip") ||
-		(properties[0] == "region") || (properties[0] == "user") ||
-		(properties[0] == "fiid") || (properties[0] == "fleet") ||
-		(properties[0] == "uiid") {
-		Error("conflicting property name")
+	if !syncOnly {
+		if len(properties[0]) == 0 {
+			Error("invalid empty property name")
+		} else if (properties[0] == "name") ||
+			(properties[0] == "ip") ||
+			(properties[0] == "public-ip") ||
+			(properties[0] == "private-ip") ||
+			(properties[0] == "region") ||
+			(properties[0] == "user") ||
+			(properties[0] == "fiid") ||
+			(properties[0] == "fleet") ||
+			(properties[0] == "uiid") ||
+			(properties[0] == "volumes") {
+			Error("conflicting property name")
+		}
 	}
 
 	ctx, err = LoadEc2Index(*setParams.OptionContext)
@@ -125,9 +150,16 @@ func Set(args []string) {
 
 	if *setParams.OptionDelete {
 		DoDelete(instances, properties[0])
-	} else {
+	} else if !syncOnly {
 		DoSet(instances, properties[0], properties[1])
 	}
 
 	StoreEc2Index(*setParams.OptionContext, ctx)
+
+	if *setParams.OptionSyncTags {
+		err = SyncAttributeTags(instances.Instances)
+		if err != nil {
+			Error("cannot synchronize tags: %s", err.Error())
+		}
+	}
 }
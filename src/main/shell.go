@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type shellParameters struct {
+	OptionContext           *string
+	OptionControlPersist    *string
+	OptionErrmode           *string
+	OptionNativeConcurrency *int
+	OptionOutmode           *string
+	OptionTransport         *string
+	OptionUser              *string
+}
+
+var DEFAULT_SHELL_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_SHELL_CONTROL_PERSIST string = DEFAULT_CONTROL_PERSIST
+var DEFAULT_SHELL_ERRMODE string = DEFAULT_ERRMODE
+var DEFAULT_SHELL_NATIVE_CONCURRENCY int = DEFAULT_NATIVE_CONCURRENCY
+var DEFAULT_SHELL_OUTMODE string = DEFAULT_OUTMODE
+var DEFAULT_SHELL_TRANSPORT string = DEFAULT_TRANSPORT
+var DEFAULT_SHELL_USER string = ""
+
+// The command executed on the instances to interpret the lines typed in the
+// shell.
+// The shell starting bash ignores the SIGINT sent to the lines so the session
+// survives them.
+//
+var SHELL_REMOTE_COMMAND []string = []string{"trap", ":", "INT", ";", "bash",
+	"-s"}
+
+// The first line sent to the remote shell of a session.
+// Each line is executed by the defined function, so a SIGINT makes the remote
+// shell abandon the line, even in the middle of a loop, and go on with the
+// next one.
+//
+const SHELL_REMOTE_PREAMBLE string = "trap 'return 130 2> /dev/null' INT ; " +
+	"ec2tools_line() { eval \"$1\" ; }\n"
+
+// The exit status of a line sent to an instance whose session is closed.
+//
+const SHELL_CLOSED_STATUS int = 255
+
+var shellParams shellParameters
+
+func PrintShellUsage() {
+	fmt.Printf(`Usage: %s shell [options] [<instance-specs...>]
+
+Open an interactive shell on one or many instances.
+Each line typed in the shell is executed on every selected instance and the
+outputs of the instances are aggregated as with '%s ssh' (see '%s help ssh'
+for the stream-modes).
+Each instance keeps its own remote shell for the whole session, so the
+working directory and the variables persist from one line to the next. The
+commands do not read any input.
+A Ctrl-C interrupts the running line on every instance and the sessions stay
+open, a second Ctrl-C kills the line and closes the sessions.
+If no instance is specified, then select every instances.
+
+Lines starting with ':' are interpreted by the shell itself:
+  :add <instance-specs...>    add the specified instances to the selection
+  :help                       print this list
+  :list                       print the selected instances
+  :quit                       close the sessions and exit (same as EOF)
+  :remove <instance-specs...> remove the specified instances from the
+                              selection
+  :select [<instance-specs>]  select the specified instances only, or every
+                              instances
+
+Options:
+
+  --context <path>            path of the context file (default: '%s')
+
+  --control-persist <time>    keep the ssh connections open in background for
+                              <time> after the shell exits, or 'none'
+                              (default: '%s')
+
+  --error-mode <stream-mode>  stream-mode of the stderr (default: '%s')
+
+  --native-concurrency <n>    establish at most <n> connections at the same
+                              time with the native transport, the sessions
+                              are not limited once connected (default: %d)
+
+  --output-mode <stream-mode> stream-mode of the stdout (default: '%s')
+
+  --transport <name>          connect with 'openssh' or 'native' (default:
+                              '%s')
+
+  --user <user-name>          use a custom user name for the ssh connections
+`,
+		PROGNAME, PROGNAME, PROGNAME, DEFAULT_SHELL_CONTEXT,
+		DEFAULT_SHELL_CONTROL_PERSIST, DEFAULT_SHELL_ERRMODE,
+		DEFAULT_SHELL_NATIVE_CONCURRENCY, DEFAULT_SHELL_OUTMODE,
+		DEFAULT_SHELL_TRANSPORT)
+}
+
+// Quote the given string so a POSIX shell interprets it as a single word with
+// the exact same content.
+//
+func ShellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", "'\\''", -1) + "'"
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Shell session related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// A persistent session with an instance.
+// The session is a remote shell reading the lines to execute on its stdin.
+// After each line, the remote shell prints a marker followed by the exit
+// status of the line on its stdout, and the marker alone on its stderr, so
+// the output of each line can be told apart.
+//
+type ShellSession struct {
+	Instance *Ec2Instance       // the remote instance
+	process  *Process           // the remote shell
+	builder  *SshProcessBuilder // killable builder of the remote shell
+	marker   string             // random marker ending the output of a line
+	closed   bool               // the remote shell has exited
+}
+
+// Create a new ShellSession with the given instance and start the given
+// remote shell process.
+//
+func newShellSession(instance *Ec2Instance, process *Process) *ShellSession {
+	var this ShellSession
+	var token [8]byte
+
+	rand.Read(token[:])
+
+	this.Instance = instance
+	this.process = process
+	this.marker = "__EC2TOOLS_" + hex.EncodeToString(token[:]) + "__"
+	this.closed = false
+
+	this.process.Start()
+	this.process.WriteStdin(SHELL_REMOTE_PREAMBLE)
+
+	return &this
+}
+
+// Copy the lines of the stdout of the remote shell if mode is true, or of its
+// stderr otherwise, to the given writer until the marker.
+// Return what follows the marker and true, or false if the remote shell
+// closed the stream before the marker.
+//
+func (this *ShellSession) relay(mode bool, to io.Writer) (string, bool) {
+	var line string
+	var has bool
+	var idx int
+
+	for {
+		line, has = readProcessStream(this.process, mode)
+		if !has {
+			return "", false
+		}
+
+		idx = strings.Index(line, this.marker)
+		if idx < 0 {
+			io.WriteString(to, line)
+			continue
+		}
+
+		if idx > 0 {
+			io.WriteString(to, line[:idx]+"\n")
+		}
+
+		return strings.TrimSpace(line[(idx + len(this.marker)):]), true
+	}
+}
+
+// Send the given line to the remote shell.
+// Return a Process, not started yet, which emits the output of the line and
+// exits with its exit status once the line is executed. If the remote shell
+// exits, the Process exits with SHELL_CLOSED_STATUS and the session is
+// closed. Killing the Process kills the remote shell.
+//
+func (this *ShellSession) Command(line string) *Process {
+	if !this.closed {
+		this.process.WriteStdin(fmt.Sprintf("ec2tools_line %s "+
+			"< /dev/null ; "+
+			"echo \"%s $?\" ; echo %s 1>&2\n", ShellQuote(line),
+			this.marker, this.marker))
+	}
+
+	return NewProcessCommand(newNativeCommand(func(cmd *nativeCommand) error {
+		var done chan bool = make(chan bool)
+		var outFound, errFound bool
+		var status string
+		var code int
+		var err error
+
+		if this.closed {
+			return newNativeCommandError(SHELL_CLOSED_STATUS,
+				"session closed")
+		}
+
+		cmd.onKill(func() {
+			this.process.Kill()
+		})
+
+		go func() {
+			_, errFound = this.relay(false, cmd.stderr)
+			done <- true
+		}()
+
+		status, outFound = this.relay(true, cmd.stdout)
+		<-done
+
+		if !outFound || !errFound {
+			this.closed = true
+			return newNativeCommandError(SHELL_CLOSED_STATUS,
+				"session closed")
+		}
+
+		code, err = strconv.Atoi(status)
+		if err != nil {
+			return newNativeCommandError(SHELL_CLOSED_STATUS,
+				"invalid status: '%s'", status)
+		} else if code != 0 {
+			return newNativeCommandError(code, "exit status %d",
+				code)
+		}
+
+		return nil
+	}))
+}
+
+// Indicate if the remote shell of this session has exited.
+//
+func (this *ShellSession) Closed() bool {
+	return this.closed
+}
+
+// Close the stdin of the remote shell and wait for it to exit.
+//
+func (this *ShellSession) Close() {
+	this.process.CloseStdin()
+	this.process.WaitFinished()
+	this.closed = true
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Shell related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// An interactive shell sending the lines typed by the user to the selected
+// instances.
+// The sessions are opened the first time an instance is selected and stay
+// open until the shell exits, even if the instance is not selected anymore.
+//
+type InteractiveShell struct {
+	Context   *Ec2Index                      // context of the instances
+	Selection []*Ec2Instance                 // selected instances
+	sessions  map[*Ec2Instance]*ShellSession // open sessions
+	connector *sshConnector                  // connection settings
+}
+
+// Create a new InteractiveShell for the given context and the context path.
+//
+func NewInteractiveShell(ctx *Ec2Index, contextPath string) *InteractiveShell {
+	var this InteractiveShell
+
+	this.Context = ctx
+	this.Selection = make([]*Ec2Instance, 0)
+	this.sessions = make(map[*Ec2Instance]*ShellSession)
+	this.connector = newSshConnector(contextPath,
+		*shellParams.OptionControlPersist,
+		*shellParams.OptionTransport,
+		*shellParams.OptionNativeConcurrency, "", *shellParams.OptionUser,
+		false)
+
+	return &this
+}
+
+// Return the session of the given instance, opening it if necessary.
+//
+func (this *InteractiveShell) session(instance *Ec2Instance) *ShellSession {
+	var builder *SshProcessBuilder
+	var session *ShellSession
+	var found bool
+
+	session, found = this.sessions[instance]
+	if found {
+		return session
+	}
+
+	builder = this.connector.Builder(instance, SHELL_REMOTE_COMMAND)
+	builder.Killable()
+	builder.Isolate()
+
+	session = newShellSession(instance, builder.Build())
+	this.sessions[instance] = session
+	session.builder = builder
+
+	return session
+}
+
+// Return the instances of the context matching the given specifications,
+// without duplicates.
+// Print a warning and return false if a specification is invalid.
+//
+func (this *InteractiveShell) match(specs []string) ([]*Ec2Instance, bool) {
+	var selection *Ec2Selection
+	var err error
+
+	selection, err = this.Context.Select(specs)
+	if err != nil {
+		Warning("invalid specification: %s", err.Error())
+		return nil, false
+	}
+
+	return selection.Unique(), true
+}
+
+// Add the given instances to the selection if they are not already selected.
+//
+func (this *InteractiveShell) add(instances []*Ec2Instance) {
+	var selected map[*Ec2Instance]bool = make(map[*Ec2Instance]bool)
+	var instance *Ec2Instance
+
+	for _, instance = range this.Selection {
+		selected[instance] = true
+	}
+
+	for _, instance = range instances {
+		if !selected[instance] {
+			selected[instance] = true
+			this.Selection = append(this.Selection, instance)
+		}
+	}
+}
+
+// Remove the given instances from the selection.
+//
+func (this *InteractiveShell) remove(instances []*Ec2Instance) {
+	var removed map[*Ec2Instance]bool = make(map[*Ec2Instance]bool)
+	var selection []*Ec2Instance = make([]*Ec2Instance, 0)
+	var instance *Ec2Instance
+
+	for _, instance = range instances {
+		removed[instance] = true
+	}
+
+	for _, instance = range this.Selection {
+		if !removed[instance] {
+			selection = append(selection, instance)
+		}
+	}
+
+	this.Selection = selection
+}
+
+// Print the selected instances on the stdout.
+//
+func (this *InteractiveShell) list() {
+	var instance *Ec2Instance
+
+	for _, instance = range this.Selection {
+		fmt.Printf("%s  %s  %s\n", instance.Name, instance.Fleet.Name,
+			instance.PublicIp)
+	}
+}
+
+// Print a warning with the instances of the given processes which exited with
+// a non zero status, grouped by status.
+// The processes are related to the selected instances.
+//
+func (this *InteractiveShell) reportFailures(processes []*Process) {
+	var failures map[int][]string = make(map[int][]string)
+	var codes []int = make([]int, 0)
+	var code, i int
+
+	for i = range processes {
+		code = boundedExitCode(processes[i])
+		if (code == 0) || this.sessions[this.Selection[i]].Closed() {
+			continue
+		} else if len(failures[code]) == 0 {
+			codes = append(codes, code)
+		}
+
+		failures[code] = append(failures[code], this.Selection[i].Name)
+	}
+
+	sort.Ints(codes)
+
+	for _, code = range codes {
+		Warning("exit status %d on %s", code,
+			strings.Join(failures[code], ", "))
+	}
+}
+
+// Execute the given line on the selected instances and print their outputs.
+// The SIGINT and SIGTERM signals received meanwhile are sent to the line on
+// the instances.
+// The instances whose session is closed are removed from the selection.
+//
+func (this *InteractiveShell) execute(line string) {
+	var processes []*Process = make([]*Process, len(this.Selection))
+	var builders []*SshProcessBuilder = make([]*SshProcessBuilder,
+		len(this.Selection))
+	var done chan bool = make(chan bool)
+	var closed []*Ec2Instance = make([]*Ec2Instance, 0)
+	var outTransmit, errTransmit ReaderTransmitter
+	var interrupt *SshInterrupt
+	var selection Ec2Selection
+	var instance *Ec2Instance
+	var i int
+
+	if len(this.Selection) == 0 {
+		Warning("no instance selected")
+		return
+	}
+
+	for i, instance = range this.Selection {
+		processes[i] = this.session(instance).Command(line)
+		builders[i] = this.sessions[instance].builder
+	}
+
+	interrupt = NewSshInterrupt(builders, processes, nil)
+	interrupt.Watch()
+
+	for i = range processes {
+		processes[i].Start()
+		processes[i].CloseStdin()
+	}
+
+	selection.Instances = this.Selection
+
+	outTransmit = newReaderTransmitter(*shellParams.OptionOutmode,
+		&selection, processes, true)
+	errTransmit = newReaderTransmitter(*shellParams.OptionErrmode,
+		&selection, processes, false)
+
+	go func() {
+		outTransmit.Transmit(os.Stdout)
+		done <- true
+	}()
+
+	errTransmit.Transmit(os.Stderr)
+	<-done
+
+	interrupt.Stop()
+	interrupt.WaitKillers()
+
+	this.reportFailures(processes)
+
+	for _, instance = range this.Selection {
+		if this.sessions[instance].Closed() {
+			Warning("session closed on instance %s", instance.Name)
+			delete(this.sessions, instance)
+			closed = append(closed, instance)
+		}
+	}
+
+	this.remove(closed)
+}
+
+// Interpret the given shell command line, starting with ':'.
+// Return false if the shell must exit.
+//
+func (this *InteractiveShell) interpret(line string) bool {
+	var instances []*Ec2Instance
+	var fields []string
+	var ok bool
+
+	fields = strings.Fields(line[1:])
+	if len(fields) == 0 {
+		Warning("missing shell command")
+		return true
+	}
+
+	if fields[0] == "add" {
+		if len(fields) < 2 {
+			Warning("missing instance specification")
+		} else if instances, ok = this.match(fields[1:]); ok {
+			this.add(instances)
+		}
+	} else if fields[0] == "help" {
+		PrintShellUsage()
+	} else if fields[0] == "list" {
+		this.list()
+	} else if fields[0] == "quit" {
+		return false
+	} else if fields[0] == "remove" {
+		if len(fields) < 2 {
+			Warning("missing instance specification")
+		} else if instances, ok = this.match(fields[1:]); ok {
+			this.remove(instances)
+		}
+	} else if fields[0] == "select" {
+		if len(fields) < 2 {
+			fields = append(fields, "//")
+		}
+
+		if instances, ok = this.match(fields[1:]); ok {
+			this.Selection = instances
+		}
+	} else {
+		Warning("unknown shell command: '%s'", fields[0])
+	}
+
+	return true
+}
+
+// Read the lines typed by the user on the stdin and execute them until the
+// end of the stdin or a ':quit' command.
+// A prompt is printed on the stderr if the stdin is a terminal.
+//
+func (this *InteractiveShell) Run() {
+	var reader *bufio.Reader = bufio.NewReader(os.Stdin)
+	var interactive bool = IsTerminal(os.Stdin)
+	var line string
+	var err error
+
+	for {
+		if interactive {
+			fmt.Fprintf(os.Stderr, "%s[%d]> ", PROGNAME,
+				len(this.Selection))
+		}
+
+		line, err = reader.ReadString('\n')
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, ":") {
+			if !this.interpret(line) {
+				break
+			}
+		} else if line != "" {
+			this.execute(line)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+}
+
+// Close every open session.
+//
+func (this *InteractiveShell) Close() {
+	var session *ShellSession
+
+	for _, session = range this.sessions {
+		session.process.CloseStdin()
+	}
+
+	for _, session = range this.sessions {
+		session.Close()
+	}
+}
+
+func Shell(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var shell *InteractiveShell
+	var ctx *Ec2Index
+	var specs []string
+	var ok bool
+	var err error
+
+	shellParams.OptionContext = flags.String("context", DEFAULT_SHELL_CONTEXT, "")
+	shellParams.OptionControlPersist = flags.String("control-persist", DEFAULT_SHELL_CONTROL_PERSIST, "")
+	shellParams.OptionErrmode = flags.String("error-mode", DEFAULT_SHELL_ERRMODE, "")
+	shellParams.OptionNativeConcurrency = flags.Int("native-concurrency", DEFAULT_SHELL_NATIVE_CONCURRENCY, "")
+	shellParams.OptionOutmode = flags.String("output-mode", DEFAULT_SHELL_OUTMODE, "")
+	shellParams.OptionTransport = flags.String("transport", DEFAULT_SHELL_TRANSPORT, "")
+	shellParams.OptionUser = flags.String("user", DEFAULT_SHELL_USER, "")
+
+	flags.Parse(args[1:])
+
+	if !checkStreamMode(*shellParams.OptionErrmode) {
+		Error("invalid stream-mode for stderr: '%s'",
+			*shellParams.OptionErrmode)
+	} else if !checkStreamMode(*shellParams.OptionOutmode) {
+		Error("invalid stream-mode for stdout: '%s'",
+			*shellParams.OptionOutmode)
+	} else if !IsTransport(*shellParams.OptionTransport) {
+		Error("invalid transport: '%s'", *shellParams.OptionTransport)
+	}
+
+	ctx, err = LoadEc2Index(*shellParams.OptionContext)
+	if err != nil {
+		Error("no context: %s", *shellParams.OptionContext)
+	}
+
+	specs = flags.Args()
+	if len(specs) == 0 {
+		specs = []string{"//"}
+	}
+
+	shell = NewInteractiveShell(ctx, *shellParams.OptionContext)
+
+	shell.Selection, ok = shell.match(specs)
+	if !ok {
+		os.Exit(1)
+	}
+
+	shell.Run()
+	shell.Close()
+}
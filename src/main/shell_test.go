@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	if ShellQuote("echo $HOME") != "'echo $HOME'" {
+		t.Fail()
+	}
+
+	if ShellQuote("it's") != "'it'\\''s'" {
+		t.Fail()
+	}
+}
+
+func readShellCommand(process *Process) (string, string, int) {
+	var stdout, stderr, line string
+	var code int
+	var has bool
+
+	process.Start()
+	process.CloseStdin()
+
+	for {
+		line, has = process.ReadStdout()
+		if !has {
+			break
+		}
+
+		stdout += line
+	}
+
+	for {
+		line, has = process.ReadStderr()
+		if !has {
+			break
+		}
+
+		stderr += line
+	}
+
+	process.WaitFinished()
+	code, _ = process.ExitCode()
+
+	return stdout, stderr, code
+}
+
+func TestShellSession(t *testing.T) {
+	var session *ShellSession
+	var stdout, stderr string
+	var code int
+
+	session = newShellSession(&Ec2Instance{Name: "i-0"},
+		NewProcess([]string{"bash", "-s"}))
+
+	stdout, stderr, code = readShellCommand(session.Command("cd / ; pwd"))
+	if (stdout != "/\n") || (stderr != "") || (code != 0) {
+		t.Fail()
+	}
+
+	stdout, stderr, code = readShellCommand(session.Command(
+		"printf 'it'\\''s' ; echo oops >&2 ; pwd ; false"))
+	if (stdout != "it's/\n") || (stderr != "oops\n") || (code != 1) {
+		t.Fail()
+	}
+
+	_, _, code = readShellCommand(session.Command("if"))
+	if (code != 2) || session.Closed() {
+		t.Fail()
+	}
+
+	_, _, code = readShellCommand(session.Command("exit 3"))
+	if (code != SHELL_CLOSED_STATUS) || !session.Closed() {
+		t.Fail()
+	}
+
+	session.Close()
+}
+
+func TestShellSessionInterrupt(t *testing.T) {
+	var session *ShellSession
+	var stdout string
+	var code int
+
+	session = newShellSession(&Ec2Instance{Name: "i-0"},
+		NewProcess([]string{"bash", "-s"}))
+
+	_, _, code = readShellCommand(session.Command("X=1 ; kill -INT $$ ; " +
+		"for i in 1 2 3 4 5 6 7 8 9 ; do sleep 0.5 ; done ; X=2"))
+	if (code != 130) || session.Closed() {
+		t.Fail()
+	}
+
+	stdout, _, code = readShellCommand(session.Command("echo $X"))
+	if (stdout != "1\n") || (code != 0) {
+		t.Fail()
+	}
+
+	session.Close()
+}
@@ -2,25 +2,72 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var DEFAULT_COMMAND string = ""
 var DEFAULT_ERRMODE string = "all-prefix"
 var DEFAULT_EXTMODE string = "eager-greatest"
 var DEFAULT_OUTMODE string = "merge-parallel"
-var DEFAULT_TIMEOUT int64 = -1
+var DEFAULT_TIMEOUT string = "none"
 var DEFAULT_VERBOSE bool = false
+var DEFAULT_PARALLEL int = 0
+var DEFAULT_BATCH int = 0
+var DEFAULT_PAUSE string = "0"
+var DEFAULT_STOP_ON_FAILURE bool = false
+var DEFAULT_SHOW_DIVERGENT bool = false
+var DEFAULT_STDIN string = "broadcast"
+var DEFAULT_STDIN_FILE string = ""
 
 var optionCommand *string
 var optionErrmode *string
 var optionExtmode *string
 var optionOutmode *string
-var optionTimeout *int64
+var optionTimeout *string
 var optionVerbose *bool
+var optionParallel *int
+var optionBatch *int
+var optionPause *string
+var optionStopOnFailure *bool
+var optionShowDivergent *bool
+var optionStdin *string
+var optionStdinFile *string
+
+// The exit status of the ssh processes which are not started because another
+// one failed with '--stop-on-failure'.
+//
+const SSH_ABORTED_STATUS int = 255
+
+// The path of the remote file storing the process group of a killable remote
+// command, formatted with a random token.
+//
+const REMOTE_PIDFILE_PATTERN string = "/tmp/.ec2tools-%s.pid"
+
+// The number of seconds to wait for an ssh process to end after its remote
+// command is killed before to kill it locally.
+//
+const SSH_KILL_GRACE int = 5
+
+// The schedule of the ssh processes built from the command line options.
+//
+var sshSchedule Schedule
+
+// Print the instances emitting divergent lines in merge-parallel stream-mode.
+//
+var sshShowDivergent bool = DEFAULT_SHOW_DIVERGENT
 
 func PrintSshUsage() {
 	fmt.Printf(`Usage: %s ssh [options] [ <instance-specs...> '--' ] <cmd> [ <args...> ]
@@ -31,15 +78,60 @@ If some instances are specified, every commands are sent to each of the
 instances.
 In each case, the instances output are aggregated.
 The aggregation behavior is controlled by the options (see Modes).
+The host keys of the instances are checked against the known_hosts file of the
+context (the context path with a '.known_hosts' suffix). The key of an
+instance is recorded on first use, or earlier by 'wait' from the console output
+of the instance, and a changed key makes the connection fail.
+The errors and warnings of ssh itself, like a changed host key, are printed on
+the stderr of the instances along with the output of the command.
+On SIGINT (Ctrl-C) or SIGTERM, no more command is started. With a timeout or
+the 'fail-fast' exit-mode, the signal is sent to the command and all its
+child processes on every instance, and a second signal kills them
+immediately. Otherwise the ssh connections are closed.
+When the keys are loaded in an ssh agent or when the standard input is not a
+terminal, ssh runs in background so it never prompts and a Ctrl-C only
+reaches the commands this way. Otherwise ssh stays in foreground so it can
+prompt for a password or a key passphrase, and a Ctrl-C also kills it.
+To find the processes to kill with a timeout or the 'fail-fast' exit-mode,
+the command is run by the login shell of the instance after a short shell
+prefix recording its process group in a file of '/tmp', removed when the
+command ends. The login shell must understand the POSIX 'trap' and
+redirections and '/tmp' must be writable.
 
 Options:
+  --batch <n>                 run the command on <n> instances at a time and
+                              wait for them to finish before the next ones
   --command <cmd>             use a custom ssh command
   --context <path>            path of the context file (default: '%s')
+  --control-persist <time>    keep the ssh connections open in background for
+                              <time> after the last command to reuse them, or
+                              'none' to disable (default: '%s')
   --error-mode <stream-mode>  stream-mode of the stderr (default: '%s')
   --exit-mode <exit-mode>     exit-mode used (default: '%s')
   --format                    interpret the cmd and args as printf format
+  --native-concurrency <n>    establish at most <n> connections at the same
+                              time with the native transport, the commands
+                              are not limited once connected (default: %d)
   --output-mode <stream-mode> stream-mode of the stdout (default: '%s')
-  --timeout <sec>             cancel the ssh commands after <sec> timeout
+  --parallel <n>              run the command on at most <n> instances at the
+                              same time, or on every instances if 0
+  --pause <timespec>          wait <timespec> between two batches
+  --show-divergent            in merge-parallel stream-mode, print the ids of
+                              the instances emitting each line which is not
+                              emitted by every instances
+  --stdin <stdin-mode>        distribution of the stdin lines to the
+                              instances (default: '%s')
+  --stdin-file <pattern>      read the stdin of each instance from the file
+                              given by the pattern formatted for the instance
+                              (see '%s help get') instead of the stdin
+  --stop-on-failure           do not start the command on the remaining
+                              instances once it failed on an instance
+  --timeout <timespec>        kill the command on an instance, remotely then
+                              locally, if it runs for longer than <timespec>
+                              or 'none' (default: '%s')
+  --transport <name>          connect with 'openssh' (external ssh command) or
+                              'native' (built-in client sharing one connection
+                              per instance) (default: '%s')
   --user <user-name>          use a custom user name for the ssh connection
   --verbose                   print ssh debug output
 
@@ -55,15 +147,66 @@ Modes:
                               is prefixed by the id of the instance.
 
     merge-parallel            Print all outputs in parallel, grouping the same
-                              output lines together.
+                              output lines together. The n-th lines of every
+                              instances are grouped, waiting at most %s
+                              for the slow instances. A notice is printed when
+                              an instance ends before the others.
+
+    raw                       Print the output of every instances as is,
+                              without prefix.
+
+    group                     Print the output of each instance at once when
+                              it finishes. Each line is prefixed by the id of
+                              the instance.
+
+    prefix-format:<pattern>   Print the output of every instances. Each line
+                              is prefixed by the pattern formatted for the
+                              instance (see '%s help get'), e.g.
+                              'prefix-format:[%%f/%%d] '.
+
+    tee-dir:<pattern>         Write the output of each instance in the
+                              'stdout' or 'stderr' file of the directory
+                              given by the pattern formatted for the instance
+                              and print it as all-prefix does.
 
   Exit-modes:
     eager-greatest            Execute the command on every instances and take
                               the greatest exit code.
+
+    fail-fast                 Kill the command on every instances as soon as
+                              it fails on one instance and take the exit code
+                              of this instance.
+
+    all-zero                  Exit with 0 if the command succeeds on every
+                              instances, 1 otherwise.
+
+    any-zero                  Exit with 0 if the command succeeds on at least
+                              one instance, 1 otherwise.
+
+    majority                  Exit with 0 if the command succeeds on more than
+                              half of the instances, 1 otherwise.
+
+    report                    Print the exit code of every instance on the
+                              stderr and take the greatest exit code.
+
+  Stdin-modes:
+    broadcast                 Send every line to every instances.
+
+    split                     Send each line to one instance, in turn.
+
+    hash                      Send each line to one instance chosen by a hash
+                              of the line, so the same lines always go to the
+                              same instance.
+
+    none                      Do not read the stdin. The command reads an
+                              empty input on every instances.
 `,
-		PROGNAME, DEFAULT_CONTEXT, DEFAULT_ERRMODE, DEFAULT_EXTMODE,
-		DEFAULT_OUTMODE,
-		DEFAULT_OUTMODE, DEFAULT_ERRMODE, DEFAULT_EXTMODE)
+		PROGNAME, DEFAULT_CONTEXT, DEFAULT_CONTROL_PERSIST,
+		DEFAULT_ERRMODE, DEFAULT_EXTMODE, DEFAULT_NATIVE_CONCURRENCY,
+		DEFAULT_OUTMODE, DEFAULT_STDIN, PROGNAME, DEFAULT_TIMEOUT,
+		DEFAULT_TRANSPORT,
+		DEFAULT_OUTMODE, DEFAULT_ERRMODE, DEFAULT_EXTMODE,
+		DEFAULT_MERGE_WINDOW, PROGNAME)
 }
 
 // - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
@@ -81,6 +224,13 @@ type SshProcessBuilder struct {
 	timeout  *int         // optional timeout (in seconds)
 	user     *string      // optional ssh user
 	verbose  bool         // enable verbose mode
+
+	control    *SshControl         // optional connection multiplexing
+	knownHosts *KnownHosts         // optional host keys to verify
+	transport  *NativeSshTransport // optional native transport
+	pidfile    string              // optional remote process group file
+	isolated   bool                // ignore the terminal signals
+	tty        bool                // allocate a remote terminal
 }
 
 // Create a new SshProcessBuilder for the specified instance and doing the
@@ -141,17 +291,164 @@ func (this *SshProcessBuilder) Verbose() *SshProcessBuilder {
 	return this
 }
 
-// Build an ssh Process based on this configuration.
+// Multiplex the ssh connection with the specified control.
+// The control is ignored for custom ssh commands.
+//
+func (this *SshProcessBuilder) Control(control *SshControl) *SshProcessBuilder {
+	this.control = control
+	return this
+}
+
+// Verify the host key of the instance against the specified known hosts
+// instead of accepting any key.
+//
+func (this *SshProcessBuilder) KnownHosts(knownHosts *KnownHosts) *SshProcessBuilder {
+	this.knownHosts = knownHosts
+	return this
+}
+
+// Use the specified native transport instead of an external ssh command.
+// The custom ssh command, if any, is ignored.
+//
+func (this *SshProcessBuilder) Native(transport *NativeSshTransport) *SshProcessBuilder {
+	this.transport = transport
+	return this
+}
+
+// Record the process group of the remote command in a remote file so it can
+// be killed later with a Process built by SshProcessBuilder.BuildRemoteKill().
+// The ssh and run commands only make the processes killable with a timeout or
+// a fail-fast exit mode. The remote file is created in '/tmp' by a POSIX shell
+// prefix of the command line (see remoteCmdline()).
+//
+func (this *SshProcessBuilder) Killable() *SshProcessBuilder {
+	var token [8]byte
+
+	rand.Read(token[:])
+
+	this.pidfile = fmt.Sprintf(REMOTE_PIDFILE_PATTERN,
+		hex.EncodeToString(token[:]))
+
+	return this
+}
+
+// Indicate if the processes built by this builder are killable.
+//
+func (this *SshProcessBuilder) IsKillable() bool {
+	return (this.pidfile != "")
+}
+
+// Allocate a terminal on the remote instance, for interactive sessions.
+// This has no effect with the native transport.
+//
+func (this *SshProcessBuilder) Tty() *SshProcessBuilder {
+	this.tty = true
+	return this
+}
+
+// Run the local ssh process in its own process group so the signals sent by
+// the terminal, like the SIGINT of a Ctrl-C, do not kill it.
+// Since a background process stops when it reads the terminal, ssh is run in
+// batch mode so it fails instead of asking for a password or a passphrase.
+// This has no effect with the native transport or with a custom command other
+// than ssh, which cannot be told not to prompt.
+//
+func (this *SshProcessBuilder) Isolate() *SshProcessBuilder {
+	this.isolated = true
+	return this
+}
+
+// Return the command line to execute on the remote instance.
+// If the process is killable, the command line is prefixed by a shell
+// command writing the remote process group in the pidfile and removing it
+// when the command ends.
+// The remote command runs in its own process group because sshd starts every
+// session in a new session.
+//
+func (this *SshProcessBuilder) remoteCmdline() []string {
+	if this.pidfile == "" {
+		return this.cmdline
+	}
+
+	return append([]string{fmt.Sprintf("trap 'rm -f %s' EXIT ;",
+		this.pidfile), "echo", "$$", ">", this.pidfile, ";"},
+		this.cmdline...)
+}
+
+// Build an ssh Process sending the given signal to the remote command of the
+// Process built by this killable builder, and to every process of its group.
+// The returned Process does nothing if the remote command is not running. It
+// waits at most SSH_KILL_GRACE seconds for the connection.
 // The returned Process is not started yet.
 //
-func (this *SshProcessBuilder) Build() *Process {
-	var sshuser, dest string
-	var cmd []string = this.sshcmd
+func (this *SshProcessBuilder) BuildRemoteKill(signal string) *Process {
+	var killer SshProcessBuilder = *this
+
+	killer.pidfile = ""
+	killer.Timeout(SSH_KILL_GRACE)
+	killer.cmdline = []string{fmt.Sprintf("test -f %s && "+
+		"kill -%s -- -$(cat %s) 2> /dev/null ; rm -f %s", this.pidfile,
+		signal, this.pidfile, this.pidfile)}
+
+	return killer.Build()
+}
+
+// Build an ssh Process using the native transport.
+//
+func (this *SshProcessBuilder) buildNative(sshuser string) *Process {
+	var timeout int = 0
+
+	if this.timeout != nil {
+		timeout = *this.timeout
+	}
+
+	if this.knownHosts != nil {
+		this.transport.SetHostKeyAlias(this.instance.PublicIp,
+			this.instance.Name)
+	}
+
+	return NewProcessCommand(this.transport.Command(sshuser,
+		this.instance.PublicIp, this.remoteCmdline(), timeout,
+		this.verbose))
+}
+
+// Return the ssh user name to use.
+//
+func (this *SshProcessBuilder) sshUser() string {
+	if this.user != nil {
+		return *this.user
+	} else {
+		return this.instance.Fleet.User
+	}
+}
+
+// Return the local command line of the ssh process based on this
+// configuration.
+// The native transport, if any, is ignored.
+//
+func (this *SshProcessBuilder) Cmdline() []string {
+	var cmd []string = append([]string{}, this.sshcmd...)
 
 	if cmd[0] == "ssh" {
-		cmd = append(cmd, "-o", "StrictHostKeyChecking=no")
-		cmd = append(cmd, "-o", "LogLevel=Quiet")
-		cmd = append(cmd, "-o", "UserKnownHostsFile=/dev/null")
+		if this.knownHosts != nil {
+			cmd = append(cmd,
+				this.knownHosts.Options(this.instance.Name)...)
+			cmd = append(cmd, "-o", "LogLevel=Error")
+		} else {
+			cmd = append(cmd, "-o", "StrictHostKeyChecking=no")
+			cmd = append(cmd, "-o", "LogLevel=Quiet")
+			cmd = append(cmd, "-o", "UserKnownHostsFile=/dev/null")
+		}
+
+		if this.control != nil {
+			cmd = append(cmd,
+				this.control.Options(this.instance.Name,
+					!this.verbose)...)
+		}
+
+		if this.isolated {
+			cmd = append(cmd, "-o", "BatchMode=yes")
+		}
 	}
 
 	if this.timeout != nil {
@@ -163,16 +460,31 @@ func (this *SshProcessBuilder) Build() *Process {
 		cmd = append(cmd, "-v")
 	}
 
-	if this.user != nil {
-		sshuser = *this.user
-	} else {
-		sshuser = this.instance.Fleet.User
+	if this.tty {
+		cmd = append(cmd, "-t")
+	}
+
+	cmd = append(cmd, this.sshUser()+"@"+this.instance.PublicIp)
+	cmd = append(cmd, this.remoteCmdline()...)
+
+	return cmd
+}
+
+// Build an ssh Process based on this configuration.
+// The returned Process is not started yet.
+//
+func (this *SshProcessBuilder) Build() *Process {
+	var cmd []string
+
+	if this.transport != nil {
+		return this.buildNative(this.sshUser())
 	}
 
-	dest = sshuser + "@" + this.instance.PublicIp
+	cmd = this.Cmdline()
 
-	cmd = append(cmd, dest)
-	cmd = append(cmd, this.cmdline...)
+	if this.isolated && (cmd[0] == "ssh") {
+		return NewProcessIsolated(cmd)
+	}
 
 	return NewProcess(cmd)
 }
@@ -288,319 +600,1812 @@ func (this *ReaderTransmitterAllPrefix) Transmit(to *os.File) {
 
 // - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 
-// A transmitted for several ssh Process launched in parallel.
-// Merge all the similar lines emitted in parallel and prefix each line
-// version with the number of processes emitting this line.
+// Return the next line of the given process stdout if mode is true or stderr
+// otherwise.
+// Block until there is a line to return or the stream is closed.
 //
-type ReaderTransmitterMergeParallel struct {
+func readProcessStream(process *Process, mode bool) (string, bool) {
+	if mode {
+		return process.ReadStdout()
+	} else {
+		return process.ReadStderr()
+	}
+}
+
+// A transmitter for several ssh Process launched in parallel.
+// Transmit the lines from each Process prefixed with a string specific to the
+// corresponding instance.
+//
+type ReaderTransmitterPrefixFormat struct {
 	Mode      bool       // true = stdout | false = stderr
+	Prefixes  []string   // prefix of the lines of each Process
 	Processes []*Process // processes to transmit the lines
 }
 
-// Create a ReaderTransmitterMergeParallel with specified parameters.
+// Create a ReaderTransmitterPrefixFormat for the specified instances and
+// processes, prefixing the lines with the given pattern formatted for each
+// instance.
+// An empty pattern transmits the lines as is.
 //
-func newReaderTransmitterMergeParallel(processes []*Process, mode bool) *ReaderTransmitterMergeParallel {
-	var ret ReaderTransmitterMergeParallel
+func NewReaderTransmitterPrefixFormat(instances *Ec2Selection,
+	processes []*Process, pattern string, mode bool) *ReaderTransmitterPrefixFormat {
+	var ret ReaderTransmitterPrefixFormat
+	var instance *Ec2Instance
+	var i int
 
 	ret.Mode = mode
+	ret.Prefixes = make([]string, len(instances.Instances))
 	ret.Processes = processes
 
-	return &ret
-}
-
-// Create a ReaderTransmitterMergeParallel for the specified processes for the
-// stdout streams.
-//
-func NewReaderTransmitterMergeParallelStdout(processes []*Process) *ReaderTransmitterMergeParallel {
-	return newReaderTransmitterMergeParallel(processes, true)
-}
+	for i, instance = range instances.Instances {
+		ret.Prefixes[i] = Format(pattern, instance)
+	}
 
-// Create a ReaderTransmitterMergeParallel for the specified processes for the
-// stderr streams.
-//
-func NewReaderTransmitterMergeParallelStderr(processes []*Process) *ReaderTransmitterMergeParallel {
-	return newReaderTransmitterMergeParallel(processes, false)
+	return &ret
 }
 
-// Compute the format to use to print lines.
-// The prefix indicating the number of emitting processes must have a fixed
-// size for the whole execution.
+// Transmit all the lines of the related processes as soon as they arrive, with
+// the prefix of their process.
 //
-func (this *ReaderTransmitterMergeParallel) computeFormat() string {
-	var width, buffer int
-	var format string
+func (this *ReaderTransmitterPrefixFormat) Transmit(to *os.File) {
+	var done chan bool = make(chan bool)
+	var lock sync.Mutex
+	var idx int
 
-	width = 1
-	buffer = len(this.Processes)
+	for idx = range this.Processes {
+		go func(i int) {
+			var line string
+			var has bool
+
+			for {
+				line, has = readProcessStream(this.Processes[i],
+					this.Mode)
+				if !has {
+					break
+				}
+
+				lock.Lock()
+				to.WriteString(this.Prefixes[i] + line)
+				lock.Unlock()
+			}
 
-	for buffer >= 10 {
-		width += 1
-		buffer /= 10
+			done <- true
+		}(idx)
 	}
 
-	format = fmt.Sprintf("%%s[%%%dd/%%%dd] %%s", width, width)
-	return format
+	for _ = range this.Processes {
+		<-done
+	}
 }
 
-// Merge the specified lines to account how many different versions there are
-// and how many occurences for each of them, then print them with the
-// appropriate prefix.
-//
-func (this *ReaderTransmitterMergeParallel) transmitFormatted(lines []string,
-	to *os.File) {
-	var packedLines map[string]int = make(map[string]int)
-	var line, bufline, format string
-	var count, max int
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 
-	for _, line = range lines {
-		packedLines[line] += 1
-	}
+// A transmitter for several ssh Process launched in parallel.
+// Buffer the lines of each Process and transmit them at once when the stream
+// of the Process closes, prefixed with the corresponding instance name.
+//
+type ReaderTransmitterGroup struct {
+	Mode      bool           // true = stdout | false = stderr
+	Instances []*Ec2Instance // instances corresponging to each ssh Process
+	Processes []*Process     // processes to transmit the lines
+}
 
-	format = this.computeFormat()
+// Create a ReaderTransmitterGroup for the specified instances and processes.
+//
+func NewReaderTransmitterGroup(instances *Ec2Selection, processes []*Process,
+	mode bool) *ReaderTransmitterGroup {
+	var ret ReaderTransmitterGroup
 
-	max = len(lines)
-	for line, count = range packedLines {
-		if count == max {
-			bufline = fmt.Sprintf(format, "*", count, max, line)
-		} else {
-			bufline = fmt.Sprintf(format, " ", count, max, line)
-		}
+	ret.Mode = mode
+	ret.Instances = instances.Instances
+	ret.Processes = processes
 
-		to.WriteString(bufline)
-	}
+	return &ret
 }
 
-// Transmit all the lines of the related processes merged with occurence count
-// displayed.
+// Transmit the lines of each process contiguously, in the order the processes
+// close their stream.
 //
-func (this *ReaderTransmitterMergeParallel) Transmit(to *os.File) {
-	var process *Process
-	var lines []string
-	var line string
-	var has bool
-
-	for {
-		lines = make([]string, 0)
+func (this *ReaderTransmitterGroup) Transmit(to *os.File) {
+	var done chan bool = make(chan bool)
+	var lock sync.Mutex
+	var idx int
 
-		for _, process = range this.Processes {
-			if this.Mode {
-				line, has = process.ReadStdout()
-			} else {
-				line, has = process.ReadStderr()
+	for idx = range this.Processes {
+		go func(i int) {
+			var buffer strings.Builder
+			var line string
+			var has bool
+
+			for {
+				line, has = readProcessStream(this.Processes[i],
+					this.Mode)
+				if !has {
+					break
+				}
+
+				buffer.WriteString(fmt.Sprintf("[%s] %s",
+					this.Instances[i].Name, line))
 			}
 
-			if has {
-				lines = append(lines, string(line))
-			}
-		}
+			lock.Lock()
+			to.WriteString(buffer.String())
+			lock.Unlock()
 
-		if len(lines) == 0 {
-			break
-		}
+			done <- true
+		}(idx)
+	}
 
-		this.transmitFormatted(lines, to)
+	for _ = range this.Processes {
+		<-done
 	}
 }
 
-// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
-// Ssh process execution related code
 // - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 
-// Read on this process stdin and transmit each line to each of the specified
-// processes.
-// Once this process stdin closes, then close all the processes stdin.
+// A transmitter for several ssh Process launched in parallel.
+// Write the lines of each Process in a file specific to the corresponding
+// instance and transmit them prefixed with the instance name.
 //
-func taskTransmitStdin(processes []*Process) {
-	var reader *bufio.Reader = bufio.NewReader(os.Stdin)
-	var process *Process
-	var line []byte
-	var err error
-
-	for {
-		line, err = reader.ReadBytes('\n')
-		if err != nil {
-			break
-		}
-
-		for _, process = range processes {
-			process.WriteStdin(string(line))
-		}
-	}
+type ReaderTransmitterTeeDir struct {
+	Mode      bool           // true = stdout | false = stderr
+	Instances []*Ec2Instance // instances corresponging to each ssh Process
+	Processes []*Process     // processes to transmit the lines
+	Files     []*os.File     // file where to write the lines of each Process
+}
 
-	for _, process = range processes {
-		process.CloseStdin()
+// Return the name of the file written in the directory of each instance by a
+// ReaderTransmitterTeeDir.
+//
+func teeDirFileName(mode bool) string {
+	if mode {
+		return "stdout"
+	} else {
+		return "stderr"
 	}
 }
 
-// Collect the exit status of all the specified processes and return the max
-// of them.
-// If a process has an exit status less than 0 or greater than 255, it is
-// considered as 255.
+// Create a ReaderTransmitterTeeDir for the specified instances and processes,
+// writing in the directories given by the pattern formatted for each
+// instance.
+// The directories are created if necessary.
+// Return an error if a file cannot be created.
 //
-func collectExitEagerGreatest(processes []*Process) int {
-	var process *Process
-	var tmp, max int
+func NewReaderTransmitterTeeDir(instances *Ec2Selection, processes []*Process,
+	pattern string, mode bool) (*ReaderTransmitterTeeDir, error) {
+	var ret ReaderTransmitterTeeDir
+	var instance *Ec2Instance
+	var dir string
+	var err error
+	var i int
 
-	max = 0
+	ret.Mode = mode
+	ret.Instances = instances.Instances
+	ret.Processes = processes
+	ret.Files = make([]*os.File, len(instances.Instances))
 
-	for _, process = range processes {
-		process.WaitFinished()
+	for i, instance = range instances.Instances {
+		dir = Format(pattern, instance)
 
-		tmp, _ = process.ExitCode()
-		if (tmp < 0) || (tmp > 255) {
-			tmp = 255
+		err = os.MkdirAll(dir, 0755)
+		if err != nil {
+			return nil, err
 		}
 
-		if tmp > max {
-			max = tmp
+		ret.Files[i], err = os.Create(filepath.Join(dir,
+			teeDirFileName(mode)))
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return max
+	return &ret, nil
 }
 
-// Transmit the input and output streams of the given processes, related to
-// the specified instances.
-// The transmission occurs accoring to the '--output-mode' and '--error-mode'
-// options.
-// Return when there is nothing more to transmit from the processes stdout and
-// stderr.
+// Transmit all the lines of the related processes as soon as they arrive,
+// prefixed by the name of the emitting instance, and write them without
+// prefix in the file of the instance.
+// The files are closed once the streams are closed.
 //
-func transmitStreams(instances *Ec2Selection, processes []*Process) {
+func (this *ReaderTransmitterTeeDir) Transmit(to *os.File) {
 	var done chan bool = make(chan bool)
-	var outTransmit, errTransmit ReaderTransmitter
+	var lock sync.Mutex
+	var idx int
 
-	if *optionOutmode == "all-prefix" {
-		outTransmit = NewReaderTransmitterAllPrefixStdout(instances,
-			processes)
-	} else if *optionOutmode == "merge-parallel" {
-		outTransmit =
-			NewReaderTransmitterMergeParallelStdout(processes)
-	} else {
-		Error("unknown output mode: '%s'", *optionOutmode)
+	for idx = range this.Processes {
+		go func(i int) {
+			var line string
+			var has bool
+
+			for {
+				line, has = readProcessStream(this.Processes[i],
+					this.Mode)
+				if !has {
+					break
+				}
+
+				this.Files[i].WriteString(line)
+
+				lock.Lock()
+				to.WriteString(fmt.Sprintf("[%s] %s",
+					this.Instances[i].Name, line))
+				lock.Unlock()
+			}
+
+			this.Files[i].Close()
+
+			done <- true
+		}(idx)
 	}
 
-	if *optionErrmode == "all-prefix" {
-		errTransmit = NewReaderTransmitterAllPrefixStderr(instances,
-			processes)
-	} else if *optionErrmode == "merge-parallel" {
-		errTransmit =
-			NewReaderTransmitterMergeParallelStderr(processes)
-	} else {
-		Error("unknown errput mode: '%s'", *optionErrmode)
+	for _ = range this.Processes {
+		<-done
 	}
+}
 
-	go func() {
-		outTransmit.Transmit(os.Stdout)
-		done <- true
-	}()
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 
-	go func() {
-		errTransmit.Transmit(os.Stderr)
-		done <- true
-	}()
+// A transmitted for several ssh Process launched in parallel.
+// Merge all the similar lines emitted in parallel and prefix each line
+// version with the number of processes emitting this line.
+// The lines are aligned by sequence: the n-th lines of every processes are
+// merged together. The n-th lines are printed once every running process
+// emitted its own or after a time window, so a slow instance does not stall
+// the output of the others. The lines a slow instance emits after this
+// window are merged and printed later on their own.
+//
+type ReaderTransmitterMergeParallel struct {
+	Mode          bool           // true = stdout | false = stderr
+	Instances     []*Ec2Instance // instances emitting the lines
+	Processes     []*Process     // processes to transmit the lines
+	Window        time.Duration  // maximum time to wait for slow processes
+	ShowDivergent bool           // print the instances of divergent lines
+}
 
-	go taskTransmitStdin(processes)
+// The time a ReaderTransmitterMergeParallel waits for the slow processes to
+// emit a line before printing it without them.
+//
+var DEFAULT_MERGE_WINDOW time.Duration = 500 * time.Millisecond
+
+// Create a ReaderTransmitterMergeParallel with specified parameters.
+//
+func newReaderTransmitterMergeParallel(instances *Ec2Selection,
+	processes []*Process, mode bool) *ReaderTransmitterMergeParallel {
+	var ret ReaderTransmitterMergeParallel
+
+	ret.Mode = mode
+	ret.Instances = instances.Instances
+	ret.Processes = processes
+	ret.Window = DEFAULT_MERGE_WINDOW
+	ret.ShowDivergent = false
+
+	return &ret
+}
+
+// Create a ReaderTransmitterMergeParallel for the specified instances and
+// processes for the stdout streams.
+//
+func NewReaderTransmitterMergeParallelStdout(instances *Ec2Selection,
+	processes []*Process) *ReaderTransmitterMergeParallel {
+	return newReaderTransmitterMergeParallel(instances, processes, true)
+}
+
+// Create a ReaderTransmitterMergeParallel for the specified instances and
+// processes for the stderr streams.
+//
+func NewReaderTransmitterMergeParallelStderr(instances *Ec2Selection,
+	processes []*Process) *ReaderTransmitterMergeParallel {
+	return newReaderTransmitterMergeParallel(instances, processes, false)
+}
+
+// Compute the format to use to print lines.
+// The prefix indicating the number of emitting processes must have a fixed
+// size for the whole execution.
+//
+func (this *ReaderTransmitterMergeParallel) computeFormat() string {
+	var width, buffer int
+	var format string
+
+	width = 1
+	buffer = len(this.Processes)
+
+	for buffer >= 10 {
+		width += 1
+		buffer /= 10
+	}
+
+	format = fmt.Sprintf("%%s[%%%dd/%%%dd] %%s", width, width)
+	return format
+}
+
+// Return the names of the instances with the given indices, separated by
+// commas.
+//
+func (this *ReaderTransmitterMergeParallel) instanceNames(indices []int) string {
+	var names []string = make([]string, 0, len(indices))
+	var idx int
+
+	for _, idx = range indices {
+		names = append(names, this.Instances[idx].Name)
+	}
+
+	return strings.Join(names, ",")
+}
+
+// Merge the specified lines, indexed by emitting process, to account how many
+// different versions there are and how many occurences for each of them, then
+// print them with the appropriate prefix.
+// The versions are printed from the most to the least emitted, then in
+// lexical order. If ShowDivergent is set, the versions not emitted by every
+// processes are prefixed by the names of the emitting instances.
+//
+func (this *ReaderTransmitterMergeParallel) transmitFormatted(
+	lines map[int]string, to *os.File) {
+	var packedLines map[string][]int = make(map[string][]int)
+	var versions []string = make([]string, 0)
+	var line, marker, format string
+	var indices []int
+	var max, idx int
+	var has bool
+
+	for idx = range this.Processes {
+		line, has = lines[idx]
+		if !has {
+			continue
+		} else if len(packedLines[line]) == 0 {
+			versions = append(versions, line)
+		}
+
+		packedLines[line] = append(packedLines[line], idx)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		var ci int = len(packedLines[versions[i]])
+		var cj int = len(packedLines[versions[j]])
+
+		if ci != cj {
+			return ci > cj
+		}
+
+		return versions[i] < versions[j]
+	})
+
+	format = this.computeFormat()
+	max = len(this.Processes)
+
+	for _, line = range versions {
+		indices = packedLines[line]
+
+		if len(indices) == max {
+			marker = "*"
+		} else {
+			marker = " "
+		}
+
+		if this.ShowDivergent && (len(indices) < max) {
+			line = "(" + this.instanceNames(indices) + ") " + line
+		}
+
+		to.WriteString(fmt.Sprintf(format, marker, len(indices), max,
+			line))
+	}
+}
+
+// Print a notice for the instances with the given indices which closed their
+// stream while other instances are still emitting lines.
+//
+func (this *ReaderTransmitterMergeParallel) transmitEnded(indices []int,
+	to *os.File) {
+	to.WriteString(fmt.Sprintf(this.computeFormat(), "-", len(indices),
+		len(this.Processes), "end of output: "+
+			this.instanceNames(indices)+"\n"))
+}
+
+// A line read by a ReaderTransmitterMergeParallel.
+// A line with has = false indicates the end of the stream of the process.
+//
+type mergeEvent struct {
+	process int    // index of the emitting process
+	line    string // the line emitted
+	has     bool   // false if the stream is closed
+}
+
+// The lines of a given sequence number not printed yet.
+//
+type mergeRow struct {
+	lines map[int]string // lines indexed by emitting process
+	since time.Time      // arrival of the oldest line not printed
+}
+
+// The state of a ReaderTransmitterMergeParallel in progress.
+//
+type mergeState struct {
+	rows     []*mergeRow // rows indexed by sequence number
+	counts   []int       // number of lines emitted by each process
+	closed   []bool      // processes with a closed stream
+	notified []bool      // processes with an end of output printed
+	next     int         // first row with lines to print or to expect
+}
+
+// Create a new mergeState for the given number of processes.
+//
+func newMergeState(size int) *mergeState {
+	var this mergeState
+
+	this.rows = make([]*mergeRow, 0)
+	this.counts = make([]int, size)
+	this.closed = make([]bool, size)
+	this.notified = make([]bool, size)
+	this.next = 0
+
+	return &this
+}
+
+// Record the given event received at the given date.
+//
+func (this *mergeState) receive(event mergeEvent, now time.Time) {
+	var row *mergeRow
+	var seq int
+
+	if !event.has {
+		this.closed[event.process] = true
+		return
+	}
+
+	seq = this.counts[event.process]
+	this.counts[event.process] += 1
+
+	if seq == len(this.rows) {
+		this.rows = append(this.rows, &mergeRow{
+			lines: make(map[int]string),
+		})
+	}
+
+	row = this.rows[seq]
+	if len(row.lines) == 0 {
+		row.since = now
+	}
+
+	row.lines[event.process] = event.line
+}
+
+// Indicate if the given process may still emit the line with the given
+// sequence number.
+//
+func (this *mergeState) expects(process, seq int) bool {
+	return !this.closed[process] && (this.counts[process] <= seq)
+}
+
+// Return the processes which closed their stream right before the line with
+// the given sequence number and which are not notified yet, then mark them as
+// notified.
+//
+func (this *mergeState) ended(seq int) []int {
+	var indices []int = make([]int, 0)
+	var idx int
+
+	for idx = range this.counts {
+		if this.closed[idx] && !this.notified[idx] &&
+			(this.counts[idx] == seq) {
+			this.notified[idx] = true
+			indices = append(indices, idx)
+		}
+	}
+
+	return indices
+}
+
+// Print the rows of the given state which are complete or which waited for
+// longer than the time window at the given date.
+// The rows are printed in sequence order: a row waiting for a slow process
+// holds the next rows until it is printed.
+//
+func (this *ReaderTransmitterMergeParallel) flush(state *mergeState,
+	now time.Time, to *os.File) {
+	var waiting bool
+	var ended []int
+	var row *mergeRow
+	var seq, idx int
+
+	for seq = state.next; seq < len(state.rows); seq++ {
+		ended = state.ended(seq)
+		if len(ended) > 0 {
+			this.transmitEnded(ended, to)
+		}
+
+		row = state.rows[seq]
+		if len(row.lines) == 0 {
+			continue
+		}
+
+		waiting = false
+		for idx = range this.Processes {
+			if state.expects(idx, seq) {
+				waiting = true
+				break
+			}
+		}
+
+		if waiting && (now.Sub(row.since) < this.Window) {
+			break
+		}
+
+		this.transmitFormatted(row.lines, to)
+		row.lines = make(map[int]string)
+	}
+
+	for state.next < len(state.rows) {
+		if len(state.rows[state.next].lines) > 0 {
+			return
+		}
+
+		for idx = range this.Processes {
+			if state.expects(idx, state.next) {
+				return
+			}
+		}
+
+		state.rows[state.next] = nil
+		state.next += 1
+	}
+}
+
+// Transmit all the lines of the related processes merged with occurence count
+// displayed.
+// The Window must be strictly positive.
+//
+func (this *ReaderTransmitterMergeParallel) Transmit(to *os.File) {
+	var events chan mergeEvent = make(chan mergeEvent)
+	var state *mergeState = newMergeState(len(this.Processes))
+	var ticker *time.Ticker
+	var event mergeEvent
+	var idx, open int
+
+	for idx = range this.Processes {
+		go func(i int) {
+			var line string
+			var has bool
+
+			for {
+				line, has = readProcessStream(this.Processes[i],
+					this.Mode)
+
+				events <- mergeEvent{process: i, line: line,
+					has: has}
+
+				if !has {
+					break
+				}
+			}
+		}(idx)
+	}
+
+	ticker = time.NewTicker(this.Window / 2)
+	defer ticker.Stop()
+
+	for open = len(this.Processes); open > 0; {
+		select {
+		case event = <-events:
+			state.receive(event, time.Now())
+			if !event.has {
+				open -= 1
+			}
+		case <-ticker.C:
+		}
+
+		this.flush(state, time.Now(), to)
+	}
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Ssh process execution related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// Return the processes, among the specified ones, to which the given line of
+// this process stdin is transmitted in the given stdin-mode.
+// The line has the given sequence number in this process stdin.
+//
+func stdinTargets(processes []*Process, mode, line string, seq int) []*Process {
+	var digest hash.Hash32
+
+	if len(processes) == 0 {
+		return processes
+	} else if mode == "split" {
+		return processes[(seq % len(processes)):][:1]
+	} else if mode == "hash" {
+		digest = fnv.New32a()
+		digest.Write([]byte(strings.TrimSuffix(line, "\n")))
+		return processes[(digest.Sum32() % uint32(len(processes))):][:1]
+	} else if mode == "none" {
+		return processes[:0]
+	} else {
+		return processes
+	}
+}
+
+// Read on this process stdin and transmit each line to the specified
+// processes according to the given stdin-mode.
+// Once this process stdin closes, then close all the processes stdin.
+// In 'none' stdin-mode, this process stdin is not read and the processes
+// stdin are closed immediately.
+//
+func taskTransmitStdin(processes []*Process, mode string) {
+	var reader *bufio.Reader = bufio.NewReader(os.Stdin)
+	var process *Process
+	var line string
+	var seq int
+	var err error
+
+	for seq = 0; mode != "none"; seq++ {
+		line, err = reader.ReadString('\n')
+
+		if line != "" {
+			for _, process = range stdinTargets(processes, mode,
+				line, seq) {
+				process.WriteStdin(line)
+			}
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	for _, process = range processes {
+		process.CloseStdin()
+	}
+}
+
+// Read the given file and transmit each line to the specified process.
+// Once the whole file is read, close the file and the process stdin.
+//
+func taskTransmitFileStdin(process *Process, file *os.File) {
+	var reader *bufio.Reader = bufio.NewReader(file)
+	var line string
+	var err error
+
+	for {
+		line, err = reader.ReadString('\n')
+
+		if line != "" {
+			process.WriteStdin(line)
+		}
+
+		if err != nil {
+			break
+		}
+	}
+
+	file.Close()
+	process.CloseStdin()
+}
+
+// Open the stdin file of each instance of the given selection, given by the
+// specified pattern formatted for the instance.
+// Return nil if the pattern is empty. Exit with an error if a file cannot be
+// opened.
+//
+func openStdinFiles(instances *Ec2Selection, pattern string) []*os.File {
+	var files []*os.File
+	var instance *Ec2Instance
+	var path string
+	var i int
+	var err error
+
+	if pattern == "" {
+		return nil
+	}
+
+	files = make([]*os.File, len(instances.Instances))
+
+	for i, instance = range instances.Instances {
+		path = Format(pattern, instance)
+
+		files[i], err = os.Open(path)
+		if err != nil {
+			Error("cannot open stdin file for instance %s: %s",
+				instance.Name, err.Error())
+		}
+	}
+
+	return files
+}
+
+// Collect the exit status of all the specified processes and return the max
+// of them.
+// If a process has an exit status less than 0 or greater than 255, it is
+// considered as 255.
+//
+func collectExitEagerGreatest(processes []*Process) int {
+	var process *Process
+	var tmp, max int
+
+	max = 0
+
+	for _, process = range processes {
+		process.WaitFinished()
+
+		tmp, _ = process.ExitCode()
+		if (tmp < 0) || (tmp > 255) {
+			tmp = 255
+		}
+
+		if tmp > max {
+			max = tmp
+		}
+	}
+
+	return max
+}
+
+// Return the exit status of the given finished process.
+// If the process has an exit status less than 0 or greater than 255, it is
+// considered as 255.
+//
+func boundedExitCode(process *Process) int {
+	var code int
+
+	process.WaitFinished()
+
+	code, _ = process.ExitCode()
+	if (code < 0) || (code > 255) {
+		code = 255
+	}
+
+	return code
+}
+
+// Collect the exit status of all the specified processes and return 0 if at
+// least the given number of them exit successfully, 1 otherwise.
+//
+func collectExitCountZero(processes []*Process, required int) int {
+	var process *Process
+	var count int
+
+	for _, process = range processes {
+		if boundedExitCode(process) == 0 {
+			count += 1
+		}
+	}
+
+	if count >= required {
+		return 0
+	} else {
+		return 1
+	}
+}
+
+// Print a table of the exit status of the given processes, related to the
+// specified instances, on the stderr.
+// Only the given number of first processes have been started by the given
+// schedule.
+//
+func reportExitStatus(instances []*Ec2Instance, processes []*Process, started int, schedule *Schedule) {
+	var instanceWidth, fleetWidth, i int
+	var instance *Ec2Instance
+	var format, status string
+
+	instanceWidth = len("instance")
+	fleetWidth = len("fleet")
+
+	for _, instance = range instances {
+		if len(instance.Name) > instanceWidth {
+			instanceWidth = len(instance.Name)
+		}
+		if len(instance.Fleet.Name) > fleetWidth {
+			fleetWidth = len(instance.Fleet.Name)
+		}
+	}
+
+	format = fmt.Sprintf("%%-%ds  %%-%ds  %%s\n", instanceWidth,
+		fleetWidth)
+
+	fmt.Fprintf(os.Stderr, format, "instance", "fleet", "exit")
+
+	for i, instance = range instances {
+		if schedule.Expired(i) {
+			boundedExitCode(processes[i])
+			status = "timeout"
+		} else if i < started {
+			status = fmt.Sprintf("%d", boundedExitCode(processes[i]))
+		} else {
+			status = "not started"
+		}
+
+		fmt.Fprintf(os.Stderr, format, instance.Name,
+			instance.Fleet.Name, status)
+	}
+}
+
+// Collect the exit status of the given processes, related to the specified
+// instances, according to the '--exit-mode' option.
+// Only the given number of first processes have been started by the given
+// schedule.
+//
+func collectExit(instances []*Ec2Instance, processes []*Process, started int, schedule *Schedule) int {
+	if *optionExtmode == "fail-fast" {
+		if schedule.Failure() == nil {
+			return 0
+		}
+
+		return boundedExitCode(schedule.Failure())
+	} else if *optionExtmode == "all-zero" {
+		return collectExitCountZero(processes, len(processes))
+	} else if *optionExtmode == "any-zero" {
+		return collectExitCountZero(processes, 1)
+	} else if *optionExtmode == "majority" {
+		return collectExitCountZero(processes, len(processes)/2+1)
+	} else if *optionExtmode == "report" {
+		reportExitStatus(instances, processes, started, schedule)
+	}
+
+	return collectExitEagerGreatest(processes[:started])
+}
+
+// A policy to start a set of processes.
+// The processes are started in batches of Batch processes, each batch starting
+// Pause seconds after the end of the previous one. Inside a batch, at most
+// Parallel processes run at the same time.
+// If StopOnFailure is true, no process is started after a process failed.
+// If KillOnFailure is true, the running processes are also killed.
+// A process running for more than Timeout seconds is killed.
+// Once the schedule is interrupted, no process is started anymore.
+// A zero Batch, Parallel or Timeout means no limit.
+// The processes are killed with Kill, given their index, or with
+// Process.Kill() if Kill is nil.
+//
+type Schedule struct {
+	Parallel      int             // maximum number of running processes
+	Batch         int             // number of processes per batch
+	Pause         int             // seconds to wait between two batches
+	StopOnFailure bool            // stop to start processes after a failure
+	KillOnFailure bool            // kill the running processes after a failure
+	Timeout       int             // seconds before to kill a process
+	Kill          func(index int) // how to kill a process
+	failure       *Process        // first process which failed or nil
+	started       []bool          // processes started
+	expired       []bool          // processes killed after Timeout
+	interrupted   bool            // no more process to start
+	interrupt     chan bool       // closed once interrupted
+	lock          sync.Mutex      // protect the fields above
+}
+
+// Indicate if the given finished process failed.
+//
+func processFailed(process *Process) bool {
+	var code int
+
+	code, _ = process.ExitCode()
+
+	return (code != 0)
+}
+
+// Kill the process with the given index among the given processes.
+//
+func (this *Schedule) kill(processes []*Process, index int) {
+	if this.Kill != nil {
+		this.Kill(index)
+	} else {
+		processes[index].Kill()
+	}
+}
+
+// Kill the process with the given index among the given processes because it
+// runs for longer than Timeout seconds, unless it is already finished.
+//
+func (this *Schedule) expire(processes []*Process, index int) {
+	var finished bool
+
+	_, finished = processes[index].ExitCode()
+	if finished {
+		return
+	}
+
+	this.lock.Lock()
+	this.expired[index] = true
+	this.lock.Unlock()
+
+	this.kill(processes, index)
+}
+
+// Start the process with the given index among the given processes and send
+// it on the given channel once it is finished.
+// Kill the process if it runs for longer than Timeout seconds.
+// Return false without starting the process if this schedule is interrupted.
+//
+func (this *Schedule) start(processes []*Process, index int,
+	finished chan *Process) bool {
+	var timer *time.Timer
+
+	this.lock.Lock()
+	if this.interrupted {
+		this.lock.Unlock()
+		return false
+	}
+	this.started[index] = true
+	this.lock.Unlock()
+
+	processes[index].Start()
+
+	if this.Timeout > 0 {
+		timer = time.AfterFunc(time.Duration(this.Timeout)*time.Second,
+			func() { this.expire(processes, index) })
+	}
+
+	go func() {
+		processes[index].WaitFinished()
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		finished <- processes[index]
+	}()
+
+	return true
+}
+
+// Indicate if the process with the given index has been started during the
+// last Schedule.Run().
+//
+func (this *Schedule) Started(index int) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return (index < len(this.started)) && this.started[index]
+}
+
+// Return a channel closed once this schedule is interrupted.
+// The lock must be held.
+//
+func (this *Schedule) interruption() chan bool {
+	if this.interrupt == nil {
+		this.interrupt = make(chan bool)
+	}
+
+	return this.interrupt
+}
+
+// Interrupt this schedule: do not start any process anymore and abort the
+// processes not started yet. The running processes are not affected.
+//
+func (this *Schedule) Interrupt() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !this.interrupted {
+		this.interrupted = true
+		close(this.interruption())
+	}
+}
+
+// Indicate if this schedule is interrupted.
+//
+func (this *Schedule) Interrupted() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.interrupted
+}
+
+// Indicate if the process with the given index has been killed during the
+// last Schedule.Run() because it ran for longer than Timeout seconds.
+//
+func (this *Schedule) Expired(index int) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return (index < len(this.expired)) && this.expired[index]
+}
+
+// Handle the end of the given process, among the given started processes.
+// Remember the first process which fails and kill the started processes if
+// KillOnFailure is true.
+// Return true if the process failed.
+//
+func (this *Schedule) finish(process *Process, started []*Process) bool {
+	var i int
+
+	if !processFailed(process) {
+		return false
+	}
+
+	if this.failure != nil {
+		return true
+	}
+
+	this.failure = process
+
+	if this.KillOnFailure {
+		for i = range started {
+			this.kill(started, i)
+		}
+	}
+
+	return true
+}
+
+// Return the first process which failed during the last Schedule.Run() or nil
+// if every process succeeded.
+//
+func (this *Schedule) Failure() *Process {
+	return this.failure
+}
+
+// Start the given processes in order, following this schedule.
+// The processes which are not started because of a failure or an interruption
+// are aborted with the given exit status.
+// Return when every process is finished or aborted, with the number of
+// aborted processes.
+//
+func (this *Schedule) Run(processes []*Process, abortStatus int) int {
+	var finished chan *Process = make(chan *Process, len(processes))
+	var parallel, batch, running, next, end, i int
+	var stop bool = this.StopOnFailure || this.KillOnFailure
+	var failed bool = false
+	var interrupt chan bool
+
+	this.failure = nil
+
+	this.lock.Lock()
+	this.started = make([]bool, len(processes))
+	this.expired = make([]bool, len(processes))
+	interrupt = this.interruption()
+	this.lock.Unlock()
+
+	parallel = this.Parallel
+	if parallel <= 0 {
+		parallel = len(processes)
+	}
+
+	batch = this.Batch
+	if batch <= 0 {
+		batch = len(processes)
+	}
+
+	for next = 0; next < len(processes); next = end {
+		if (next > 0) && (this.Pause > 0) {
+			select {
+			case <-time.After(time.Duration(this.Pause) *
+				time.Second):
+			case <-interrupt:
+			}
+		}
+
+		end = next + batch
+		if end > len(processes) {
+			end = len(processes)
+		}
+
+		for i = next; i < end; i++ {
+			for running >= parallel {
+				failed = this.finish(<-finished,
+					processes[:i]) || failed
+				running -= 1
+			}
+
+			if failed && stop {
+				break
+			} else if !this.start(processes, i, finished) {
+				break
+			}
+
+			running += 1
+		}
+
+		for running > 0 {
+			failed = this.finish(<-finished, processes[:i]) || failed
+			running -= 1
+		}
+
+		if (failed && stop) || this.Interrupted() {
+			end = i
+			break
+		}
+	}
+
+	for i = end; i < len(processes); i++ {
+		processes[i].Abort(abortStatus)
+	}
+
+	return len(processes) - end
+}
+
+// Split the given stream-mode into its name and its argument.
+// The argument follows the first ':' character of the mode, if any.
+//
+func splitStreamMode(mode string) (string, string) {
+	var parts []string = strings.SplitN(mode, ":", 2)
+
+	if len(parts) == 1 {
+		return parts[0], ""
+	} else {
+		return parts[0], parts[1]
+	}
+}
+
+// Create the ReaderTransmitter for the given stream-mode, the given instances
+// and processes and the stdout stream if mode is true or stderr otherwise.
+// Exit with an error if the transmitter cannot be created.
+//
+func newReaderTransmitter(streamMode string, instances *Ec2Selection,
+	processes []*Process, mode bool) ReaderTransmitter {
+	var transmitter *ReaderTransmitterTeeDir
+	var merge *ReaderTransmitterMergeParallel
+	var name, arg string
+	var err error
+
+	name, arg = splitStreamMode(streamMode)
+
+	if name == "all-prefix" {
+		return newReaderTransmitterAllPrefix(instances, processes,
+			mode)
+	} else if name == "merge-parallel" {
+		merge = newReaderTransmitterMergeParallel(instances, processes,
+			mode)
+		merge.ShowDivergent = sshShowDivergent
+		return merge
+	} else if name == "raw" {
+		return NewReaderTransmitterPrefixFormat(instances, processes,
+			"", mode)
+	} else if name == "group" {
+		return NewReaderTransmitterGroup(instances, processes, mode)
+	} else if name == "prefix-format" {
+		return NewReaderTransmitterPrefixFormat(instances, processes,
+			arg, mode)
+	} else if name == "tee-dir" {
+		transmitter, err = NewReaderTransmitterTeeDir(instances,
+			processes, arg, mode)
+		if err != nil {
+			Error("cannot create output file: %s", err.Error())
+		}
+
+		return transmitter
+	}
+
+	Error("unknown stream mode: '%s'", streamMode)
+	return nil
+}
+
+// Transmit the input and output streams of the given processes, related to
+// the specified instances.
+// The transmission occurs accoring to the '--output-mode', '--error-mode' and
+// '--stdin' options. If files are specified, the stdin of each process is
+// read from the file with the same index instead.
+// Return when there is nothing more to transmit from the processes stdout and
+// stderr.
+//
+func transmitStreams(instances *Ec2Selection, processes []*Process,
+	files []*os.File) {
+	var done chan bool = make(chan bool)
+	var outTransmit, errTransmit ReaderTransmitter
+	var i int
+
+	outTransmit = newReaderTransmitter(*optionOutmode, instances,
+		processes, true)
+	errTransmit = newReaderTransmitter(*optionErrmode, instances,
+		processes, false)
+
+	go func() {
+		outTransmit.Transmit(os.Stdout)
+		done <- true
+	}()
+
+	go func() {
+		errTransmit.Transmit(os.Stderr)
+		done <- true
+	}()
+
+	if files == nil {
+		go taskTransmitStdin(processes, *optionStdin)
+	} else {
+		for i = range processes {
+			go taskTransmitFileStdin(processes[i], files[i])
+		}
+	}
 
 	<-done
 	<-done
 }
 
+// Kill the remote command of the given running process, built by the given
+// builder, then kill the process itself if it is still running after
+// SSH_KILL_GRACE seconds.
+// If the builder is not killable, only kill the process.
+// Return immediately, the processes are killed in background.
+//
+func killSshProcess(builder *SshProcessBuilder, process *Process) {
+	var finished bool
+
+	_, finished = process.ExitCode()
+	if finished {
+		return
+	} else if !builder.IsKillable() {
+		process.Kill()
+		return
+	}
+
+	go func() {
+		var done chan bool = make(chan bool, 1)
+		var killer *Process
+
+		killer = builder.BuildRemoteKill("TERM")
+		killer.Start()
+		killer.CloseStdin()
+
+		go func() {
+			process.WaitFinished()
+			done <- true
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Duration(SSH_KILL_GRACE) * time.Second):
+			process.Kill()
+		}
+	}()
+}
+
+// The handling of the SIGINT and SIGTERM signals received while ssh processes
+// run on the instances.
+// On the first signal, no more process is started and the signal is sent to
+// the remote command of the running processes which can then end gracefully.
+// On the next signals, the remote commands and the local processes are killed
+// immediately.
+// The processes built by a builder which is not killable are killed on the
+// first signal.
+//
+type SshInterrupt struct {
+	Builders    []*SshProcessBuilder // builders of the processes
+	Processes   []*Process           // processes to interrupt
+	Schedule    *Schedule            // schedule starting the processes or nil
+	signal      os.Signal            // first signal received or nil
+	signals     chan os.Signal       // signals to handle once watched
+	interrupted []bool               // processes running at first signal
+	killers     []*Process           // processes sending remote signals
+	lock        sync.Mutex           // protect the fields above
+}
+
+// Create a new SshInterrupt for the given processes built by the given
+// builders and started by the given schedule, or nil if they are
+// all started already.
+//
+func NewSshInterrupt(builders []*SshProcessBuilder, processes []*Process,
+	schedule *Schedule) *SshInterrupt {
+	var this SshInterrupt
+
+	this.Builders = builders
+	this.Processes = processes
+	this.Schedule = schedule
+	this.signal = nil
+	this.interrupted = make([]bool, len(processes))
+	this.killers = make([]*Process, 0)
+
+	return &this
+}
+
+// Send the given signal to the remote command of the process with the given
+// index, or kill the process if its builder is not killable.
+// The lock must be held.
+//
+func (this *SshInterrupt) sendRemote(index int, signal string) {
+	var killer *Process
+
+	if !this.Builders[index].IsKillable() {
+		this.Processes[index].Kill()
+		return
+	}
+
+	killer = this.Builders[index].BuildRemoteKill(signal)
+	killer.Start()
+	killer.CloseStdin()
+
+	this.killers = append(this.killers, killer)
+}
+
+// Handle the given signal.
+//
+func (this *SshInterrupt) handle(sig os.Signal) {
+	var finished bool
+	var name string
+	var i int
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.signal != nil {
+		Warning("killing the command on every instances")
+
+		for i = range this.Processes {
+			if !this.interrupted[i] {
+				continue
+			}
+
+			_, finished = this.Processes[i].ExitCode()
+			if !finished {
+				this.sendRemote(i, "KILL")
+				this.Processes[i].Kill()
+			}
+		}
+
+		return
+	}
+
+	this.signal = sig
+
+	if this.Schedule != nil {
+		this.Schedule.Interrupt()
+	}
+
+	if sig == syscall.SIGTERM {
+		name = "TERM"
+	} else {
+		name = "INT"
+	}
+
+	Warning("interrupting the command, interrupt again to kill it")
+
+	for i = range this.Processes {
+		if (this.Schedule != nil) && !this.Schedule.Started(i) {
+			continue
+		}
+
+		_, finished = this.Processes[i].ExitCode()
+		if !finished {
+			this.interrupted[i] = true
+			this.sendRemote(i, name)
+		}
+	}
+}
+
+// Handle in background the SIGINT and SIGTERM signals received by this
+// process.
+//
+func (this *SshInterrupt) Watch() {
+	this.signals = make(chan os.Signal, 2)
+
+	signal.Notify(this.signals, os.Interrupt, syscall.SIGTERM)
+
+	go func(signals chan os.Signal) {
+		var sig os.Signal
+
+		for sig = range signals {
+			this.handle(sig)
+		}
+	}(this.signals)
+}
+
+// Stop handling the signals watched by SshInterrupt.Watch(), so they get
+// their default behavior back.
+//
+func (this *SshInterrupt) Stop() {
+	signal.Stop(this.signals)
+	close(this.signals)
+}
+
+// Return the first signal received or nil if the processes have not been
+// interrupted.
+//
+func (this *SshInterrupt) Signal() os.Signal {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.signal
+}
+
+// Indicate if the process with the given index was running when the first
+// signal has been received.
+//
+func (this *SshInterrupt) Interrupted(index int) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	return this.interrupted[index]
+}
+
+// Wait for the remote signals to be sent.
+//
+func (this *SshInterrupt) WaitKillers() {
+	var killers []*Process
+	var killer *Process
+
+	this.lock.Lock()
+	killers = this.killers
+	this.lock.Unlock()
+
+	for _, killer = range killers {
+		killer.WaitFinished()
+	}
+}
+
+// The connection settings shared by the ssh processes of a command.
+//
+type sshConnector struct {
+	command    []string            // ssh command
+	user       string              // custom user name or empty
+	verbose    bool                // print the ssh debug messages
+	control    *SshControl         // connection multiplexing or nil
+	knownHosts *KnownHosts         // host keys of the context
+	transport  *NativeSshTransport // native transport or nil
+}
+
+// Create a new sshConnector for the context with the given path, with the
+// given '--control-persist', '--transport' and '--native-concurrency' option
+// values, the given custom ssh command and user name, both ignored if empty,
+// and printing the ssh debug messages if verbose is true.
+//
+func newSshConnector(contextPath, persist, transport string, concurrency int,
+	command, user string, verbose bool) *sshConnector {
+	var this sshConnector
+
+	if command != "" {
+		this.command = strings.Split(command, " ")
+	} else {
+		this.command = []string{"ssh"}
+	}
+
+	this.user = user
+	this.verbose = verbose
+	this.knownHosts = NewKnownHosts(contextPath)
+	this.control = OpenSshControl(contextPath, persist)
+
+	if transport == TRANSPORT_NATIVE {
+		this.transport = OpenNativeSshTransport(this.knownHosts,
+			concurrency)
+	}
+
+	return &this
+}
+
+// Create a new sshConnector according to the options of the ssh and run
+// commands.
+//
+func newOptionSshConnector() *sshConnector {
+	return newSshConnector(*optionContext, *optionControlPersist,
+		*optionTransport, *optionNativeConcurrency, *optionCommand,
+		*optionUser, *optionVerbose)
+}
+
+// Return an SshProcessBuilder running the given command line on the given
+// instance with the settings of this connector.
+//
+func (this *sshConnector) Builder(instance *Ec2Instance, cmdline []string) *SshProcessBuilder {
+	return this.BuilderOptions(instance, []string{}, cmdline)
+}
+
+// Return an SshProcessBuilder running the given command line on the given
+// instance with the settings of this connector and the given additional ssh
+// options.
+//
+func (this *sshConnector) BuilderOptions(instance *Ec2Instance, options, cmdline []string) *SshProcessBuilder {
+	var builder *SshProcessBuilder
+	var sshcmd []string
+
+	sshcmd = append(append([]string{}, this.command...), options...)
+	builder = BuildCustomSshProcess(instance, sshcmd, cmdline)
+
+	if this.user != "" {
+		builder.User(this.user)
+	}
+	if this.verbose {
+		builder.Verbose()
+	}
+	if this.control != nil {
+		builder.Control(this.control)
+	}
+	builder.KnownHosts(this.knownHosts)
+	if this.transport != nil {
+		builder.Native(this.transport)
+	}
+
+	return builder
+}
+
 // Execute the given command line on the instances of the given selection
 // through ssh.
 // This function never return but instead exit with the maximum exit code
 // among the launched ssh processes.
 //
 func doSsh(instances *Ec2Selection, cmdline []string) {
-	var processes []*Process = make([]*Process, len(instances.Instances))
-	var builder *SshProcessBuilder
+	var cmdlines [][]string = make([][]string, len(instances.Instances))
 	var instance *Ec2Instance
-	var cmdargs []string
 	var cmdarg string
 	var i, j int
 
 	for i, instance = range instances.Instances {
 		if *optionFormat {
-			cmdargs = make([]string, len(cmdline))
+			cmdlines[i] = make([]string, len(cmdline))
 			for j, cmdarg = range cmdline {
-				cmdargs[j] = Format(cmdarg, instance)
+				cmdlines[i][j] = Format(cmdarg, instance)
 			}
 		} else {
-			cmdargs = cmdline
+			cmdlines[i] = cmdline
 		}
+	}
 
-		if *optionCommand != "" {
-			builder = BuildCustomSshProcess(instance,
-				strings.Split(*optionCommand, " "), cmdargs)
-		} else {
-			builder = BuildSshProcess(instance, cmdargs)
-		}
+	runSsh(instances, newOptionSshConnector(), cmdlines, nil)
+}
+
+// Indicate if the local ssh processes can run in their own process group,
+// which prevents them from prompting.
+// This is the case when the keys can be found in an ssh agent, or when the
+// standard input is not a terminal so there is probably nobody to answer.
+//
+func canIsolateSsh() bool {
+	return (os.Getenv("SSH_AUTH_SOCK") != "") || !IsTerminal(os.Stdin)
+}
+
+// Run the given command lines on the instances with the same index in the
+// given selection through the given connector, according to the ssh options.
+// If inputs is not nil, the string with the same index is written on the
+// stdin of each process, before the stdin transmitted by transmitStreams().
+// This function never returns.
+//
+func runSsh(instances *Ec2Selection, connector *sshConnector,
+	cmdlines [][]string, inputs []string) {
+	var processes []*Process = make([]*Process, len(instances.Instances))
+	var builders []*SshProcessBuilder
+	var interrupt *SshInterrupt
+	var builder *SshProcessBuilder
+	var instance *Ec2Instance
+	var aborted chan int = make(chan int)
+	var isolate bool = canIsolateSsh()
+	var killable bool
+	var files []*os.File
+	var i, skipped int
+
+	killable = (sshSchedule.Timeout > 0) || sshSchedule.KillOnFailure
 
-		if *optionUser != "" {
-			builder.User(*optionUser)
+	files = openStdinFiles(instances, *optionStdinFile)
+	builders = make([]*SshProcessBuilder, len(instances.Instances))
+
+	for i, instance = range instances.Instances {
+		builder = connector.Builder(instance, cmdlines[i])
+		if killable {
+			builder.Killable()
 		}
-		if *optionVerbose {
-			builder.Verbose()
+		if isolate {
+			builder.Isolate()
 		}
 
+		builders[i] = builder
 		processes[i] = builder.Build()
+
+		if inputs != nil {
+			processes[i].WriteStdin(inputs[i])
+		}
+	}
+
+	sshSchedule.Kill = func(index int) {
+		killSshProcess(builders[index], processes[index])
 	}
 
-	for i, _ = range processes {
-		processes[i].Start()
+	interrupt = NewSshInterrupt(builders, processes, &sshSchedule)
+	interrupt.Watch()
+
+	go func() {
+		aborted <- sshSchedule.Run(processes, SSH_ABORTED_STATUS)
+	}()
+
+	transmitStreams(instances, processes, files)
+
+	skipped = <-aborted
+	interrupt.WaitKillers()
+
+	if (skipped > 0) && (interrupt.Signal() != nil) {
+		Warning("command not started on %d instances after an "+
+			"interruption", skipped)
+	} else if skipped > 0 {
+		Warning("command not started on %d instances after a failure",
+			skipped)
+	}
+
+	for i, instance = range instances.Instances {
+		if sshSchedule.Expired(i) {
+			Warning("command timed out on instance %s",
+				instance.Name)
+		} else if interrupt.Interrupted(i) {
+			Warning("command interrupted on instance %s",
+				instance.Name)
+		}
 	}
 
-	transmitStreams(instances, processes)
+	if interrupt.Signal() != nil {
+		os.Exit(128 + int(interrupt.Signal().(syscall.Signal)))
+	}
 
-	os.Exit(collectExitEagerGreatest(processes))
+	os.Exit(collectExit(instances.Instances, processes,
+		len(processes)-skipped, &sshSchedule))
 }
 
 // - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
 
 func checkStreamMode(mode string) bool {
-	if mode == "all-prefix" {
+	var name, arg string
+
+	name, arg = splitStreamMode(mode)
+
+	if (name == "prefix-format") || (name == "tee-dir") {
+		return (arg != "")
+	} else if arg != "" {
+		return false
+	} else if mode == "all-prefix" {
 		return true
 	} else if mode == "merge-parallel" {
 		return true
+	} else if mode == "raw" {
+		return true
+	} else if mode == "group" {
+		return true
 	} else {
 		return false
 	}
 }
 
+// Check that the given stream-modes do not write the same files for different
+// instances of the given selection.
+//
+func checkStreamFiles(instances *Ec2Selection, modes []string) {
+	var paths map[string]*Ec2Instance = make(map[string]*Ec2Instance)
+	var instance, other *Ec2Instance
+	var name, arg, mode, path string
+	var found bool
+
+	for _, mode = range modes {
+		name, arg = splitStreamMode(mode)
+		if name != "tee-dir" {
+			continue
+		}
+
+		for _, instance = range instances.Instances {
+			path = filepath.Clean(Format(arg, instance))
+
+			other, found = paths[path]
+			if found && (other != instance) {
+				Error("conflicting tee-dir for instances %s "+
+					"and %s: '%s'", other.Name,
+					instance.Name, path)
+			}
+
+			paths[path] = instance
+		}
+	}
+}
+
 func checkExitMode(mode string) bool {
 	if mode == "eager-greatest" {
 		return true
+	} else if mode == "fail-fast" {
+		return true
+	} else if mode == "all-zero" {
+		return true
+	} else if mode == "any-zero" {
+		return true
+	} else if mode == "majority" {
+		return true
+	} else if mode == "report" {
+		return true
 	} else {
 		return false
 	}
 }
 
-func Ssh(args []string) {
-	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
-	var instances *Ec2Selection
-	var command []string
-	var specs []string
-	var hasSpecs bool
-	var ctx *Ec2Index
-	var arg string
-	var err error
+func checkStdinMode(mode string) bool {
+	if mode == "broadcast" {
+		return true
+	} else if mode == "split" {
+		return true
+	} else if mode == "hash" {
+		return true
+	} else if mode == "none" {
+		return true
+	} else {
+		return false
+	}
+}
+
+func processSshSchedule() {
+	var ok bool
+
+	if *optionParallel < 0 {
+		Error("invalid value for option --parallel: '%d'",
+			*optionParallel)
+	} else if *optionBatch < 0 {
+		Error("invalid value for option --batch: '%d'", *optionBatch)
+	}
+
+	if *optionTimeout == "none" {
+		sshSchedule.Timeout = 0
+	} else {
+		sshSchedule.Timeout, ok = ParseTimespec(*optionTimeout)
+		if !ok {
+			Error("invalid value for option --timeout: '%s'",
+				*optionTimeout)
+		}
+	}
 
+	sshSchedule.Parallel = *optionParallel
+	sshSchedule.Batch = *optionBatch
+	sshSchedule.StopOnFailure = *optionStopOnFailure
+	sshSchedule.KillOnFailure = (*optionExtmode == "fail-fast")
+
+	sshSchedule.Pause, ok = ParseTimespec(*optionPause)
+	if !ok {
+		Error("invalid value for option --pause: '%s'", *optionPause)
+	} else if (sshSchedule.Pause > 0) && (sshSchedule.Batch == 0) {
+		Error("option --pause requires option --batch")
+	}
+}
+
+// Define the options of the commands running programs through ssh on the
+// given flag set.
+//
+func registerSshOptions(flags *flag.FlagSet) {
 	optionCommand = flags.String("command", "", "")
 	optionContext = flags.String("context", DEFAULT_CONTEXT, "")
+	optionControlPersist = flags.String("control-persist", DEFAULT_CONTROL_PERSIST, "")
 	optionErrmode = flags.String("error-mode", DEFAULT_ERRMODE, "")
 	optionExtmode = flags.String("exit-mode", DEFAULT_EXTMODE, "")
 	optionFormat = flags.Bool("format", DEFAULT_FORMAT, "")
+	optionNativeConcurrency = flags.Int("native-concurrency", DEFAULT_NATIVE_CONCURRENCY, "")
 	optionOutmode = flags.String("output-mode", DEFAULT_OUTMODE, "")
-	optionTimeout = flags.Int64("timeout", DEFAULT_TIMEOUT, "")
+	optionTimeout = flags.String("timeout", DEFAULT_TIMEOUT, "")
+	optionTransport = flags.String("transport", DEFAULT_TRANSPORT, "")
 	optionUser = flags.String("user", "", "")
 	optionVerbose = flags.Bool("verbose", DEFAULT_VERBOSE, "")
+	optionParallel = flags.Int("parallel", DEFAULT_PARALLEL, "")
+	optionBatch = flags.Int("batch", DEFAULT_BATCH, "")
+	optionPause = flags.String("pause", DEFAULT_PAUSE, "")
+	optionStopOnFailure = flags.Bool("stop-on-failure", DEFAULT_STOP_ON_FAILURE, "")
+	optionShowDivergent = flags.Bool("show-divergent", DEFAULT_SHOW_DIVERGENT, "")
+	optionStdin = flags.String("stdin", DEFAULT_STDIN, "")
+	optionStdinFile = flags.String("stdin-file", DEFAULT_STDIN_FILE, "")
+}
 
-	flags.Parse(args[1:])
-	args = flags.Args()
+// Check the options defined by registerSshOptions() once parsed and configure
+// the ssh schedule accordingly.
+// Exit with an error if an option is invalid.
+//
+func processSshOptions() {
+	processSshSchedule()
 
-	if len(args) < 1 {
-		Error("missing instance-id operand")
+	sshShowDivergent = *optionShowDivergent
+
+	if !IsTransport(*optionTransport) {
+		Error("invalid transport: '%s'", *optionTransport)
+	} else if (*optionTransport == TRANSPORT_NATIVE) &&
+		(*optionCommand != "") {
+		Error("cannot use a custom command with the native transport")
+	}
+
+	if !checkStreamMode(*optionErrmode) {
+		Error("invalid stream-mode for stderr: '%s'", *optionErrmode)
+	} else if !checkExitMode(*optionExtmode) {
+		Error("invalid exit-mode: '%s'", *optionExtmode)
+	} else if !checkStreamMode(*optionOutmode) {
+		Error("invalid stream-mode for stdout: '%s'", *optionOutmode)
+	} else if !checkStdinMode(*optionStdin) {
+		Error("invalid stdin-mode: '%s'", *optionStdin)
+	} else if (*optionStdinFile != "") && (*optionStdin != DEFAULT_STDIN) {
+		Error("cannot use option --stdin with option --stdin-file")
 	}
+}
+
+// Split the given operands of the form '[ <instance-specs...> -- ] <cmd>
+// [ <args...> ]' and select the specified instances in the context given by
+// the '--context' option, or every instances if none is specified.
+// Return the selection and the remaining operands.
+// Exit with an error if the context cannot be loaded or if a specification is
+// invalid.
+//
+func selectSshOperands(args []string) (*Ec2Selection, []string) {
+	var instances *Ec2Selection
+	var command []string
+	var specs []string
+	var hasSpecs bool
+	var ctx *Ec2Index
+	var arg string
+	var err error
 
 	hasSpecs = false
 	for _, arg = range args {
@@ -614,14 +2419,6 @@ func Ssh(args []string) {
 		command = append(command, arg)
 	}
 
-	if !checkStreamMode(*optionErrmode) {
-		Error("invalid stream-mode for stderr: '%s'", *optionErrmode)
-	} else if !checkExitMode(*optionExtmode) {
-		Error("invalid exit-mode: '%s'", *optionExtmode)
-	} else if !checkStreamMode(*optionOutmode) {
-		Error("invalid stream-mode for stdout: '%s'", *optionOutmode)
-	}
-
 	ctx, err = LoadEc2Index(*optionContext)
 	if err != nil {
 		Error("no context: %s", *optionContext)
@@ -636,5 +2433,28 @@ func Ssh(args []string) {
 		}
 	}
 
+	return instances, command
+}
+
+func Ssh(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var instances *Ec2Selection
+	var command []string
+
+	registerSshOptions(flags)
+
+	flags.Parse(args[1:])
+	args = flags.Args()
+
+	if len(args) < 1 {
+		Error("missing instance-id operand")
+	}
+
+	processSshOptions()
+
+	instances, command = selectSshOperands(args)
+
+	checkStreamFiles(instances, []string{*optionOutmode, *optionErrmode})
+
 	doSsh(instances, command)
 }
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleRun(t *testing.T) {
+	var schedule Schedule = Schedule{Parallel: 2, Batch: 3}
+	var processes []*Process
+	var code, i int
+	var has bool
+
+	processes = []*Process{
+		NewProcess([]string{"true"}),
+		NewProcess([]string{"false"}),
+		NewProcess([]string{"true"}),
+		NewProcess([]string{"true"}),
+	}
+
+	if schedule.Run(processes, 255) != 0 {
+		t.FailNow()
+	}
+
+	for i = range processes {
+		code, has = processes[i].ExitCode()
+		if !has || ((code != 0) != (i == 1)) {
+			t.Fail()
+		}
+	}
+}
+
+func TestScheduleRunStopOnFailure(t *testing.T) {
+	var schedule Schedule = Schedule{Batch: 2, StopOnFailure: true}
+	var processes []*Process
+	var code int
+	var has bool
+
+	processes = []*Process{
+		NewProcess([]string{"true"}),
+		NewProcess([]string{"false"}),
+		NewProcess([]string{"true"}),
+		NewProcess([]string{"true"}),
+	}
+
+	if schedule.Run(processes, 255) != 2 {
+		t.FailNow()
+	}
+
+	code, has = processes[1].ExitCode()
+	if !has || (code != 1) {
+		t.Fail()
+	}
+
+	code, has = processes[3].ExitCode()
+	if !has || (code != 255) {
+		t.Fail()
+	}
+}
+
+func TestCollectExitCountZero(t *testing.T) {
+	var processes []*Process
+	var process *Process
+
+	processes = []*Process{
+		NewProcess([]string{"true"}),
+		NewProcess([]string{"false"}),
+		NewProcess([]string{"true"}),
+	}
+
+	for _, process = range processes {
+		process.Start()
+	}
+
+	if collectExitCountZero(processes, 3) != 1 {
+		t.Fail()
+	}
+
+	if collectExitCountZero(processes, 1) != 0 {
+		t.Fail()
+	}
+
+	if collectExitCountZero(processes, 2) != 0 {
+		t.Fail()
+	}
+}
+
+func TestScheduleRunKillOnFailure(t *testing.T) {
+	var schedule Schedule = Schedule{Parallel: 2, KillOnFailure: true}
+	var processes []*Process
+	var code int
+	var has bool
+
+	processes = []*Process{
+		NewProcess([]string{"sleep", "5"}),
+		NewProcess([]string{"sh", "-c", "exit 3"}),
+		NewProcess([]string{"true"}),
+	}
+
+	if schedule.Run(processes, 255) != 1 {
+		t.Fail()
+	}
+
+	if schedule.Failure() != processes[1] {
+		t.Fail()
+	}
+
+	code, has = processes[0].ExitCode()
+	if !has || (code == 0) {
+		t.Fail()
+	}
+
+	code, has = processes[2].ExitCode()
+	if !has || (code != 255) {
+		t.Fail()
+	}
+}
+
+func TestCheckStreamMode(t *testing.T) {
+	if !checkStreamMode("raw") || !checkStreamMode("group") {
+		t.Fail()
+	}
+
+	if !checkStreamMode("prefix-format:[%f/%d] ") {
+		t.Fail()
+	}
+
+	if checkStreamMode("prefix-format") || checkStreamMode("tee-dir:") {
+		t.Fail()
+	}
+
+	if checkStreamMode("raw:arg") || checkStreamMode("unknown") {
+		t.Fail()
+	}
+}
+
+func TestReaderTransmitterTeeDir(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet"}
+	var instances Ec2Selection
+	var transmitter *ReaderTransmitterTeeDir
+	var processes []*Process
+	var content []byte
+	var out *os.File
+	var dir string
+	var err error
+
+	instances.Instances = []*Ec2Instance{
+		&Ec2Instance{Name: "i-0", Fleet: &fleet},
+		&Ec2Instance{Name: "i-1", Fleet: &fleet},
+	}
+
+	processes = []*Process{
+		NewProcess([]string{"echo", "hello"}),
+		NewProcess([]string{"echo", "world"}),
+	}
+
+	dir, err = ioutil.TempDir("", "ec2tools-test")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	transmitter, err = NewReaderTransmitterTeeDir(&instances, processes,
+		filepath.Join(dir, "%n"), true)
+	if err != nil {
+		t.FailNow()
+	}
+
+	out, err = os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.FailNow()
+	}
+
+	processes[0].Start()
+	processes[1].Start()
+
+	transmitter.Transmit(out)
+	out.Close()
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "i-1", "stdout"))
+	if (err != nil) || (string(content) != "world\n") {
+		t.Fail()
+	}
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "out"))
+	if (err != nil) || (len(content) != len("[i-0] hello\n[i-1] world\n")) {
+		t.Fail()
+	}
+}
+
+func runMergeParallel(t *testing.T, transmitter *ReaderTransmitterMergeParallel) string {
+	var content []byte
+	var process *Process
+	var out *os.File
+	var dir string
+	var err error
+
+	dir, err = ioutil.TempDir("", "ec2tools-test")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+
+	out, err = os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		t.FailNow()
+	}
+
+	for _, process = range transmitter.Processes {
+		process.Start()
+	}
+
+	transmitter.Transmit(out)
+	out.Close()
+
+	content, err = ioutil.ReadFile(filepath.Join(dir, "out"))
+	if err != nil {
+		t.FailNow()
+	}
+
+	return string(content)
+}
+
+func TestReaderTransmitterMergeParallel(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet"}
+	var transmitter *ReaderTransmitterMergeParallel
+	var instances Ec2Selection
+
+	instances.Instances = []*Ec2Instance{
+		&Ec2Instance{Name: "i-0", Fleet: &fleet},
+		&Ec2Instance{Name: "i-1", Fleet: &fleet},
+		&Ec2Instance{Name: "i-2", Fleet: &fleet},
+	}
+
+	transmitter = NewReaderTransmitterMergeParallelStdout(&instances,
+		[]*Process{
+			NewProcess([]string{"printf", "a\\nc\\n"}),
+			NewProcess([]string{"printf", "a\\nb\\n"}),
+			NewProcess([]string{"printf", "a\\n"}),
+		})
+	transmitter.Window = 10 * time.Second
+	transmitter.ShowDivergent = true
+
+	if runMergeParallel(t, transmitter) != "*[3/3] a\n"+
+		"-[1/3] end of output: i-2\n"+
+		" [1/3] (i-1) b\n"+
+		" [1/3] (i-0) c\n" {
+		t.Fail()
+	}
+}
+
+func TestReaderTransmitterMergeParallelWindow(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet"}
+	var transmitter *ReaderTransmitterMergeParallel
+	var instances Ec2Selection
+
+	instances.Instances = []*Ec2Instance{
+		&Ec2Instance{Name: "i-0", Fleet: &fleet},
+		&Ec2Instance{Name: "i-1", Fleet: &fleet},
+	}
+
+	transmitter = NewReaderTransmitterMergeParallelStdout(&instances,
+		[]*Process{
+			NewProcess([]string{"sh", "-c", "sleep 1 ; echo a"}),
+			NewProcess([]string{"echo", "a"}),
+		})
+	transmitter.Window = 50 * time.Millisecond
+
+	if runMergeParallel(t, transmitter) != " [1/2] a\n [1/2] a\n" {
+		t.Fail()
+	}
+}
+
+func TestStdinTargets(t *testing.T) {
+	var processes []*Process
+	var targets []*Process
+	var seq int
+
+	processes = []*Process{
+		NewProcess([]string{"true"}),
+		NewProcess([]string{"true"}),
+		NewProcess([]string{"true"}),
+	}
+
+	if len(stdinTargets(processes, "broadcast", "a\n", 0)) != 3 {
+		t.Fail()
+	}
+
+	if len(stdinTargets(processes, "none", "a\n", 0)) != 0 {
+		t.Fail()
+	}
+
+	for seq = 0; seq < 6; seq++ {
+		targets = stdinTargets(processes, "split", "a\n", seq)
+		if (len(targets) != 1) || (targets[0] != processes[seq%3]) {
+			t.Fail()
+		}
+	}
+
+	targets = stdinTargets(processes, "hash", "a\n", 0)
+	if len(targets) != 1 {
+		t.FailNow()
+	}
+
+	for seq = 1; seq < 6; seq++ {
+		if stdinTargets(processes, "hash", "a", seq)[0] != targets[0] {
+			t.Fail()
+		}
+	}
+}
+
+func TestScheduleRunTimeout(t *testing.T) {
+	var schedule Schedule = Schedule{Timeout: 1}
+	var processes []*Process
+	var code int
+	var has bool
+
+	processes = []*Process{
+		NewProcess([]string{"sleep", "10"}),
+		NewProcess([]string{"true"}),
+	}
+
+	if schedule.Run(processes, 255) != 0 {
+		t.Fail()
+	}
+
+	code, has = processes[0].ExitCode()
+	if !has || (code == 0) || !schedule.Expired(0) {
+		t.Fail()
+	}
+
+	code, has = processes[1].ExitCode()
+	if !has || (code != 0) || schedule.Expired(1) {
+		t.Fail()
+	}
+}
+
+func TestScheduleInterrupt(t *testing.T) {
+	var schedule Schedule = Schedule{Parallel: 1}
+	var processes []*Process
+
+	processes = []*Process{
+		NewProcess([]string{"sleep", "1"}),
+		NewProcess([]string{"true"}),
+		NewProcess([]string{"true"}),
+	}
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		schedule.Interrupt()
+	}()
+
+	if schedule.Run(processes, 255) != 2 {
+		t.Fail()
+	}
+
+	if !schedule.Started(0) || schedule.Started(1) ||
+		!schedule.Interrupted() {
+		t.Fail()
+	}
+}
+
+func TestSshProcessBuilderCmdline(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet", User: "ec2-user"}
+	var instance Ec2Instance = Ec2Instance{Name: "i-0", Fleet: &fleet,
+		PublicIp: "10.0.0.1"}
+	var builder *SshProcessBuilder
+	var cmdline []string
+
+	builder = BuildSshProcess(&instance, []string{"uname", "-a"})
+	builder.Tty()
+
+	cmdline = builder.Cmdline()
+	if (len(cmdline) < 5) || (cmdline[0] != "ssh") ||
+		(cmdline[len(cmdline)-4] != "-t") ||
+		(cmdline[len(cmdline)-3] != "ec2-user@10.0.0.1") ||
+		(cmdline[len(cmdline)-2] != "uname") {
+		t.Fail()
+	}
+
+	builder.User("admin")
+
+	cmdline = builder.Cmdline()
+	if cmdline[len(cmdline)-3] != "admin@10.0.0.1" {
+		t.Fail()
+	}
+}
+
+func TestSshProcessBuilderIsolate(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet", User: "ec2-user"}
+	var instance Ec2Instance = Ec2Instance{Name: "i-0", Fleet: &fleet,
+		PublicIp: "10.0.0.1"}
+	var builder *SshProcessBuilder
+
+	builder = BuildSshProcess(&instance, []string{"true"})
+	if strings.Contains(strings.Join(builder.Cmdline(), " "),
+		"BatchMode") {
+		t.Fail()
+	}
+
+	builder.Isolate()
+	if !strings.Contains(strings.Join(builder.Cmdline(), " "),
+		"-o BatchMode=yes") {
+		t.Fail()
+	}
+
+	builder = BuildCustomSshProcess(&instance, []string{"my-ssh"},
+		[]string{"true"})
+	builder.Isolate()
+	if strings.Contains(strings.Join(builder.Cmdline(), " "),
+		"BatchMode") {
+		t.Fail()
+	}
+}
+
+func TestSshProcessBuilderKillable(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet", User: "ec2-user"}
+	var instance Ec2Instance = Ec2Instance{Name: "i-0", Fleet: &fleet,
+		PublicIp: "10.0.0.1"}
+	var builder *SshProcessBuilder
+	var cmdline []string
+
+	builder = BuildSshProcess(&instance, []string{"true"})
+	cmdline = builder.Cmdline()
+	if builder.IsKillable() || (cmdline[len(cmdline)-2] !=
+		"ec2-user@10.0.0.1") {
+		t.Fail()
+	}
+
+	builder.Killable()
+	cmdline = builder.Cmdline()
+	if !builder.IsKillable() ||
+		!strings.HasPrefix(cmdline[len(cmdline)-7], "trap ") {
+		t.Fail()
+	}
+}
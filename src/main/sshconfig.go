@@ -0,0 +1,322 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type sshConfigParameters struct {
+	OptionAlias          *string
+	OptionAuto           *bool
+	OptionContext        *string
+	OptionControlPersist *string
+	OptionIdentityFile   *string
+	OptionNoAuto         *bool
+	OptionOutput         *string
+	OptionUser           *string
+}
+
+var DEFAULT_SSH_CONFIG_ALIAS string = "%f-%d"
+var DEFAULT_SSH_CONFIG_AUTO bool = false
+var DEFAULT_SSH_CONFIG_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_SSH_CONFIG_CONTROL_PERSIST string = CONTROL_PERSIST_NONE
+var DEFAULT_SSH_CONFIG_IDENTITY_FILE string = ""
+var DEFAULT_SSH_CONFIG_NO_AUTO bool = false
+var DEFAULT_SSH_CONFIG_OUTPUT string = "-"
+var DEFAULT_SSH_CONFIG_USER string = ""
+
+var sshConfigParams sshConfigParameters
+
+func PrintSshConfigUsage() {
+	fmt.Printf(`Usage: %s ssh-config [options] [<instance-specs...>]
+
+Print an OpenSSH configuration with a Host entry for each of the specified
+instances, so other tools using ssh can reach them by an alias.
+If no instance is specified, then print an entry for every instances.
+Each entry gives the public IP of the instance, the user of its fleet and the
+options '%s ssh' uses to check the host keys.
+The output file can be included in '~/.ssh/config' with an 'Include' line.
+
+Options:
+
+  --alias <pattern>           alias of each instance, formatted for the
+                              instance (see '%s help get') (default: '%s')
+
+  --auto                      record the options in the context so the output
+                              file is written again each time the context
+                              changes, for instance by '%s update', even
+                              after the last fleet is stopped
+
+  --context <path>            path of the context file (default: '%s')
+
+  --control-persist <time>    keep the ssh connections open in background for
+                              <time> after the last command to reuse them, or
+                              'none' to disable (default: '%s'), the directory
+                              of the control sockets is created each time the
+                              output file is written
+
+  --identity-file <path>      use the given private key for the connections
+
+  --no-auto                   stop to write the output file when the context
+                              changes
+
+  --output <path>             write the configuration in the given file, or
+                              '-' for the stdout (default: '%s')
+
+  --user <user-name>          use a custom user name for the ssh connections
+`,
+		PROGNAME, PROGNAME, PROGNAME, DEFAULT_SSH_CONFIG_ALIAS,
+		PROGNAME, DEFAULT_SSH_CONFIG_CONTEXT,
+		DEFAULT_SSH_CONFIG_CONTROL_PERSIST, DEFAULT_SSH_CONFIG_OUTPUT)
+}
+
+// The settings of an OpenSSH configuration generated from a context.
+// They are stored in the context when the configuration is written again
+// each time the context changes.
+//
+type SshConfigSettings struct {
+	Alias          string   // pattern of the host aliases
+	ControlPersist string   // value of the '--control-persist' option
+	IdentityFile   string   // path of the private key or empty
+	Output         string   // path of the configuration file
+	Specs          []string // specification of the instances
+	User           string   // custom user name or empty
+}
+
+// Return the given ssh command line options of the form '-o' '<key>=<value>'
+// as OpenSSH configuration lines.
+//
+func sshConfigOptions(options []string) []string {
+	var lines []string = make([]string, 0, len(options)/2)
+	var parts []string
+	var i int
+
+	for i = 1; i < len(options); i += 2 {
+		parts = strings.SplitN(options[i], "=", 2)
+		lines = append(lines, parts[0]+" "+sshConfigQuote(parts[1]))
+	}
+
+	return lines
+}
+
+// Quote the given value for an OpenSSH configuration file if it contains
+// spaces.
+//
+func sshConfigQuote(value string) string {
+	if strings.ContainsAny(value, " \t") {
+		return "\"" + value + "\""
+	}
+
+	return value
+}
+
+// Return the OpenSSH configuration for the instances of the given context,
+// with the given path, according to these settings.
+// Return an error if the instances cannot be selected or if two instances
+// have the same alias.
+//
+func (this *SshConfigSettings) Generate(contextPath string, ctx *Ec2Index) (string, error) {
+	var aliases map[string]*Ec2Instance = make(map[string]*Ec2Instance)
+	var builder strings.Builder
+	var selection *Ec2Selection
+	var instance, other *Ec2Instance
+	var knownHosts *KnownHosts
+	var control *SshControl
+	var alias, user, line string
+	var options []string
+	var specs []string
+	var found bool
+	var err error
+
+	knownHosts = NewKnownHosts(ContextTagValue(contextPath))
+
+	control, err = NewSshControl(ContextTagValue(contextPath),
+		this.ControlPersist)
+	if err != nil {
+		return "", err
+	}
+
+	specs = this.Specs
+	if len(specs) == 0 {
+		specs = []string{"//"}
+	}
+
+	selection, err = ctx.Select(specs)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(&builder, "# Generated by %s from the context '%s'\n",
+		PROGNAME, ContextTagValue(contextPath))
+
+	for _, instance = range selection.Reachable(false) {
+		alias = Format(this.Alias, instance)
+		if (alias == "") || strings.ContainsAny(alias, " \t*?!") {
+			return "", fmt.Errorf("invalid alias for instance %s: "+
+				"'%s'", instance.Name, alias)
+		}
+
+		other, found = aliases[alias]
+		if found {
+			return "", fmt.Errorf("conflicting alias for instances "+
+				"%s and %s: '%s'", other.Name, instance.Name,
+				alias)
+		}
+
+		aliases[alias] = instance
+
+		user = this.User
+		if user == "" {
+			user = instance.Fleet.User
+		}
+
+		options = knownHosts.Options(instance.Name)
+		if control != nil {
+			options = append(options,
+				control.Options(instance.Name, true)...)
+		}
+
+		fmt.Fprintf(&builder, "\nHost %s\n", alias)
+		fmt.Fprintf(&builder, "    HostName %s\n", instance.PublicIp)
+		fmt.Fprintf(&builder, "    User %s\n", user)
+
+		if this.IdentityFile != "" {
+			fmt.Fprintf(&builder, "    IdentityFile %s\n",
+				sshConfigQuote(this.IdentityFile))
+		}
+
+		for _, line = range sshConfigOptions(options) {
+			fmt.Fprintf(&builder, "    %s\n", line)
+		}
+	}
+
+	return builder.String(), nil
+}
+
+// Write the OpenSSH configuration for the instances of the given context,
+// with the given path, in the output file of these settings, or on the stdout
+// if the output is '-'.
+// The output file is replaced at once so ssh never reads a partial file.
+// The directory of the control sockets is created if needed since ssh fails
+// when the ControlPath of an entry cannot be created.
+//
+func (this *SshConfigSettings) Write(contextPath string, ctx *Ec2Index) error {
+	var content, temp string
+	var control *SshControl
+	var err error
+
+	content, err = this.Generate(contextPath, ctx)
+	if err != nil {
+		return err
+	}
+
+	control, err = NewSshControl(ContextTagValue(contextPath),
+		this.ControlPersist)
+	if err != nil {
+		return err
+	} else if control != nil {
+		err = control.Prepare()
+		if err != nil {
+			return err
+		}
+	}
+
+	if this.Output == "-" {
+		_, err = fmt.Print(content)
+		return err
+	}
+
+	temp = this.Output + ".tmp"
+
+	err = ioutil.WriteFile(temp, []byte(content), 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(temp, this.Output)
+	if err != nil {
+		os.Remove(temp)
+	}
+
+	return err
+}
+
+func SshConfig(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var settings SshConfigSettings
+	var ctx *Ec2Index
+	var err error
+
+	sshConfigParams.OptionAlias = flags.String("alias", DEFAULT_SSH_CONFIG_ALIAS, "")
+	sshConfigParams.OptionAuto = flags.Bool("auto", DEFAULT_SSH_CONFIG_AUTO, "")
+	sshConfigParams.OptionContext = flags.String("context", DEFAULT_SSH_CONFIG_CONTEXT, "")
+	sshConfigParams.OptionControlPersist = flags.String("control-persist", DEFAULT_SSH_CONFIG_CONTROL_PERSIST, "")
+	sshConfigParams.OptionIdentityFile = flags.String("identity-file", DEFAULT_SSH_CONFIG_IDENTITY_FILE, "")
+	sshConfigParams.OptionNoAuto = flags.Bool("no-auto", DEFAULT_SSH_CONFIG_NO_AUTO, "")
+	sshConfigParams.OptionOutput = flags.String("output", DEFAULT_SSH_CONFIG_OUTPUT, "")
+	sshConfigParams.OptionUser = flags.String("user", DEFAULT_SSH_CONFIG_USER, "")
+
+	flags.Parse(args[1:])
+
+	if *sshConfigParams.OptionAuto && *sshConfigParams.OptionNoAuto {
+		Error("cannot use option --auto with option --no-auto")
+	} else if *sshConfigParams.OptionAuto &&
+		(*sshConfigParams.OptionOutput == "-") {
+		Error("option --auto requires option --output")
+	}
+
+	ctx, err = LoadEc2Index(*sshConfigParams.OptionContext)
+	if err != nil {
+		Error("no context: %s", *sshConfigParams.OptionContext)
+	}
+
+	if *sshConfigParams.OptionNoAuto {
+		ctx.SshConfig = nil
+
+		err = StoreEc2Index(*sshConfigParams.OptionContext, ctx)
+		if err != nil {
+			Error("cannot update context: %s", err.Error())
+		}
+
+		return
+	}
+
+	settings.Alias = *sshConfigParams.OptionAlias
+	settings.ControlPersist = *sshConfigParams.OptionControlPersist
+	settings.IdentityFile = *sshConfigParams.OptionIdentityFile
+	settings.Output = *sshConfigParams.OptionOutput
+	settings.Specs = flags.Args()
+	settings.User = *sshConfigParams.OptionUser
+
+	if settings.IdentityFile != "" {
+		settings.IdentityFile, err = filepath.Abs(settings.IdentityFile)
+		if err != nil {
+			Error("invalid identity file: %s", err.Error())
+		}
+	}
+
+	if settings.Output != "-" {
+		settings.Output, err = filepath.Abs(settings.Output)
+		if err != nil {
+			Error("invalid output file: %s", err.Error())
+		}
+	}
+
+	err = settings.Write(*sshConfigParams.OptionContext, ctx)
+	if err != nil {
+		Error("cannot write ssh config: %s", err.Error())
+	}
+
+	if *sshConfigParams.OptionAuto {
+		ctx.SshConfig = &settings
+
+		err = StoreEc2Index(*sshConfigParams.OptionContext, ctx)
+		if err != nil {
+			Error("cannot update context: %s", err.Error())
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSshConfigGenerate(t *testing.T) {
+	var settings SshConfigSettings
+	var idx *Ec2Index = NewEc2Index()
+	var fleet *Ec2Fleet
+	var content string
+	var err error
+
+	fleet, _ = idx.AddEc2Fleet("0", "fleet", "ubuntu", "r", 3)
+	fleet.AddEc2Instance("i0", "0.0.0.0", "1.0.0.0")
+	fleet.AddEc2Instance("i1", "0.0.0.1", "1.0.0.1")
+	fleet.AddEc2Instance("i2", "", "1.0.0.2")
+
+	settings.Alias = "%f-%d"
+	settings.ControlPersist = "none"
+	settings.IdentityFile = "/my keys/key.pem"
+
+	content, err = settings.Generate("/ctx", idx)
+	if err != nil {
+		t.FailNow()
+	}
+
+	if !strings.Contains(content, "\nHost fleet-0\n"+
+		"    HostName 0.0.0.0\n    User ubuntu\n"+
+		"    IdentityFile \"/my keys/key.pem\"\n") ||
+		!strings.Contains(content, "\nHost fleet-1\n") ||
+		strings.Contains(content, "fleet-2") ||
+		!strings.Contains(content, "    HostKeyAlias i1\n") ||
+		!strings.Contains(content, "    UserKnownHostsFile "+
+			"/ctx"+KNOWN_HOSTS_SUFFIX+"\n") ||
+		strings.Contains(content, "ControlPath") {
+		t.Fail()
+	}
+
+	settings.Alias = "%f"
+
+	_, err = settings.Generate("/ctx", idx)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestStoreEc2IndexSshConfig(t *testing.T) {
+	var path string = "context_test_TestStoreEc2IndexSshConfig.json"
+	var output string = path + ".ssh_config"
+	var idx *Ec2Index = NewEc2Index()
+	var fleet *Ec2Fleet
+	var raw []byte
+	var err error
+
+	defer os.Remove(path)
+	defer os.Remove(output)
+	defer os.Remove(ControlDirectory(path))
+
+	fleet, _ = idx.AddEc2Fleet("0", "fleet", "u", "r", 1)
+	fleet.AddEc2Instance("i0", "0.0.0.0", "1.0.0.0")
+
+	idx.SshConfig = &SshConfigSettings{Alias: "%n", ControlPersist: "5m",
+		Output: output}
+
+	err = StoreEc2Index(path, idx)
+	if err != nil {
+		t.FailNow()
+	}
+
+	raw, err = ioutil.ReadFile(output)
+	if (err != nil) || !strings.Contains(string(raw), "\nHost i0\n") {
+		t.Fail()
+	}
+
+	_, err = os.Stat(ControlDirectory(path))
+	if err != nil {
+		t.Fail()
+	}
+
+	idx, err = LoadEc2Index(path)
+	if (err != nil) || (idx.SshConfig == nil) ||
+		(idx.SshConfig.Output != output) {
+		t.FailNow()
+	}
+
+	idx.RemoveEc2Fleet(idx.FleetsByName["fleet"])
+
+	err = StoreEc2Index(path, idx)
+	if err != nil {
+		t.FailNow()
+	}
+
+	raw, err = ioutil.ReadFile(output)
+	if (err != nil) || strings.Contains(string(raw), "Host") {
+		t.Fail()
+	}
+
+	idx, err = LoadEc2Index(path)
+	if (err != nil) || (idx.SshConfig == nil) {
+		t.FailNow()
+	}
+
+	idx.SshConfig = nil
+
+	err = StoreEc2Index(path, idx)
+	if err != nil {
+		t.FailNow()
+	}
+
+	_, err = os.Stat(path)
+	if err == nil {
+		t.Fail()
+	}
+}
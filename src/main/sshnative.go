@@ -0,0 +1,546 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The transports to connect to the instances.
+// The openssh transport forks an external 'ssh' or 'scp' process for each
+// instance while the native transport uses a built-in ssh client.
+//
+const (
+	TRANSPORT_NATIVE  string = "native"
+	TRANSPORT_OPENSSH string = "openssh"
+)
+
+var DEFAULT_TRANSPORT string = TRANSPORT_OPENSSH
+var DEFAULT_NATIVE_CONCURRENCY int = 32
+var DEFAULT_NATIVE_PORT string = "22"
+
+// The exit status of a native command which cannot connect to the remote
+// host, as the one of the 'ssh' command.
+//
+const NATIVE_SSH_CONNECT_STATUS int = 255
+
+// The private key files used by the native transport, relative to the home
+// directory of the user, if they exist and are not encrypted.
+//
+var NATIVE_KEY_FILES []string = []string{
+	".ssh/id_rsa",
+	".ssh/id_ecdsa",
+	".ssh/id_ed25519",
+}
+
+var optionNativeConcurrency *int
+var optionTransport *string
+
+// Indicate if the given name designates a valid transport.
+//
+func IsTransport(name string) bool {
+	return (name == TRANSPORT_NATIVE) || (name == TRANSPORT_OPENSSH)
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Native command related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// An error related to a native command which does not exit successfully.
+// Implements the ExitStatusError interface.
+//
+type NativeCommandError struct {
+	message string
+	status  int
+}
+
+// Create a new NativeCommandError with the given exit status.
+//
+func newNativeCommandError(status int, format string, a ...interface{}) *NativeCommandError {
+	var err NativeCommandError
+
+	err.message = fmt.Sprintf(format, a...)
+	err.status = status
+
+	return &err
+}
+
+// The implementation of error.Error() method for NativeCommandError.
+//
+func (this *NativeCommandError) Error() string {
+	return this.message
+}
+
+// The implementation of ExitStatusError.ExitStatus() for NativeCommandError.
+//
+func (this *NativeCommandError) ExitStatus() int {
+	return this.status
+}
+
+// A command executed by a Go function in its own goroutine instead of an
+// external process.
+// The function reads and writes the streams of the command. Once it returns,
+// the output streams are closed and the command is finished.
+// Implements the Command interface.
+//
+type nativeCommand struct {
+	run     func(*nativeCommand) error // body of the command
+	stdout  *io.PipeWriter             // standard output for run
+	stderr  *io.PipeWriter             // standard error for run
+	stdin   *io.PipeReader             // standard input for run
+	outpipe *io.PipeReader             // standard output for Process
+	errpipe *io.PipeReader             // standard error for Process
+	inpipe  *io.PipeWriter             // standard input for Process
+	done    chan error                 // result of run
+	lock    sync.Mutex                 // protect killed and kill
+	killed  bool                       // if Kill() has been called
+	kill    func()                     // interrupt run or nil
+}
+
+// Create a new nativeCommand executing the given function.
+//
+func newNativeCommand(run func(*nativeCommand) error) *nativeCommand {
+	var this nativeCommand
+
+	this.run = run
+	this.outpipe, this.stdout = io.Pipe()
+	this.errpipe, this.stderr = io.Pipe()
+	this.stdin, this.inpipe = io.Pipe()
+	this.done = make(chan error, 1)
+
+	return &this
+}
+
+// Set the function to call to interrupt the body of the command when it is
+// killed.
+// If the command is already killed, call it immediately.
+//
+func (this *nativeCommand) onKill(kill func()) {
+	var killed bool
+
+	this.lock.Lock()
+	this.kill = kill
+	killed = this.killed
+	this.lock.Unlock()
+
+	if killed {
+		kill()
+	}
+}
+
+// The implementation of KillableCommand.Kill() for nativeCommand.
+//
+func (this *nativeCommand) Kill() error {
+	var kill func()
+
+	this.lock.Lock()
+	this.killed = true
+	kill = this.kill
+	this.lock.Unlock()
+
+	if kill != nil {
+		kill()
+	}
+
+	return nil
+}
+
+// The implementation of Command.StdoutPipe() for nativeCommand.
+//
+func (this *nativeCommand) StdoutPipe() (io.ReadCloser, error) {
+	return this.outpipe, nil
+}
+
+// The implementation of Command.StderrPipe() for nativeCommand.
+//
+func (this *nativeCommand) StderrPipe() (io.ReadCloser, error) {
+	return this.errpipe, nil
+}
+
+// The implementation of Command.StdinPipe() for nativeCommand.
+//
+func (this *nativeCommand) StdinPipe() (io.WriteCloser, error) {
+	return this.inpipe, nil
+}
+
+// The implementation of Command.Start() for nativeCommand.
+// Run the function of the command in a new goroutine and never fail.
+//
+func (this *nativeCommand) Start() error {
+	go func() {
+		var err error = this.run(this)
+
+		this.stdout.Close()
+		this.stderr.Close()
+		this.stdin.Close()
+
+		this.done <- err
+	}()
+
+	return nil
+}
+
+// The implementation of Command.Wait() for nativeCommand.
+//
+func (this *nativeCommand) Wait() error {
+	return <-this.done
+}
+
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+// Native ssh transport related code
+// - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
+
+// A connection to a remote host shared by all the commands executed on this
+// host.
+//
+type nativeSshClient struct {
+	ready  chan bool   // closed once the connection attempt finished
+	client *ssh.Client // the connection if it succeeded
+	err    error       // the connection error if it failed
+}
+
+// A built-in ssh client executing commands on remote hosts.
+// There is at most one connection per remote host and user, which is shared
+// by all the commands executed on this host. The number of connections being
+// established at the same time is limited, to not overload the local host
+// with handshakes. Once established, the connections and their sessions are
+// not limited, the number of commands running at the same time is up to the
+// callers.
+//
+type NativeSshTransport struct {
+	config     ssh.ClientConfig            // configuration shared by clients
+	lock       sync.Mutex                  // protect clients and aliases
+	clients    map[string]*nativeSshClient // connections by user@host
+	slots      chan bool                   // connections being established
+	knownHosts *KnownHosts                 // host keys or nil to ignore
+	aliases    map[string]string           // host key aliases by host
+}
+
+// Return the authentication methods available for the native transport.
+// Use the ssh agent if SSH_AUTH_SOCK is set and the non encrypted key files
+// of the user.
+//
+func nativeAuthMethods() []ssh.AuthMethod {
+	var methods []ssh.AuthMethod = make([]ssh.AuthMethod, 0)
+	var signers []ssh.Signer = make([]ssh.Signer, 0)
+	var signer ssh.Signer
+	var home, path string
+	var conn net.Conn
+	var raw []byte
+	var err error
+
+	if os.Getenv("SSH_AUTH_SOCK") != "" {
+		conn, err = net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(
+				agent.NewClient(conn).Signers))
+		}
+	}
+
+	home, err = os.UserHomeDir()
+	if err != nil {
+		return methods
+	}
+
+	for _, path = range NATIVE_KEY_FILES {
+		raw, err = ioutil.ReadFile(filepath.Join(home, path))
+		if err != nil {
+			continue
+		}
+
+		signer, err = ssh.ParsePrivateKey(raw)
+		if err != nil {
+			continue
+		}
+
+		signers = append(signers, signer)
+	}
+
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	return methods
+}
+
+// Create a new NativeSshTransport establishing at most the given number of
+// connections at the same time.
+// The host keys are not verified unless VerifyHostKeys() is called.
+// Return an error if there is no way to authenticate.
+//
+func NewNativeSshTransport(concurrency int) (*NativeSshTransport, error) {
+	var this NativeSshTransport
+
+	this.config.Auth = nativeAuthMethods()
+	if len(this.config.Auth) == 0 {
+		return nil, newNativeCommandError(NATIVE_SSH_CONNECT_STATUS,
+			"no ssh agent nor unencrypted private key available")
+	}
+
+	this.config.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	this.clients = make(map[string]*nativeSshClient)
+	this.slots = make(chan bool, concurrency)
+	this.aliases = make(map[string]string)
+
+	return &this, nil
+}
+
+// Create a new NativeSshTransport establishing at most the given number of
+// connections at the same time and verifying the host keys against the given
+// known hosts.
+// Exit with an error if the concurrency is not strictly positive or if the
+// transport cannot be created.
+//
+func OpenNativeSshTransport(knownHosts *KnownHosts, concurrency int) *NativeSshTransport {
+	var transport *NativeSshTransport
+	var err error
+
+	if concurrency <= 0 {
+		Error("invalid value for option --native-concurrency: '%d'",
+			concurrency)
+	}
+
+	transport, err = NewNativeSshTransport(concurrency)
+	if err != nil {
+		Error("cannot use native transport: %s", err.Error())
+	}
+
+	transport.VerifyHostKeys(knownHosts)
+
+	return transport
+}
+
+// Verify the host keys against the given known hosts instead of accepting any
+// key. Unknown hosts are trusted on first use.
+//
+func (this *NativeSshTransport) VerifyHostKeys(knownHosts *KnownHosts) {
+	this.knownHosts = knownHosts
+}
+
+// Look for the keys of the given host under the given alias in the known
+// hosts.
+//
+func (this *NativeSshTransport) SetHostKeyAlias(host, alias string) {
+	this.lock.Lock()
+	this.aliases[host] = alias
+	this.lock.Unlock()
+}
+
+// Open a connection to the given host for the given user.
+// Wait at most the given duration for the connection if it is not zero.
+//
+func (this *NativeSshTransport) dial(user, host string, timeout time.Duration) (*ssh.Client, error) {
+	var config ssh.ClientConfig = this.config
+	var client *ssh.Client
+	var alias string
+	var found bool
+	var err error
+
+	config.User = user
+	config.Timeout = timeout
+
+	if this.knownHosts != nil {
+		this.lock.Lock()
+		alias, found = this.aliases[host]
+		this.lock.Unlock()
+
+		if !found {
+			alias = host
+		}
+
+		config.HostKeyCallback = this.knownHosts.HostKeyCallback(alias)
+		config.HostKeyAlgorithms =
+			this.knownHosts.HostKeyAlgorithms(alias)
+	}
+
+	this.slots <- true
+	client, err = ssh.Dial("tcp", net.JoinHostPort(host,
+		DEFAULT_NATIVE_PORT), &config)
+	<-this.slots
+
+	return client, err
+}
+
+// Return the connection to the given host for the given user, opening it if
+// it does not exist yet.
+// Concurrent calls for the same host and user share the same connection
+// attempt. A failed connection is not remembered.
+//
+func (this *NativeSshTransport) connect(user, host string, timeout time.Duration) (*ssh.Client, error) {
+	var key string = user + "@" + host
+	var entry *nativeSshClient
+	var found bool
+
+	this.lock.Lock()
+
+	entry, found = this.clients[key]
+	if found {
+		this.lock.Unlock()
+		<-entry.ready
+		return entry.client, entry.err
+	}
+
+	entry = &nativeSshClient{ready: make(chan bool)}
+	this.clients[key] = entry
+
+	this.lock.Unlock()
+
+	entry.client, entry.err = this.dial(user, host, timeout)
+	if entry.err != nil {
+		this.forget(key, entry)
+	}
+
+	close(entry.ready)
+
+	return entry.client, entry.err
+}
+
+// Forget the given connection for the given user@host key so the next
+// command opens a new connection.
+//
+func (this *NativeSshTransport) forget(key string, entry *nativeSshClient) {
+	this.lock.Lock()
+	if this.clients[key] == entry {
+		delete(this.clients, key)
+	}
+	this.lock.Unlock()
+}
+
+// Open a new session on the given host for the given user.
+// If the shared connection is broken, open a new connection once.
+//
+func (this *NativeSshTransport) NewSession(user, host string, timeout time.Duration) (*ssh.Session, error) {
+	var key string = user + "@" + host
+	var entry *nativeSshClient
+	var session *ssh.Session
+	var client *ssh.Client
+	var found bool
+	var err error
+
+	client, err = this.connect(user, host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	session, err = client.NewSession()
+	if err == nil {
+		return session, nil
+	}
+
+	this.lock.Lock()
+	entry, found = this.clients[key]
+	if found && (entry.client == client) {
+		delete(this.clients, key)
+	}
+	this.lock.Unlock()
+
+	client.Close()
+
+	client, err = this.connect(user, host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return client.NewSession()
+}
+
+// Close every connections opened by this transport.
+//
+func (this *NativeSshTransport) Close() {
+	var entry *nativeSshClient
+
+	this.lock.Lock()
+
+	for _, entry = range this.clients {
+		if entry.client != nil {
+			entry.client.Close()
+		}
+	}
+
+	this.clients = make(map[string]*nativeSshClient)
+
+	this.lock.Unlock()
+}
+
+// Open a session on the given host for the given user in the context of the
+// given native command.
+// Print the progress on the command stderr if verbose is true.
+// Return the session or an error with the same exit status as the 'ssh'
+// command if the connection fails.
+//
+func (this *NativeSshTransport) openSession(cmd *nativeCommand, user, host string, timeout int, verbose bool) (*ssh.Session, error) {
+	var session *ssh.Session
+	var err error
+
+	if verbose {
+		fmt.Fprintf(cmd.stderr, "native: connect to %s@%s\n", user,
+			host)
+	}
+
+	session, err = this.NewSession(user, host,
+		time.Duration(timeout)*time.Second)
+	if err != nil {
+		if verbose {
+			fmt.Fprintf(cmd.stderr, "native: %s@%s: %s\n", user,
+				host, err.Error())
+		}
+
+		return nil, newNativeCommandError(NATIVE_SSH_CONNECT_STATUS,
+			"%s@%s: %s", user, host, err.Error())
+	}
+
+	return session, nil
+}
+
+// Return a Command executing the given command line on the given host for the
+// given user, as the 'ssh' command does.
+// The arguments of the command line are separated by spaces and interpreted
+// by the remote shell.
+// If timeout is strictly positive, wait at most this number of seconds for
+// the connection.
+//
+func (this *NativeSshTransport) Command(user, host string, cmdline []string, timeout int, verbose bool) Command {
+	return newNativeCommand(func(cmd *nativeCommand) error {
+		var session *ssh.Session
+		var stdin io.WriteCloser
+		var err error
+
+		session, err = this.openSession(cmd, user, host, timeout,
+			verbose)
+		if err != nil {
+			return err
+		}
+
+		defer session.Close()
+
+		cmd.onKill(func() { session.Close() })
+
+		session.Stdout = cmd.stdout
+		session.Stderr = cmd.stderr
+
+		stdin, err = session.StdinPipe()
+		if err != nil {
+			return err
+		}
+
+		err = session.Start(strings.Join(cmdline, " "))
+		if err != nil {
+			return err
+		}
+
+		go func() {
+			io.Copy(stdin, cmd.stdin)
+			stdin.Close()
+		}()
+
+		return session.Wait()
+	})
+}
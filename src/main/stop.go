@@ -6,17 +6,27 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
+	"sort"
+	"strings"
 )
 
 func PrintStopUsage() {
 	fmt.Printf(`Usage: %s stop [options] [<fleet-name...>]
 
 Stop one or more fleets on AWS EC2.
-Stopping a fleet also stops all of the associated instances.
+Stopping a fleet also stops all of the associated instances, closes the ssh
+connections kept open in background for them and forgets their host keys.
 If no fleet is specified, stop every fleets.
+When the standard input is a terminal, ask for a confirmation before to stop
+the fleets.
 
 Options:
   --context <path>            path of the context file (default: '%s')
+
+  --dry-run                   print the fleets which would be stopped and check
+                              the permissions without stopping anything
+
+  --yes                       do not ask for a confirmation
 `,
 		PROGNAME, DEFAULT_CONTEXT)
 }
@@ -40,6 +50,22 @@ func requestStop(region string, ids []*string) bool {
 	return true
 }
 
+// Check that the fleets with the given ids in the given region could be
+// cancelled, using the EC2 DryRun mechanism.
+// Return nil if the fleets could be cancelled, an error otherwise.
+//
+func checkStop(region string, ids []*string) error {
+	var params ec2.CancelSpotFleetRequestsInput
+	var err error
+
+	params.DryRun = aws.Bool(true)
+	params.SpotFleetRequestIds = ids
+	params.TerminateInstances = aws.Bool(true)
+
+	_, err = newRegionClient(region).CancelSpotFleetRequests(&params)
+	return CheckDryRunError(err)
+}
+
 func taskRequestStop(region string, ids []*string, retchan chan bool) {
 	var payload bool = requestStop(region, ids)
 	retchan <- payload
@@ -82,7 +108,92 @@ func doRegionStops(ctx *Ec2Index, regionFleets map[string][]*string) {
 	}
 }
 
+// Return the names of the given fleets, checking they exist in the given
+// context. If no fleet name is given, return the names of every fleets of the
+// context.
+// The returned names are sorted.
+//
+func selectStopFleets(ctx *Ec2Index, fleetNames []string) []string {
+	var names []string = make([]string, 0)
+	var fleetName string
+
+	if len(fleetNames) == 0 {
+		for fleetName = range ctx.FleetsByName {
+			names = append(names, fleetName)
+		}
+	} else {
+		for _, fleetName = range fleetNames {
+			if ctx.FleetsByName[fleetName] == nil {
+				Error("unknown fleet-name: '%s'", fleetName)
+			}
+			names = append(names, fleetName)
+		}
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+// Print the fleets with the given names which would be stopped and check the
+// permissions to stop them without modifying anything.
+// Exit with an error if the fleets of any region could not be stopped.
+//
+func DryRunStop(ctx *Ec2Index, fleetNames []string) {
+	var regionFleets map[string][]*string
+	var fleet *Ec2Fleet
+	var fleetName string
+	var region string
+	var failed int
+	var err error
+
+	regionFleets = make(map[string][]*string)
+
+	for _, fleetName = range selectStopFleets(ctx, fleetNames) {
+		fleet = ctx.FleetsByName[fleetName]
+		regionFleets[fleet.Region] =
+			append(regionFleets[fleet.Region], &fleet.Id)
+
+		DryRunPrint("cancel fleet '%s' (%s) in region %s and "+
+			"terminate its %d instances", fleet.Name, fleet.Id,
+			fleet.Region, len(fleet.Instances))
+	}
+
+	for _, region = range sortedRegions(regionFleets) {
+		err = checkStop(region, regionFleets[region])
+		if err != nil {
+			Warning("cannot cancel fleets for region '%s': %s",
+				region, err.Error())
+			failed += 1
+		}
+	}
+
+	if failed > 0 {
+		Error("stop request would fail for %d regions", failed)
+	}
+}
+
+// Remove the host keys of the given instances from the known hosts of the
+// context with the given path.
+//
+func forgetHostKeys(contextPath string, instances []*Ec2Instance) {
+	var aliases []string = make([]string, len(instances))
+	var instance *Ec2Instance
+	var err error
+	var i int
+
+	for i, instance = range instances {
+		aliases[i] = instance.Name
+	}
+
+	err = NewKnownHosts(contextPath).Remove(aliases)
+	if err != nil {
+		Warning("cannot remove host keys: %s", err.Error())
+	}
+}
+
 func DoStop(ctx *Ec2Index, fleetNames []string) {
+	var instances []*Ec2Instance = make([]*Ec2Instance, 0)
 	var regionFleets map[string][]*string
 	var fleet *Ec2Fleet
 	var fleetName string
@@ -93,6 +204,7 @@ func DoStop(ctx *Ec2Index, fleetNames []string) {
 		for fleetName, fleet = range ctx.FleetsByName {
 			regionFleets[fleet.Region] =
 				append(regionFleets[fleet.Region], &fleet.Id)
+			instances = append(instances, fleet.Instances...)
 		}
 	} else {
 		for _, fleetName = range fleetNames {
@@ -104,18 +216,25 @@ func DoStop(ctx *Ec2Index, fleetNames []string) {
 			fleet = ctx.FleetsByName[fleetName]
 			regionFleets[fleet.Region] =
 				append(regionFleets[fleet.Region], &fleet.Id)
+			instances = append(instances, fleet.Instances...)
 		}
 	}
 
+	CloseSshControl(*optionContext, instances)
+	forgetHostKeys(*optionContext, instances)
+
 	doRegionStops(ctx, regionFleets)
 }
 
 func Stop(args []string) {
 	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var names []string
 	var ctx *Ec2Index
 	var err error
 
 	optionContext = flags.String("context", DEFAULT_CONTEXT, "")
+	optionDryRun = flags.Bool("dry-run", DEFAULT_DRY_RUN, "")
+	optionYes = flags.Bool("yes", DEFAULT_YES, "")
 
 	flags.Parse(args[1:])
 
@@ -124,6 +243,17 @@ func Stop(args []string) {
 		Error("no context: %s", *optionContext)
 	}
 
+	if *optionDryRun {
+		DryRunStop(ctx, flags.Args())
+		return
+	}
+
+	names = selectStopFleets(ctx, flags.Args())
+	if len(names) > 0 {
+		ConfirmOrExit(*optionYes, "stop fleets %s?",
+			strings.Join(names, ", "))
+	}
+
 	DoStop(ctx, flags.Args())
 
 	StoreEc2Index(*optionContext, ctx)
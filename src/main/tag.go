@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// The keys of the EC2 tags set by ec2tools on the resources it creates.
+// User defined attributes are stored as tags with a key made of the
+// TAG_ATTRIBUTE_PREFIX followed by the attribute name.
+//
+const (
+	TAG_NAME             string = "Name"
+	TAG_CONTEXT          string = "ec2tools:context"
+	TAG_FLEET            string = "ec2tools:fleet"
+	TAG_INSTANCE         string = "ec2tools:instance"
+	TAG_OWNER            string = "ec2tools:owner"
+	TAG_USER             string = "ec2tools:user"
+	TAG_ATTRIBUTE_PREFIX string = "ec2tools:attribute:"
+)
+
+var DEFAULT_OWNER string = os.Getenv("USER")
+
+// An error related to an ill formed tag specification.
+// Implements the error interface.
+//
+type TagSpecError struct {
+	message string
+}
+
+// The implementation of error.Error() method for TagSpecError.
+//
+func (this *TagSpecError) Error() string {
+	return this.message
+}
+
+// Parse a tag specification of the form '<key>=<value>'.
+// The key must not be empty but the value can be.
+// Return the key and the value or an error if the specification is ill
+// formed.
+//
+func ParseTagSpec(spec string) (string, string, error) {
+	var err TagSpecError
+	var pos int
+
+	pos = strings.Index(spec, "=")
+	if pos < 0 {
+		err.message = fmt.Sprintf("invalid tag '%s': missing '='", spec)
+		return "", "", &err
+	} else if pos == 0 {
+		err.message = fmt.Sprintf("invalid tag '%s': empty key", spec)
+		return "", "", &err
+	}
+
+	return spec[:pos], spec[(pos + 1):], nil
+}
+
+// Parse a list of tag specifications and add the resulting tags to the given
+// map, possibly overwriting existing tags with the same key.
+// Return an error if one of the specifications is ill formed.
+//
+func ParseTagSpecs(tags map[string]string, specs []string) error {
+	var key, value, spec string
+	var err error
+
+	for _, spec = range specs {
+		key, value, err = ParseTagSpec(spec)
+		if err != nil {
+			return err
+		}
+
+		tags[key] = value
+	}
+
+	return nil
+}
+
+// Return the value of the TAG_CONTEXT tag for the context file with the given
+// path. This is the absolute path of the context file.
+//
+func ContextTagValue(contextPath string) string {
+	var path string
+	var err error
+
+	path, err = filepath.Abs(contextPath)
+	if err != nil {
+		return contextPath
+	}
+
+	return path
+}
+
+// Return the tags common to every resources created by ec2tools from the
+// context file with the given path on behalf of the given owner.
+// The context path is stored as an absolute path.
+//
+func NewContextTags(contextPath, owner string) map[string]string {
+	var tags map[string]string = make(map[string]string)
+
+	tags[TAG_CONTEXT] = ContextTagValue(contextPath)
+
+	if owner != "" {
+		tags[TAG_OWNER] = owner
+	}
+
+	return tags
+}
+
+// Return the key of the tag storing the attribute with the given name.
+//
+func AttributeTagKey(name string) string {
+	return TAG_ATTRIBUTE_PREFIX + name
+}
+
+// Indicate if the tag with the given key stores an attribute.
+// If so, also return the name of the attribute.
+//
+func IsAttributeTagKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, TAG_ATTRIBUTE_PREFIX) {
+		return "", false
+	}
+
+	return key[len(TAG_ATTRIBUTE_PREFIX):], true
+}
+
+// Convert a map of tags to a slice of EC2 tags, sorted by key.
+//
+func BuildEc2Tags(tags map[string]string) []*ec2.Tag {
+	var ret []*ec2.Tag = make([]*ec2.Tag, 0, len(tags))
+	var keys []string = make([]string, 0, len(tags))
+	var key string
+
+	for key = range tags {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key = range keys {
+		ret = append(ret, &ec2.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(tags[key]),
+		})
+	}
+
+	return ret
+}
+
+// Convert a slice of EC2 tags to a map of tags.
+//
+func UnpackEc2Tags(tags []*ec2.Tag) map[string]string {
+	var ret map[string]string = make(map[string]string)
+	var tag *ec2.Tag
+
+	for _, tag = range tags {
+		if (tag.Key == nil) || (tag.Value == nil) {
+			continue
+		}
+
+		ret[*tag.Key] = *tag.Value
+	}
+
+	return ret
+}
+
+// Return an EC2 tag specification to tag a resource of the given type with
+// the given tags at creation time.
+//
+func BuildTagSpecification(rtype string, tags map[string]string) *ec2.TagSpecification {
+	var spec ec2.TagSpecification
+
+	spec.ResourceType = aws.String(rtype)
+	spec.Tags = BuildEc2Tags(tags)
+
+	return &spec
+}
+
+// Return the tags storing the attributes of the given instance.
+//
+func instanceAttributeTags(instance *Ec2Instance) map[string]string {
+	var tags map[string]string = make(map[string]string)
+	var name, value string
+
+	for name, value = range instance.Attributes {
+		tags[AttributeTagKey(name)] = value
+	}
+
+	return tags
+}
+
+// Return the EC2 tags of the given instances, all from the region of the given
+// client, indexed by instance name.
+// Return an error if the tags cannot be fetched.
+//
+func describeInstanceTags(client *ec2.EC2, instances []*Ec2Instance) (map[string]map[string]string, error) {
+	var tags map[string]map[string]string
+	var input ec2.DescribeTagsInput
+	var instance *Ec2Instance
+	var filter ec2.Filter
+	var err error
+
+	tags = make(map[string]map[string]string)
+
+	filter.Name = aws.String("resource-id")
+	filter.Values = make([]*string, 0, len(instances))
+	for _, instance = range instances {
+		filter.Values = append(filter.Values, aws.String(instance.Name))
+		tags[instance.Name] = make(map[string]string)
+	}
+	input.Filters = []*ec2.Filter{&filter}
+
+	err = client.DescribeTagsPages(&input,
+		func(page *ec2.DescribeTagsOutput, last bool) bool {
+			var tag *ec2.TagDescription
+
+			for _, tag = range page.Tags {
+				tags[*tag.ResourceId][*tag.Key] = *tag.Value
+			}
+
+			return true
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return tags, nil
+}
+
+// Synchronize the EC2 tags of the given instances, all from the given region,
+// with their attributes.
+// Return the first error encountered or nil if everything goes well.
+//
+func syncRegionTags(region string, instances []*Ec2Instance) error {
+	var existing map[string]map[string]string
+	var dinput ec2.DeleteTagsInput
+	var cinput ec2.CreateTagsInput
+	var desired map[string]string
+	var instance *Ec2Instance
+	var sess *session.Session
+	var obsolete []*ec2.Tag
+	var client *ec2.EC2
+	var key string
+	var found bool
+	var err error
+
+	sess = session.New()
+	client = ec2.New(sess, &aws.Config{Region: aws.String(region)})
+
+	existing, err = describeInstanceTags(client, instances)
+	if err != nil {
+		return err
+	}
+
+	for _, instance = range instances {
+		desired = instanceAttributeTags(instance)
+
+		obsolete = make([]*ec2.Tag, 0)
+		for key = range existing[instance.Name] {
+			if _, found = IsAttributeTagKey(key); !found {
+				continue
+			}
+
+			if _, found = desired[key]; !found {
+				obsolete = append(obsolete,
+					&ec2.Tag{Key: aws.String(key)})
+			}
+		}
+
+		if len(obsolete) > 0 {
+			dinput.Resources = []*string{aws.String(instance.Name)}
+			dinput.Tags = obsolete
+
+			_, err = client.DeleteTags(&dinput)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(desired) > 0 {
+			cinput.Resources = []*string{aws.String(instance.Name)}
+			cinput.Tags = BuildEc2Tags(desired)
+
+			_, err = client.CreateTags(&cinput)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Set the attributes of the given instances, all from the given region, from
+// their EC2 tags.
+// Existing attributes without corresponding tag are left untouched.
+// Return an error if the tags cannot be fetched.
+//
+func loadRegionTags(region string, instances []*Ec2Instance) error {
+	var tags map[string]map[string]string
+	var instance *Ec2Instance
+	var sess *session.Session
+	var client *ec2.EC2
+	var key, name string
+	var found bool
+	var err error
+
+	sess = session.New()
+	client = ec2.New(sess, &aws.Config{Region: aws.String(region)})
+
+	tags, err = describeInstanceTags(client, instances)
+	if err != nil {
+		return err
+	}
+
+	for _, instance = range instances {
+		for key = range tags[instance.Name] {
+			name, found = IsAttributeTagKey(key)
+			if found && (name != "") {
+				instance.Attributes[name] =
+					tags[instance.Name][key]
+			}
+		}
+	}
+
+	return nil
+}
+
+// Apply the given function to the given instances grouped by region.
+// Every region is processed in parallel, ignoring duplicate instances.
+// Return the first error encountered or nil if everything goes well.
+//
+func forEachRegionInstances(instances []*Ec2Instance, fn func(string, []*Ec2Instance) error) error {
+	var regionInstances map[string][]*Ec2Instance
+	var seen map[*Ec2Instance]bool
+	var instance *Ec2Instance
+	var errchan chan error
+	var region string
+	var err, rerr error
+
+	regionInstances = make(map[string][]*Ec2Instance)
+	seen = make(map[*Ec2Instance]bool)
+
+	for _, instance = range instances {
+		if seen[instance] {
+			continue
+		}
+
+		seen[instance] = true
+		region = instance.Fleet.Region
+		regionInstances[region] =
+			append(regionInstances[region], instance)
+	}
+
+	errchan = make(chan error, len(regionInstances))
+
+	for region = range regionInstances {
+		go func(region string) {
+			errchan <- fn(region, regionInstances[region])
+		}(region)
+	}
+
+	err = nil
+	for _ = range regionInstances {
+		rerr = <-errchan
+		if err == nil {
+			err = rerr
+		}
+	}
+
+	return err
+}
+
+// Synchronize the EC2 tags of the given instances with their attributes.
+// Each attribute is stored in a tag with a key built by AttributeTagKey() and
+// the attribute tags which do not correspond to any attribute are removed.
+// Every region is synchronized in parallel.
+// Return the first error encountered or nil if everything goes well.
+//
+func SyncAttributeTags(instances []*Ec2Instance) error {
+	return forEachRegionInstances(instances, syncRegionTags)
+}
+
+// Set the attributes of the given instances from their EC2 tags, as written
+// by SyncAttributeTags().
+// Every region is processed in parallel.
+// Return the first error encountered or nil if everything goes well.
+//
+func LoadAttributeTags(instances []*Ec2Instance) error {
+	return forEachRegionInstances(instances, loadRegionTags)
+}
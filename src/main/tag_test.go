@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"testing"
+)
+
+func TestParseTagSpec(t *testing.T) {
+	var key, value string
+	var err error
+
+	key, value, err = ParseTagSpec("project=a=b")
+
+	if err != nil {
+		t.FailNow()
+	} else if key != "project" {
+		t.Fail()
+	} else if value != "a=b" {
+		t.Fail()
+	}
+
+	key, value, err = ParseTagSpec("empty=")
+
+	if err != nil {
+		t.FailNow()
+	} else if key != "empty" {
+		t.Fail()
+	} else if value != "" {
+		t.Fail()
+	}
+}
+
+func TestParseTagSpecInvalid(t *testing.T) {
+	var spec string
+	var err error
+
+	for _, spec = range []string{"", "key", "=value"} {
+		_, _, err = ParseTagSpec(spec)
+		if err == nil {
+			t.Fail()
+		}
+	}
+}
+
+func TestAttributeTagKey(t *testing.T) {
+	var name string
+	var found bool
+
+	name, found = IsAttributeTagKey(AttributeTagKey("my-tag"))
+	if !found {
+		t.FailNow()
+	} else if name != "my-tag" {
+		t.Fail()
+	}
+
+	_, found = IsAttributeTagKey(TAG_FLEET)
+	if found {
+		t.Fail()
+	}
+}
+
+func TestBuildEc2Tags(t *testing.T) {
+	var tags map[string]string = make(map[string]string)
+	var unpacked map[string]string
+	var built []*ec2.Tag
+
+	tags["b"] = "1"
+	tags["a"] = "2"
+	tags["c"] = ""
+
+	built = BuildEc2Tags(tags)
+
+	if len(built) != 3 {
+		t.FailNow()
+	} else if *built[0].Key != "a" {
+		t.Fail()
+	} else if *built[1].Key != "b" {
+		t.Fail()
+	} else if *built[2].Key != "c" {
+		t.Fail()
+	}
+
+	unpacked = UnpackEc2Tags(built)
+
+	if len(unpacked) != 3 {
+		t.FailNow()
+	} else if unpacked["a"] != "2" {
+		t.Fail()
+	} else if unpacked["b"] != "1" {
+		t.Fail()
+	} else if unpacked["c"] != "" {
+		t.Fail()
+	}
+}
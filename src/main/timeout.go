@@ -35,9 +35,7 @@ func NewTimeoutFromSec(sec int) *Timeout {
 	return &this
 }
 
-// Create a timeout with the specified number of days/hours/minutes/seconds
-// after invocation.
-// The timeout duration is specified with a human readable string like the
+// Parse a duration specified with a human readable string like the
 // following:
 //
 //     18          # 18 seconds (if only a number, the 's' suffix is optional)
@@ -55,8 +53,10 @@ func NewTimeoutFromSec(sec int) *Timeout {
 //     1d4h12m57s  # 1 day 4 hours 12 minutes 57 seconds (full spec)
 //
 // Spaces can be added between numbers and unit suffixes.
+// Return the number of seconds with true or 0 with false if the string is not
+// a valid duration.
 //
-func NewTimeoutFromSpec(spec string) *Timeout {
+func ParseTimespec(spec string) (int, bool) {
 	var mode int = 0 // 0 = num/sp, 1 = num, 2 = unit, 3 = sp
 	var defaultMult int = 1
 	var empty bool = true
@@ -84,7 +84,7 @@ func NewTimeoutFromSpec(spec string) *Timeout {
 	for _, c = range spec {
 		if (c >= '0') && (c <= '9') {
 			if mode == 3 {
-				return nil
+				return 0, false
 			} else {
 				mode = 1
 			}
@@ -100,7 +100,7 @@ func NewTimeoutFromSpec(spec string) *Timeout {
 			}
 		} else {
 			if (mode == 0) || (mode == 2) {
-				return nil
+				return 0, false
 			} else {
 				mode = 2
 			}
@@ -119,7 +119,7 @@ func NewTimeoutFromSpec(spec string) *Timeout {
 				ret += acc
 				defaultMult = -1
 			default:
-				return nil
+				return 0, false
 			}
 
 			acc = 0
@@ -127,18 +127,36 @@ func NewTimeoutFromSpec(spec string) *Timeout {
 	}
 
 	if empty {
-		return nil
+		return 0, false
 	}
 
 	if acc != 0 {
 		if defaultMult == -1 {
-			return nil
+			return 0, false
 		} else {
 			ret += acc * defaultMult
 		}
 	}
 
-	return NewTimeoutFromSec(ret)
+	return ret, true
+}
+
+// Create a timeout with the specified number of days/hours/minutes/seconds
+// after invocation.
+// The timeout duration is specified with a human readable string (see
+// ParseTimespec()).
+// Return nil if the string is not a valid duration.
+//
+func NewTimeoutFromSpec(spec string) *Timeout {
+	var sec int
+	var ok bool
+
+	sec, ok = ParseTimespec(spec)
+	if !ok {
+		return nil
+	}
+
+	return NewTimeoutFromSec(sec)
 }
 
 // Return true if the timeout never expires.
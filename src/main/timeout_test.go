@@ -104,3 +104,33 @@ func TestNewTimeoutFromSpacedSpec(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func TestParseTimespec(t *testing.T) {
+	var sec int
+	var ok bool
+
+	sec, ok = ParseTimespec("5m")
+	if !ok || (sec != 300) {
+		t.Fail()
+	}
+
+	sec, ok = ParseTimespec("1h 40m 30s")
+	if !ok || (sec != 6030) {
+		t.Fail()
+	}
+
+	sec, ok = ParseTimespec("1m10")
+	if !ok || (sec != 70) {
+		t.Fail()
+	}
+
+	_, ok = ParseTimespec("none")
+	if ok {
+		t.Fail()
+	}
+
+	_, ok = ParseTimespec("")
+	if ok {
+		t.Fail()
+	}
+}
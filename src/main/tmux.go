@@ -0,0 +1,321 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+type tmuxParameters struct {
+	OptionCommand        *string
+	OptionContext        *string
+	OptionControlPersist *string
+	OptionDetach         *bool
+	OptionLayout         *string
+	OptionSession        *string
+	OptionSynchronize    *bool
+	OptionTitle          *string
+	OptionUser           *string
+}
+
+var DEFAULT_TMUX_COMMAND string = ""
+var DEFAULT_TMUX_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_TMUX_CONTROL_PERSIST string = DEFAULT_CONTROL_PERSIST
+var DEFAULT_TMUX_DETACH bool = false
+var DEFAULT_TMUX_LAYOUT string = "tiled"
+var DEFAULT_TMUX_SESSION string = PROGNAME
+var DEFAULT_TMUX_SYNCHRONIZE bool = false
+var DEFAULT_TMUX_TITLE string = "%f-%d"
+var DEFAULT_TMUX_USER string = ""
+
+// The layout opening one tmux window per instance instead of one pane.
+//
+const TMUX_LAYOUT_WINDOWS string = "windows"
+
+var tmuxParams tmuxParameters
+
+func PrintTmuxUsage() {
+	fmt.Printf(`Usage: %s tmux [options] [<instance-specs...>]
+
+Open a tmux session with an interactive terminal on each of the specified
+instances, in one pane or one window per instance, then attach it.
+If no instance is specified, then open a terminal on every instances.
+The connections use the user of the fleet of each instance and check the host
+keys as '%s ssh' does.
+
+Options:
+
+  --command <cmd>             use a custom ssh command
+
+  --context <path>            path of the context file (default: '%s')
+
+  --control-persist <time>    keep the ssh connections open in background for
+                              <time> after the logout, or 'none' (default:
+                              '%s')
+
+  --detach                    create the tmux session without attaching it
+
+  --layout <layout>           tmux layout of the panes ('tiled',
+                              'even-horizontal', 'even-vertical',
+                              'main-horizontal' or 'main-vertical'), or
+                              'windows' for one window per instance
+                              (default: '%s')
+
+  --session <name>            name of the tmux session to create (default:
+                              '%s')
+
+  --synchronize               send the keys typed in a pane to every panes
+
+  --title <pattern>           title of the panes or windows, formatted for
+                              each instance (see '%s help get') (default:
+                              '%s')
+
+  --user <user-name>          use a custom user name for the ssh connections
+`,
+		PROGNAME, PROGNAME, DEFAULT_TMUX_CONTEXT,
+		DEFAULT_TMUX_CONTROL_PERSIST, DEFAULT_TMUX_LAYOUT,
+		DEFAULT_TMUX_SESSION, PROGNAME, DEFAULT_TMUX_TITLE)
+}
+
+// Return an error if the given layout is invalid or cannot be synchronized
+// when synchronize is true.
+//
+func checkTmuxLayout(layout string, synchronize bool) error {
+	if (layout != TMUX_LAYOUT_WINDOWS) && (layout != "tiled") &&
+		(layout != "even-horizontal") && (layout != "even-vertical") &&
+		(layout != "main-horizontal") && (layout != "main-vertical") {
+		return fmt.Errorf("invalid layout: '%s'", layout)
+	}
+
+	if (layout == TMUX_LAYOUT_WINDOWS) && synchronize {
+		return fmt.Errorf("option --synchronize requires a pane layout")
+	}
+
+	return nil
+}
+
+func processTmuxOptionLayout() {
+	var err error
+
+	err = checkTmuxLayout(*tmuxParams.OptionLayout,
+		*tmuxParams.OptionSynchronize)
+	if err != nil {
+		Error("%s", err.Error())
+	}
+}
+
+// Execute tmux with the given arguments.
+// Return the first line printed by tmux without its end of line, or an error
+// with the message printed by tmux if it fails.
+//
+func runTmux(args ...string) (string, error) {
+	var process *Process
+	var output, line string
+	var messages []string
+	var code int
+	var has bool
+
+	process = NewProcess(append([]string{"tmux"}, args...))
+	process.Start()
+	process.CloseStdin()
+
+	for {
+		line, has = process.ReadStdout()
+		if !has {
+			break
+		} else if output == "" {
+			output = strings.TrimRight(line, "\n")
+		}
+	}
+
+	for {
+		line, has = process.ReadStderr()
+		if !has {
+			break
+		}
+
+		messages = append(messages, strings.TrimRight(line, "\n"))
+	}
+
+	process.WaitFinished()
+
+	code, _ = process.ExitCode()
+	if code != 0 {
+		return "", fmt.Errorf("tmux %s: %s", args[0],
+			strings.Join(messages, " "))
+	}
+
+	return output, nil
+}
+
+// Return the shell command, as interpreted by tmux, opening an interactive
+// terminal on the given instance.
+//
+func tmuxLoginCommand(instance *Ec2Instance, connector *sshConnector) string {
+	var builder *SshProcessBuilder
+	var words []string = make([]string, 0)
+	var word string
+
+	builder = connector.Builder(instance, []string{})
+	builder.Tty()
+
+	for _, word = range builder.Cmdline() {
+		words = append(words, ShellQuote(word))
+	}
+
+	return strings.Join(words, " ")
+}
+
+// Create the tmux session with a terminal on each of the given instances.
+// Return an error if a tmux command fails.
+//
+func createTmuxSession(instances []*Ec2Instance) error {
+	var session string = *tmuxParams.OptionSession
+	var layout string = *tmuxParams.OptionLayout
+	var connector *sshConnector
+	var instance *Ec2Instance
+	var command, title, pane string
+	var i int
+	var err error
+
+	connector = newSshConnector(*tmuxParams.OptionContext,
+		*tmuxParams.OptionControlPersist, TRANSPORT_OPENSSH,
+		DEFAULT_NATIVE_CONCURRENCY, *tmuxParams.OptionCommand,
+		*tmuxParams.OptionUser, false)
+
+	for i, instance = range instances {
+		command = tmuxLoginCommand(instance, connector)
+		title = Format(*tmuxParams.OptionTitle, instance)
+
+		if i == 0 {
+			pane, err = runTmux("new-session", "-d", "-P", "-F",
+				"#{pane_id}", "-s", session, "-n", title,
+				command)
+		} else if layout == TMUX_LAYOUT_WINDOWS {
+			pane, err = runTmux("new-window", "-d", "-P", "-F",
+				"#{pane_id}", "-t", session+":", "-n", title,
+				command)
+		} else {
+			pane, err = runTmux("split-window", "-d", "-P", "-F",
+				"#{pane_id}", "-t", session+":", command)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if layout == TMUX_LAYOUT_WINDOWS {
+			continue
+		}
+
+		_, err = runTmux("select-pane", "-t", pane, "-T", title)
+		if err != nil {
+			return err
+		}
+
+		_, err = runTmux("select-layout", "-t", session+":", layout)
+		if err != nil {
+			return err
+		}
+	}
+
+	if layout == TMUX_LAYOUT_WINDOWS {
+		return nil
+	}
+
+	_, err = runTmux("set-window-option", "-t", session+":",
+		"pane-border-status", "top")
+	if err != nil {
+		return err
+	}
+
+	if *tmuxParams.OptionSynchronize {
+		_, err = runTmux("set-window-option", "-t", session+":",
+			"synchronize-panes", "on")
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Attach the tmux session, or switch to it if already inside tmux.
+// This function never returns.
+//
+func attachTmuxSession() {
+	var session string = *tmuxParams.OptionSession
+	var path string
+	var err error
+
+	path, err = exec.LookPath("tmux")
+	if err != nil {
+		Error("cannot find tmux: %s", err.Error())
+	}
+
+	if os.Getenv("TMUX") != "" {
+		err = syscall.Exec(path, []string{"tmux", "switch-client", "-t",
+			session}, os.Environ())
+	} else {
+		err = syscall.Exec(path, []string{"tmux", "attach-session",
+			"-t", session}, os.Environ())
+	}
+
+	Error("cannot execute tmux: %s", err.Error())
+}
+
+func Tmux(args []string) {
+	var flags *flag.FlagSet = flag.NewFlagSet("", flag.ContinueOnError)
+	var selection *Ec2Selection
+	var instances []*Ec2Instance
+	var specs []string
+	var ctx *Ec2Index
+	var err error
+
+	tmuxParams.OptionCommand = flags.String("command", DEFAULT_TMUX_COMMAND, "")
+	tmuxParams.OptionContext = flags.String("context", DEFAULT_TMUX_CONTEXT, "")
+	tmuxParams.OptionControlPersist = flags.String("control-persist", DEFAULT_TMUX_CONTROL_PERSIST, "")
+	tmuxParams.OptionDetach = flags.Bool("detach", DEFAULT_TMUX_DETACH, "")
+	tmuxParams.OptionLayout = flags.String("layout", DEFAULT_TMUX_LAYOUT, "")
+	tmuxParams.OptionSession = flags.String("session", DEFAULT_TMUX_SESSION, "")
+	tmuxParams.OptionSynchronize = flags.Bool("synchronize", DEFAULT_TMUX_SYNCHRONIZE, "")
+	tmuxParams.OptionTitle = flags.String("title", DEFAULT_TMUX_TITLE, "")
+	tmuxParams.OptionUser = flags.String("user", DEFAULT_TMUX_USER, "")
+
+	flags.Parse(args[1:])
+
+	processTmuxOptionLayout()
+
+	ctx, err = LoadEc2Index(*tmuxParams.OptionContext)
+	if err != nil {
+		Error("no context: %s", *tmuxParams.OptionContext)
+	}
+
+	specs = flags.Args()
+	if len(specs) == 0 {
+		specs = []string{"//"}
+	}
+
+	selection, err = ctx.Select(specs)
+	if err != nil {
+		Error("invalid specification: %s", err.Error())
+	}
+
+	instances = selection.Reachable(true)
+
+	if len(instances) == 0 {
+		Error("no instance to open")
+	}
+
+	err = createTmuxSession(instances)
+	if err != nil {
+		Error("%s", err.Error())
+	}
+
+	if !*tmuxParams.OptionDetach {
+		attachTmuxSession()
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckTmuxLayout(t *testing.T) {
+	if (checkTmuxLayout("tiled", true) != nil) ||
+		(checkTmuxLayout("main-vertical", false) != nil) ||
+		(checkTmuxLayout(TMUX_LAYOUT_WINDOWS, false) != nil) {
+		t.Fail()
+	}
+
+	if checkTmuxLayout("diagonal", false) == nil {
+		t.Fail()
+	}
+
+	if checkTmuxLayout(TMUX_LAYOUT_WINDOWS, true) == nil {
+		t.Fail()
+	}
+}
+
+func TestTmuxLoginCommand(t *testing.T) {
+	var fleet Ec2Fleet = Ec2Fleet{Name: "fleet", User: "ec2-user"}
+	var instance Ec2Instance = Ec2Instance{Name: "i-0", Fleet: &fleet,
+		PublicIp: "10.0.0.1"}
+	var connector *sshConnector
+	var command string
+
+	connector = newSshConnector("/my ctx", CONTROL_PERSIST_NONE,
+		TRANSPORT_OPENSSH, DEFAULT_NATIVE_CONCURRENCY, "", "", false)
+	command = tmuxLoginCommand(&instance, connector)
+
+	if !strings.HasPrefix(command, "'ssh' ") ||
+		!strings.Contains(command,
+			" 'UserKnownHostsFile=/my ctx"+KNOWN_HOSTS_SUFFIX+"' ") ||
+		!strings.HasSuffix(command, " '-t' 'ec2-user@10.0.0.1'") {
+		t.Fail()
+	}
+
+	connector = newSshConnector("/ctx", CONTROL_PERSIST_NONE,
+		TRANSPORT_OPENSSH, DEFAULT_NATIVE_CONCURRENCY, "my-ssh -F it's",
+		"admin", false)
+	command = tmuxLoginCommand(&instance, connector)
+
+	if !strings.HasPrefix(command, "'my-ssh' '-F' 'it'\\''s' ") ||
+		!strings.HasSuffix(command, " '-t' 'admin@10.0.0.1'") {
+		t.Fail()
+	}
+}
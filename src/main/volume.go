@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"strconv"
+	"strings"
+)
+
+// The storage attached to the instances of a fleet on a given device.
+// A volume is either an EBS volume, with an optional size, type and
+// provisioned IOPS, or an instance store volume identified by its virtual
+// name.
+//
+type Ec2Volume struct {
+	Device    string // device name (e.g. '/dev/sdb')
+	Ephemeral string // instance store name (e.g. 'ephemeral0') or ""
+	Size      int    // size of an EBS volume in GiB (0 for default)
+	Type      string // type of an EBS volume (e.g. 'gp2') or "" for default
+	Iops      int    // provisioned IOPS of an EBS volume (0 for default)
+}
+
+// An error related to an ill formed volume specification.
+// Implements the error interface.
+//
+type VolumeSpecError struct {
+	message string
+}
+
+// The implementation of error.Error() method for VolumeSpecError.
+//
+func (this *VolumeSpecError) Error() string {
+	return this.message
+}
+
+// Create a new VolumeSpecError for the given specification.
+//
+func newVolumeSpecError(spec, reason string) *VolumeSpecError {
+	var err VolumeSpecError
+
+	err.message = fmt.Sprintf("invalid volume '%s': %s", spec, reason)
+
+	return &err
+}
+
+// Test if a volume description designates an instance store volume.
+// An instance store volume is named 'ephemeral' followed by its index.
+//
+func isEphemeralName(desc string) bool {
+	var err error
+
+	if !strings.HasPrefix(desc, "ephemeral") {
+		return false
+	}
+
+	_, err = strconv.Atoi(desc[len("ephemeral"):])
+	return (err == nil)
+}
+
+// Test if the given EBS volume type accepts a provisioned IOPS value.
+//
+func isIopsVolumeType(volumeType string) bool {
+	return (volumeType == "io1") || (volumeType == "io2") ||
+		(volumeType == "gp3")
+}
+
+// Parse a non negative integer field of a volume specification.
+// An empty field is the same as 0.
+//
+func parseVolumeInt(spec, field, name string) (int, error) {
+	var value int
+	var err error
+
+	if field == "" {
+		return 0, nil
+	}
+
+	value, err = strconv.Atoi(field)
+	if (err != nil) || (value < 0) {
+		return 0, newVolumeSpecError(spec, "invalid "+name)
+	}
+
+	return value, nil
+}
+
+// Parse a volume specification and return the corresponding Ec2Volume.
+// The BNF for a volume specification is as follows:
+//
+//     volume-spec ::= device '=' ephemeral
+//                   | device '=' size [ ':' type [ ':' iops ] ]
+//
+//     ephemeral   ::= 'ephemeral' integer
+//
+//     size        ::= integer
+//
+//     iops        ::= '' | integer
+//
+// The size is expressed in GiB and is required since AWS cannot create an
+// additional EBS volume without it. An empty iops keeps the default value of
+// the volume type, other values are only accepted by the 'io1', 'io2' and
+// 'gp3' types.
+// Return an error if the specification is ill formed.
+//
+func ParseVolumeSpec(spec string) (*Ec2Volume, error) {
+	var volume Ec2Volume
+	var fields []string
+	var desc string
+	var pos int
+	var err error
+
+	pos = strings.Index(spec, "=")
+	if pos < 0 {
+		return nil, newVolumeSpecError(spec, "missing '='")
+	} else if pos == 0 {
+		return nil, newVolumeSpecError(spec, "missing device name")
+	}
+
+	volume.Device = spec[:pos]
+	desc = spec[(pos + 1):]
+
+	if isEphemeralName(desc) {
+		volume.Ephemeral = desc
+		return &volume, nil
+	}
+
+	fields = strings.Split(desc, ":")
+	if len(fields) > 3 {
+		return nil, newVolumeSpecError(spec, "too many fields")
+	}
+
+	volume.Size, err = parseVolumeInt(spec, fields[0], "size")
+	if err != nil {
+		return nil, err
+	} else if volume.Size == 0 {
+		return nil, newVolumeSpecError(spec, "missing size")
+	}
+
+	if len(fields) > 1 {
+		volume.Type = fields[1]
+	}
+
+	if len(fields) > 2 {
+		volume.Iops, err = parseVolumeInt(spec, fields[2], "iops")
+		if err != nil {
+			return nil, err
+		} else if (volume.Iops > 0) && !isIopsVolumeType(volume.Type) {
+			return nil, newVolumeSpecError(spec,
+				"iops require type 'io1', 'io2' or 'gp3'")
+		}
+	}
+
+	return &volume, nil
+}
+
+// Return the specification of this volume.
+// The returned string can be parsed back with ParseVolumeSpec() unless this
+// is an EBS volume without a size, like a root volume keeping the size of its
+// image.
+//
+func (this *Ec2Volume) String() string {
+	var ret string = this.Device + "="
+
+	if this.Ephemeral != "" {
+		return ret + this.Ephemeral
+	}
+
+	if this.Size > 0 {
+		ret += strconv.Itoa(this.Size)
+	}
+
+	if this.Iops > 0 {
+		ret += ":" + this.Type + ":" + strconv.Itoa(this.Iops)
+	} else if this.Type != "" {
+		ret += ":" + this.Type
+	}
+
+	return ret
+}
+
+// Return the AWS EC2 block device mapping corresponding to this volume.
+// EBS volumes are deleted when the instance terminates.
+//
+func (this *Ec2Volume) BlockDeviceMapping() *ec2.BlockDeviceMapping {
+	var mapping ec2.BlockDeviceMapping
+	var ebs ec2.EbsBlockDevice
+
+	mapping.DeviceName = aws.String(this.Device)
+
+	if this.Ephemeral != "" {
+		mapping.VirtualName = aws.String(this.Ephemeral)
+		return &mapping
+	}
+
+	ebs.DeleteOnTermination = aws.Bool(true)
+
+	if this.Size > 0 {
+		ebs.VolumeSize = aws.Int64(int64(this.Size))
+	}
+	if this.Type != "" {
+		ebs.VolumeType = aws.String(this.Type)
+	}
+	if this.Iops > 0 {
+		ebs.Iops = aws.Int64(int64(this.Iops))
+	}
+
+	mapping.Ebs = &ebs
+
+	return &mapping
+}
+
+// Create the Ec2Volume corresponding to an AWS EC2 block device mapping.
+// This is the reverse operation of Ec2Volume.BlockDeviceMapping().
+//
+func NewEc2VolumeFromMapping(mapping *ec2.BlockDeviceMapping) *Ec2Volume {
+	var volume Ec2Volume
+
+	volume.Device = aws.StringValue(mapping.DeviceName)
+	volume.Ephemeral = aws.StringValue(mapping.VirtualName)
+
+	if mapping.Ebs != nil {
+		volume.Size = int(aws.Int64Value(mapping.Ebs.VolumeSize))
+		volume.Type = aws.StringValue(mapping.Ebs.VolumeType)
+		volume.Iops = int(aws.Int64Value(mapping.Ebs.Iops))
+	}
+
+	return &volume
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseVolumeSpecEbs(t *testing.T) {
+	var volume *Ec2Volume
+	var err error
+
+	volume, err = ParseVolumeSpec("/dev/sdb=500:io1:5000")
+
+	if err != nil {
+		t.FailNow()
+	} else if volume.Device != "/dev/sdb" {
+		t.Fail()
+	} else if volume.Ephemeral != "" {
+		t.Fail()
+	} else if volume.Size != 500 {
+		t.Fail()
+	} else if volume.Type != "io1" {
+		t.Fail()
+	} else if volume.Iops != 5000 {
+		t.Fail()
+	}
+}
+
+func TestParseVolumeSpecPartial(t *testing.T) {
+	var volume *Ec2Volume
+	var err error
+
+	volume, err = ParseVolumeSpec("/dev/sdb=8:gp2")
+
+	if err != nil {
+		t.FailNow()
+	} else if volume.Device != "/dev/sdb" {
+		t.Fail()
+	} else if volume.Size != 8 {
+		t.Fail()
+	} else if volume.Type != "gp2" {
+		t.Fail()
+	} else if volume.Iops != 0 {
+		t.Fail()
+	}
+}
+
+func TestParseVolumeSpecEphemeral(t *testing.T) {
+	var volume *Ec2Volume
+	var err error
+
+	volume, err = ParseVolumeSpec("/dev/sdc=ephemeral1")
+
+	if err != nil {
+		t.FailNow()
+	} else if volume.Device != "/dev/sdc" {
+		t.Fail()
+	} else if volume.Ephemeral != "ephemeral1" {
+		t.Fail()
+	} else if volume.Size != 0 {
+		t.Fail()
+	}
+}
+
+func TestParseVolumeSpecInvalid(t *testing.T) {
+	var spec string
+	var err error
+
+	for _, spec = range []string{"", "/dev/sdb", "=100", "/dev/sdb=a",
+		"/dev/sdb=-1", "/dev/sdb=100:io1:x", "/dev/sdb=1:io1:1:1",
+		"/dev/sdb=", "/dev/sdb=0", "/dev/sdb=:gp2", "/dev/sdb=:io1:100",
+		"/dev/sdb=100:gp2:100", "/dev/sdb=100::100"} {
+		_, err = ParseVolumeSpec(spec)
+		if err == nil {
+			t.Fail()
+		}
+	}
+}
+
+func TestVolumeString(t *testing.T) {
+	var volume *Ec2Volume
+	var spec string
+
+	for _, spec = range []string{"/dev/sdb=500:io1:5000", "/dev/sdb=100",
+		"/dev/sdc=ephemeral0", "/dev/sdd=8:gp2"} {
+		volume, _ = ParseVolumeSpec(spec)
+		if volume == nil {
+			t.FailNow()
+		} else if volume.String() != spec {
+			t.Fail()
+		}
+	}
+}
+
+func TestVolumeStringRoot(t *testing.T) {
+	var volume Ec2Volume = Ec2Volume{Device: "/dev/sda1", Type: "gp2"}
+
+	if volume.String() != "/dev/sda1=:gp2" {
+		t.Fail()
+	}
+}
+
+func TestNewEc2VolumeFromMapping(t *testing.T) {
+	var volume *Ec2Volume
+	var spec string
+
+	for _, spec = range []string{"/dev/sdb=500:io1:5000", "/dev/sdb=100",
+		"/dev/sdc=ephemeral0", "/dev/sdd=8:gp2"} {
+		volume, _ = ParseVolumeSpec(spec)
+		if volume == nil {
+			t.FailNow()
+		}
+
+		volume = NewEc2VolumeFromMapping(volume.BlockDeviceMapping())
+		if volume.String() != spec {
+			t.Fail()
+		}
+	}
+}
@@ -14,21 +14,32 @@ const (
 )
 
 type waitParameters struct {
-	OptionCommand *string
-	OptionContext *string
-	OptionCount   *string
-	OptionTimeout *string
-	OptionVerbose *bool
-	OptionWaitFor *string
+	OptionCommand           *string
+	OptionContext           *string
+	OptionControlPersist    *string
+	OptionCount             *string
+	OptionNativeConcurrency *int
+	OptionTimeout           *string
+	OptionTransport         *string
+	OptionVerbose           *bool
+	OptionWaitFor           *string
 }
 
 var DEFAULT_WAIT_COMMAND string = ""
 var DEFAULT_WAIT_CONTEXT string = DEFAULT_CONTEXT
+var DEFAULT_WAIT_CONTROL_PERSIST string = DEFAULT_CONTROL_PERSIST
 var DEFAULT_WAIT_COUNT string = "100%"
+var DEFAULT_WAIT_NATIVE_CONCURRENCY int = DEFAULT_NATIVE_CONCURRENCY
 var DEFAULT_WAIT_TIMEOUT string = ""
+var DEFAULT_WAIT_TRANSPORT string = DEFAULT_TRANSPORT
 var DEFAULT_WAIT_VERBOSE bool = false
 var DEFAULT_WAIT_WAIT_FOR string = "ssh"
 
+// The minimum number of seconds between two checks of the console output of
+// an instance for its host keys.
+//
+var DEFAULT_WAIT_CONSOLE_PERIOD float64 = 10
+
 var waitParams waitParameters
 
 type processedOptionCount struct {
@@ -49,6 +60,10 @@ definition can be modified by options.
 The fleet specifications can be either exact fleet names or regular
 expressions. In this last case, it starts and ends with a '/' character.
 If no fleet specification is supplied, wait for all fleets.
+When waiting for ssh, the host keys of the instances are collected from their
+console output when available, or trusted on first use otherwise, and recorded
+in the known_hosts file of the context (the context path with a '.known_hosts'
+suffix).
 
 Options:
 
@@ -57,14 +72,25 @@ Options:
 
   --context <path>            path of the context file (default: '%s')
 
+  --control-persist <time>    keep the ssh connections open in background for
+                              <time> so the next commands reuse them, or
+                              'none' to disable (default: '%s')
+
   --count <count|proportion>  the minimum count of instances per fleet
                               specification (or the minimum proportion if
                               argument ends with a '%%') to wait
 
+  --native-concurrency <n>    establish at most <n> connections at the same
+                              time with the native transport, the checks
+                              are not limited once connected (default: %d)
+
   --timeout <timespec>        maximum time to wait the instances specified in
                               format like '30' (seconds), '1m20' or even
                               '1h 40m 30s'
 
+  --transport <name>          connect with 'openssh' or 'native' when waiting
+                              for ssh reachable instances (default: '%s')
+
   --verbose                   print what is happening as well as the debug
                               output for ssh connections
 
@@ -72,7 +98,9 @@ Options:
                               it has a public IPv4 address. 'ssh' when it is
                               reachable via ssh (default: '%s').
 `,
-		PROGNAME, DEFAULT_CONTEXT, DEFAULT_WAIT_WAIT_FOR)
+		PROGNAME, DEFAULT_CONTEXT, DEFAULT_WAIT_CONTROL_PERSIST,
+		DEFAULT_WAIT_NATIVE_CONCURRENCY, DEFAULT_WAIT_TRANSPORT,
+		DEFAULT_WAIT_WAIT_FOR)
 }
 
 func computeRequiredCount(maximumCount int) int {
@@ -177,19 +205,94 @@ func (this *ValidityMapIp) Finalize() {
 // If the ssh process exits successfully, the instance is valid.
 //
 type ValidityMapSsh struct {
-	Processes map[*Ec2Instance]*Process
+	Processes  map[*Ec2Instance]*Process
+	Transport  *NativeSshTransport        // native transport or nil for ssh
+	Control    *SshControl                // connection multiplexing or nil
+	KnownHosts *KnownHosts                // host keys of the instances
+	Consoles   map[*Ec2Instance]float64   // last console check (in seconds)
+	Collects   map[*Ec2Instance]chan bool // closed when console check done
+	Started    time.Time                  // creation date of the map
 }
 
-// Create a new empty ValidityMapSsh.
+// Create a new empty ValidityMapSsh recording the host keys in the given
+// known hosts.
+// If transport is not nil, use it instead of launching ssh processes.
+// If control is not nil, open master connections reused by the next commands.
 //
-func NewValidityMapSsh() *ValidityMapSsh {
+func NewValidityMapSsh(knownHosts *KnownHosts, transport *NativeSshTransport, control *SshControl) *ValidityMapSsh {
 	var this ValidityMapSsh
 
 	this.Processes = make(map[*Ec2Instance]*Process)
+	this.Transport = transport
+	this.Control = control
+	this.KnownHosts = knownHosts
+	this.Consoles = make(map[*Ec2Instance]float64)
+	this.Collects = make(map[*Ec2Instance]chan bool)
+	this.Started = time.Now()
 
 	return &this
 }
 
+// Try to collect the host keys of the given instance from its console output
+// in background, so they are known before the first ssh connection.
+// The console output of an instance is checked at most every
+// DEFAULT_WAIT_CONSOLE_PERIOD seconds.
+//
+func (this *ValidityMapSsh) collectHostKeys(instance *Ec2Instance) {
+	var now float64 = time.Since(this.Started).Seconds()
+	var done chan bool = make(chan bool)
+	var last float64
+	var found bool
+
+	last, found = this.Consoles[instance]
+	if found && ((now - last) < DEFAULT_WAIT_CONSOLE_PERIOD) {
+		return
+	}
+
+	this.Consoles[instance] = now
+	this.Collects[instance] = done
+
+	go func() {
+		var known bool
+		var err error
+
+		defer close(done)
+
+		known, err = this.KnownHosts.Collect(instance)
+		if !*waitParams.OptionVerbose {
+			return
+		}
+
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[ec2tools] cannot fetch console "+
+				"of %s: %s\n", instance.Name, err.Error())
+		} else if known {
+			fmt.Fprintf(os.Stderr, "[ec2tools] host keys of %s "+
+				"known\n", instance.Name)
+		}
+	}()
+}
+
+// Indicate if the host keys of the given instance are being collected from
+// its console output.
+//
+func (this *ValidityMapSsh) collectingHostKeys(instance *Ec2Instance) bool {
+	var done chan bool
+	var found bool
+
+	done, found = this.Collects[instance]
+	if !found {
+		return false
+	}
+
+	select {
+	case <-done:
+		return false
+	default:
+		return true
+	}
+}
+
 // Try to see if the specified instance is reachable.
 // If the process has no associated ssh background process, launch one.
 // If it has an associated ssh background process that finished with failure,
@@ -210,6 +313,13 @@ func (this *ValidityMapSsh) UpdateValidity(instance *Ec2Instance,
 	}
 
 	if !found || (exited && (exitcode != 0)) {
+		// Do not let ssh record a key in the known hosts while the
+		// console keys are being recorded, try again later instead
+		this.collectHostKeys(instance)
+		if this.collectingHostKeys(instance) {
+			return
+		}
+
 		if *waitParams.OptionCommand == "" {
 			builder = BuildSshProcess(instance, []string{"true"})
 		} else {
@@ -233,6 +343,14 @@ func (this *ValidityMapSsh) UpdateValidity(instance *Ec2Instance,
 			builder.Verbose()
 		}
 
+		if this.Control != nil {
+			builder.Control(this.Control)
+		}
+		builder.KnownHosts(this.KnownHosts)
+		if this.Transport != nil {
+			builder.Native(this.Transport)
+		}
+
 		this.Processes[instance] = builder.Build()
 		this.Processes[instance].Start()
 	}
@@ -301,6 +419,10 @@ func (this *ValidityMapSsh) Finalize() {
 	for _, proc = range this.Processes {
 		proc.WaitFinished()
 	}
+
+	if this.Transport != nil {
+		this.Transport.Close()
+	}
 }
 
 // - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - -
@@ -360,11 +482,24 @@ func validSelection(selection *Ec2Selection, validityMap ValidityMap) bool {
 func waitFleets(ctx *Ec2Index, specs []string) bool {
 	var selections []*Ec2Selection
 	var selection *Ec2Selection
+	var transport *NativeSshTransport
 	var validityMap ValidityMap
+	var knownHosts *KnownHosts
+	var control *SshControl
 	var valid bool
 
+	knownHosts = NewKnownHosts(*waitParams.OptionContext)
+	control = OpenSshControl(*waitParams.OptionContext,
+		*waitParams.OptionControlPersist)
+
+	if *waitParams.OptionTransport == TRANSPORT_NATIVE {
+		transport = OpenNativeSshTransport(knownHosts,
+			*waitParams.OptionNativeConcurrency)
+	}
+
 	if *waitParams.OptionWaitFor == "ssh" {
-		validityMap = NewValidityMapSsh()
+		validityMap = NewValidityMapSsh(knownHosts, transport,
+			control)
 	} else if *waitParams.OptionWaitFor == "ip" {
 		validityMap = NewValidityMapIp()
 	} else {
@@ -470,8 +605,11 @@ func Wait(args []string) {
 
 	waitParams.OptionCommand = flags.String("command", DEFAULT_WAIT_COMMAND, "")
 	waitParams.OptionContext = flags.String("context", DEFAULT_WAIT_CONTEXT, "")
+	waitParams.OptionControlPersist = flags.String("control-persist", DEFAULT_WAIT_CONTROL_PERSIST, "")
 	waitParams.OptionCount = flags.String("count", DEFAULT_WAIT_COUNT, "")
+	waitParams.OptionNativeConcurrency = flags.Int("native-concurrency", DEFAULT_WAIT_NATIVE_CONCURRENCY, "")
 	waitParams.OptionTimeout = flags.String("timeout", DEFAULT_WAIT_TIMEOUT, "")
+	waitParams.OptionTransport = flags.String("transport", DEFAULT_WAIT_TRANSPORT, "")
 	waitParams.OptionVerbose = flags.Bool("verbose", DEFAULT_WAIT_VERBOSE, "")
 	waitParams.OptionWaitFor = flags.String("wait-for", DEFAULT_WAIT_WAIT_FOR, "")
 
@@ -480,6 +618,13 @@ func Wait(args []string) {
 	processOptionCount()
 	processOptionTimeout()
 
+	if !IsTransport(*waitParams.OptionTransport) {
+		Error("invalid transport: '%s'", *waitParams.OptionTransport)
+	} else if (*waitParams.OptionTransport == TRANSPORT_NATIVE) &&
+		(*waitParams.OptionCommand != "") {
+		Error("cannot use a custom command with the native transport")
+	}
+
 	if len(flags.Args()) == 0 {
 		fleetSpecs = []string{"@//"}
 	} else {
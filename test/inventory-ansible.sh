@@ -0,0 +1,29 @@
+#!/bin/bash
+
+set -e
+
+# Create a fake context as we work locally
+cp '../test/context-10instances-sydney.json' '.ec2tools'
+
+# Every instance is listed with its variables and in the groups of its fleet
+# and of its region
+inventory=$(ec2tools inventory --ansible --list)
+test $(echo "$inventory" | grep -c '"ec2tools_name"') -eq 10
+echo "$inventory" | grep -q '"fleet_test_fleet"'
+echo "$inventory" | grep -q '"region_ap_southeast_2"'
+
+# An attribute value creates a group prefixed by 'attr_'
+ec2tools set '/^i-0c/' -- 'role' 'db'
+ec2tools inventory --ansible --list | grep -q '"attr_role_db"'
+
+# The variables of a host give its address and user
+name=$(ec2tools get name | head -n 1)
+ip=$(ec2tools get "$name" -- public-ip)
+host=$(ec2tools inventory --ansible --host "$name")
+echo "$host" | grep -q "\"ansible_host\": \"$ip\""
+echo "$host" | grep -q '"ansible_user": "ubuntu"'
+
+# Remove the fake context so nobody complains
+rm '.ec2tools'
+
+exit 0